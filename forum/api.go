@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+type envelope map[string]any
+
+func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+	return nil
+}
+
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	// limit request bodies to 1MB
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+		var invalidUnmarshalError *json.InvalidUnmarshalError
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("body contains badly-formed JSON")
+		case errors.As(err, &unmarshalTypeError):
+			if unmarshalTypeError.Field != "" {
+				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+			}
+			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return fmt.Errorf("body contains unknown key %s", fieldName)
+		case errors.As(err, &maxBytesError):
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+		// passing a non-pointer to Decode is a bug in the handler
+		case errors.As(err, &invalidUnmarshalError):
+			panic(err)
+		default:
+			return err
+		}
+	}
+
+	// the body must only contain a single JSON value
+	err = dec.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		return errors.New("body must only contain a single JSON value")
+	}
+
+	return nil
+}
+
+func (app *application) errorResponse(w http.ResponseWriter, status int, message any) {
+	body := envelope{"error": envelope{"status": status, "message": message}}
+
+	err := app.writeJSON(w, status, body, nil)
+	if err != nil {
+		app.errorLog.Output(2, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (app *application) serverErrorResponse(w http.ResponseWriter, err error) {
+	app.errorLog.Output(2, err.Error())
+	app.errorResponse(w, http.StatusInternalServerError, "the server encountered a problem and could not process your request")
+}
+
+func (app *application) badRequestResponse(w http.ResponseWriter, err error) {
+	app.errorResponse(w, http.StatusBadRequest, err.Error())
+}
+
+func (app *application) notFoundResponse(w http.ResponseWriter) {
+	app.errorResponse(w, http.StatusNotFound, "the requested resource could not be found")
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter) {
+	app.errorResponse(w, http.StatusForbidden, "you do not have permission to access this resource")
+}
+
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter) {
+	app.errorResponse(w, http.StatusUnauthorized, "you must be authenticated to access this resource")
+}
+
+func (app *application) invalidCredentialsResponse(w http.ResponseWriter) {
+	app.errorResponse(w, http.StatusUnauthorized, "invalid authentication credentials")
+}
+
+func (app *application) twoFactorRequiredResponse(w http.ResponseWriter) {
+	app.errorResponse(w, http.StatusUnauthorized, "the account has two-factor authentication, the code is required")
+}
+
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	app.errorResponse(w, http.StatusUnauthorized, "invalid or missing authentication token")
+}
+
+func (app *application) inactiveAccountResponse(w http.ResponseWriter) {
+	app.errorResponse(w, http.StatusForbidden, "your account must be activated to access this resource")
+}
+
+func (app *application) bannedResponse(w http.ResponseWriter) {
+	app.errorResponse(w, http.StatusForbidden, "your account is banned, see /banned for details")
+}
+
+func (app *application) accountLockedResponse(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfter(wait))
+	app.errorResponse(w, http.StatusForbidden, "the account is locked after too many failed logins, try again later")
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfter(wait))
+	app.errorResponse(w, http.StatusTooManyRequests, "rate limit exceeded")
+}
+
+func (app *application) failedValidationResponse(w http.ResponseWriter, v Validator) {
+	body := envelope{
+		"error": envelope{
+			"status":  http.StatusUnprocessableEntity,
+			"message": "the request failed validation",
+			"fields":  v.FieldErrors,
+			"errors":  v.NonFieldErrors,
+		},
+	}
+
+	err := app.writeJSON(w, http.StatusUnprocessableEntity, body, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+// modelErrorResponse maps the models.Err* sentinels onto HTTP status codes so
+// every API endpoint reports the same failure in the same way
+func (app *application) modelErrorResponse(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrNoRecordFound), errors.Is(err, models.ErrNoCommentsForPost):
+		app.errorResponse(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, models.ErrInvalidCursor), errors.Is(err, models.ErrInvalidSort), errors.Is(err, models.ErrInvalidWindow),
+		errors.Is(err, models.ErrInvalidModAction), errors.Is(err, models.ErrInvalidPollVote):
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, models.ErrPostLocked), errors.Is(err, models.ErrBanned), errors.Is(err, models.ErrPollClosed):
+		app.errorResponse(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, models.ErrInvalidCredentials):
+		app.errorResponse(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, models.ErrDuplicateEmail), errors.Is(err, models.ErrDuplicateUsername),
+		errors.Is(err, models.ErrCannotLikeAgain), errors.Is(err, models.ErrCannotDislikeAgain),
+		errors.Is(err, models.ErrConcurrencyControl), errors.Is(err, models.ErrDuplicateLink),
+		errors.Is(err, models.ErrAlreadyVoted):
+		app.errorResponse(w, http.StatusConflict, err.Error())
+	default:
+		app.serverErrorResponse(w, err)
+	}
+}
+
+// apiIDParam reads the :id route parameter, writing a 404 response if it is not a positive integer
+func (app *application) apiIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFoundResponse(w)
+		return 0, false
+	}
+	return id, true
+}
+
+// pageLinks turns the cursors of a page into links to the neighbouring pages,
+// keeping every other query parameter of the current request
+func (app *application) pageLinks(r *http.Request, page models.Page) envelope {
+	link := func(key, cursor string) string {
+		qs := r.URL.Query()
+		qs.Del("after")
+		qs.Del("before")
+		qs.Set("sort", page.Sort)
+		qs.Set("limit", strconv.Itoa(page.Limit))
+		qs.Set(key, cursor)
+		return r.URL.Path + "?" + qs.Encode()
+	}
+
+	links := envelope{}
+	if page.Next != "" {
+		links["next"] = link("after", page.Next)
+	}
+	if page.Prev != "" {
+		links["prev"] = link("before", page.Prev)
+	}
+	return links
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	_ "golang.org/x/image/webp"
+
+	"github.com/groth00/forum/internal/models"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// images larger than this are rejected before they are decoded, for GIFs
+	// it is the sum of the pixels of every frame
+	maxImagePixels = 40_000_000
+	maxGIFFrames   = 1000
+	// longest side of the thumbnails
+	thumbnailSize = 320
+	// how long a post or comment with attachments may take to upload, the
+	// read timeout of the server is for requests without files
+	uploadTimeout = 2 * time.Minute
+)
+
+// content types accepted as attachments, as sniffed by http.DetectContentType,
+// and the extension of their storage keys
+var attachmentTypes = map[string]string{
+	"image/jpeg":                ".jpg",
+	"image/png":                 ".png",
+	"image/gif":                 ".gif",
+	"image/webp":                ".webp",
+	"application/pdf":           ".pdf",
+	"text/plain; charset=utf-8": ".txt",
+}
+
+var (
+	errAttachmentTooLarge = errors.New("attachment is too large")
+	errAttachmentType     = errors.New("attachment type is not allowed")
+	errAttachmentImage    = errors.New("attachment is not a valid image")
+)
+
+// upload is an attachment that was checked and processed but not stored yet
+type upload struct {
+	attachment *models.Attachment
+	data       []byte
+	thumbnail  []byte
+}
+
+// readAttachments processes the files of the "attachments" field of a
+// multipart form, problems with the files are added to the validator
+func (app *application) readAttachments(r *http.Request, v *Validator) ([]*upload, error) {
+	err := r.ParseMultipartForm(app.config.uploads.maxSize)
+	if err != nil {
+		if errors.Is(err, http.ErrNotMultipart) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	files := r.MultipartForm.File["attachments"]
+	if len(files) > app.config.uploads.maxFiles {
+		v.AddFieldError("attachments", fmt.Sprintf("at most %d files can be attached", app.config.uploads.maxFiles))
+		return nil, nil
+	}
+
+	uploads := []*upload{}
+	for _, header := range files {
+		u, err := app.processUpload(header)
+		if err != nil {
+			switch {
+			case errors.Is(err, errAttachmentTooLarge):
+				v.AddFieldError("attachments", fmt.Sprintf("%s is larger than %d MB", header.Filename, app.config.uploads.maxSize>>20))
+			case errors.Is(err, errAttachmentType):
+				v.AddFieldError("attachments", fmt.Sprintf("%s is not an image, PDF or text file", header.Filename))
+			case errors.Is(err, errAttachmentImage):
+				v.AddFieldError("attachments", fmt.Sprintf("%s could not be read as an image", header.Filename))
+			default:
+				return nil, err
+			}
+			continue
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+// processUpload sniffs the type of an uploaded file and re-encodes images,
+// which drops their EXIF data, and makes their thumbnails
+func (app *application) processUpload(header *multipart.FileHeader) (*upload, error) {
+	if header.Size > app.config.uploads.maxSize {
+		return nil, errAttachmentTooLarge
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, app.config.uploads.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > app.config.uploads.maxSize {
+		return nil, errAttachmentTooLarge
+	}
+
+	content_type := http.DetectContentType(data)
+	ext, ok := attachmentTypes[content_type]
+	if !ok {
+		return nil, errAttachmentType
+	}
+
+	key, err := attachmentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upload{
+		attachment: &models.Attachment{
+			Filename:    attachmentFilename(header.Filename),
+			ContentType: content_type,
+		},
+		data: data,
+	}
+
+	if strings.HasPrefix(content_type, "image/") {
+		err = u.processImage()
+		if err != nil {
+			return nil, err
+		}
+		// webp is decoded but stored as png, there is no webp encoder
+		ext = attachmentTypes[u.attachment.ContentType]
+		u.attachment.ThumbKey = "attachments/" + key + "_thumb" + attachmentTypes[thumbnailType(u.attachment.ContentType)]
+	}
+
+	u.attachment.StorageKey = "attachments/" + key + ext
+	u.attachment.Size = int64(len(u.data))
+	return u, nil
+}
+
+func (u *upload) processImage() error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(u.data))
+	if err != nil {
+		return errAttachmentImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return errAttachmentImage
+	}
+
+	var buf bytes.Buffer
+	var img image.Image
+
+	// encoding the decoded image again keeps the pixels and nothing else; the
+	// EXIF orientation is lost with the rest of the metadata
+	if u.attachment.ContentType == "image/gif" {
+		frames, pixels, err := gifSize(u.data)
+		if err != nil || frames > maxGIFFrames || pixels > maxImagePixels {
+			return errAttachmentImage
+		}
+
+		animation, err := gif.DecodeAll(bytes.NewReader(u.data))
+		if err != nil {
+			return errAttachmentImage
+		}
+		if err := gif.EncodeAll(&buf, animation); err != nil {
+			return err
+		}
+		img = animation.Image[0]
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(u.data))
+		if err != nil {
+			return errAttachmentImage
+		}
+		if err := encodeImage(&buf, img, u.attachment.ContentType); err != nil {
+			return err
+		}
+		if u.attachment.ContentType == "image/webp" {
+			u.attachment.ContentType = "image/png"
+		}
+	}
+
+	thumbnail, err := makeThumbnail(img, thumbnailType(u.attachment.ContentType))
+	if err != nil {
+		return err
+	}
+
+	u.data = buf.Bytes()
+	u.thumbnail = thumbnail
+	u.attachment.Width = config.Width
+	u.attachment.Height = config.Height
+	return nil
+}
+
+// gifSize counts the frames of a GIF and adds up their pixels by walking the
+// blocks of the file without decompressing them; gif.DecodeAll keeps every
+// frame in memory, a small file can hold thousands of them
+func gifSize(data []byte) (frames, pixels int, err error) {
+	r := bytes.NewReader(data)
+
+	// header and logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, err
+	}
+	if err := skipColorTable(r, header[10]); err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		block, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		switch block {
+		case 0x21: // extension, its label and data sub-blocks
+			if _, err := r.ReadByte(); err != nil {
+				return 0, 0, err
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, 0, err
+			}
+		case 0x2c: // image descriptor, color table, LZW code size and data sub-blocks
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return 0, 0, err
+			}
+			frames++
+			pixels += int(binary.LittleEndian.Uint16(descriptor[4:6])) * int(binary.LittleEndian.Uint16(descriptor[6:8]))
+
+			if err := skipColorTable(r, descriptor[8]); err != nil {
+				return 0, 0, err
+			}
+			if _, err := r.ReadByte(); err != nil {
+				return 0, 0, err
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, 0, err
+			}
+		case 0x3b: // trailer
+			return frames, pixels, nil
+		default:
+			return 0, 0, errAttachmentImage
+		}
+	}
+}
+
+// skipColorTable skips the color table announced by the flags of a
+// descriptor, if there is one
+func skipColorTable(r *bytes.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := r.Seek(3<<(flags&0x07+1), io.SeekCurrent)
+	return err
+}
+
+// skipSubBlocks skips data sub-blocks up to the empty one ending them
+func skipSubBlocks(r *bytes.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := r.Seek(int64(size), io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+}
+
+// makeThumbnail scales the image down to fit in a thumbnailSize square,
+// smaller images are only encoded again
+func makeThumbnail(img image.Image, content_type string) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width > thumbnailSize || height > thumbnailSize {
+		if width > height {
+			width, height = thumbnailSize, max(1, height*thumbnailSize/width)
+		} else {
+			width, height = max(1, width*thumbnailSize/height), thumbnailSize
+		}
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, thumb, content_type); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// thumbnailType is the content type of the thumbnails of images of
+// content_type, only the first frame of a GIF is kept so it becomes a png
+func thumbnailType(content_type string) string {
+	if content_type == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// encodeImage writes jpegs as jpeg and everything else as png
+func encodeImage(w io.Writer, img image.Image, content_type string) error {
+	if content_type == "image/jpeg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	}
+	return png.Encode(w, img)
+}
+
+// attachmentKey returns a random name for a stored file, the name given by
+// the uploader is only kept in the database
+func attachmentKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// attachmentFilename strips the directories and control characters from the
+// name of an uploaded file
+func attachmentFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+
+	if runes := []rune(name); len(runes) > 128 {
+		name = string(runes[:128])
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "attachment"
+	}
+	return name
+}
+
+// storeUploads saves the files and thumbnails in the storage backend, on
+// failure the ones already saved are deleted again
+func (app *application) storeUploads(ctx context.Context, uploads []*upload) error {
+	stored := []*upload{}
+	for _, u := range uploads {
+		a := u.attachment
+		err := app.storage.Put(ctx, a.StorageKey, bytes.NewReader(u.data), int64(len(u.data)), a.ContentType)
+		if err == nil && a.ThumbKey != "" {
+			err = app.storage.Put(ctx, a.ThumbKey, bytes.NewReader(u.thumbnail), int64(len(u.thumbnail)), thumbnailType(a.ContentType))
+			if err != nil {
+				app.deleteUploads(ctx, []*upload{u})
+			}
+		}
+		if err != nil {
+			app.deleteUploads(ctx, stored)
+			return err
+		}
+		stored = append(stored, u)
+	}
+	return nil
+}
+
+func (app *application) deleteUploads(ctx context.Context, uploads []*upload) {
+	for _, u := range uploads {
+		for _, key := range []string{u.attachment.StorageKey, u.attachment.ThumbKey} {
+			if key == "" {
+				continue
+			}
+			if err := app.storage.Delete(ctx, key); err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+	}
+}
+
+// uploadedAttachments returns the attachments of the stored uploads, which
+// are inserted together with the post or comment they belong to
+func uploadedAttachments(uploads []*upload) []*models.Attachment {
+	attachments := make([]*models.Attachment, len(uploads))
+	for i, u := range uploads {
+		attachments[i] = u.attachment
+	}
+	return attachments
+}
+
+// loadAttachments fills in the attachments of the post and of the comments
+// in the trees, hidden posts and comments have no content and keep none
+func (app *application) loadAttachments(post *models.Post, nodes []*models.CommentNode) error {
+	if post != nil && !post.Hidden {
+		attachments, err := app.attachments.GetForPost(post.ID)
+		if err != nil {
+			return err
+		}
+		post.Attachments = attachments
+	}
+
+	ids := []int{}
+	var collect func(nodes []*models.CommentNode)
+	collect = func(nodes []*models.CommentNode) {
+		for _, node := range nodes {
+			if node.Content != "" {
+				ids = append(ids, node.ID)
+			}
+			collect(node.CommentNodes)
+		}
+	}
+	collect(nodes)
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	attachments, err := app.attachments.GetForComments(ids)
+	if err != nil {
+		return err
+	}
+
+	var assign func(nodes []*models.CommentNode)
+	assign = func(nodes []*models.CommentNode) {
+		for _, node := range nodes {
+			node.Attachments = attachments[node.ID]
+			assign(node.CommentNodes)
+		}
+	}
+	assign(nodes)
+	return nil
+}
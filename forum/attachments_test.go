@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fileHeader returns the header of a file uploaded in a multipart form
+func fileHeader(t *testing.T, filename string, data []byte) *multipart.FileHeader {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("attachments", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	return r.MultipartForm.File["attachments"][0]
+}
+
+func testImage(width, height int) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.White, color.Black})
+	img.SetColorIndex(width/2, height/2, 1)
+	return img
+}
+
+func TestProcessUploadThumbnails(t *testing.T) {
+	app := &application{}
+	app.config.uploads.maxSize = 1 << 20
+
+	var jpg, pngData, gifData bytes.Buffer
+	jpeg.Encode(&jpg, testImage(400, 200), nil)
+	png.Encode(&pngData, testImage(400, 200))
+	gif.EncodeAll(&gifData, &gif.GIF{Image: []*image.Paletted{testImage(400, 200), testImage(400, 200)}, Delay: []int{10, 10}})
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantType  string
+		wantThumb string
+	}{
+		{"jpeg", jpg.Bytes(), "image/jpeg", "image/jpeg"},
+		{"png", pngData.Bytes(), "image/png", "image/png"},
+		{"gif", gifData.Bytes(), "image/gif", "image/png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := app.processUpload(fileHeader(t, "image", tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if u.attachment.ContentType != tt.wantType {
+				t.Errorf("got content type %q; want %q", u.attachment.ContentType, tt.wantType)
+			}
+			if got := http.DetectContentType(u.thumbnail); got != tt.wantThumb {
+				t.Errorf("got thumbnail of type %q; want %q", got, tt.wantThumb)
+			}
+			if got := thumbnailType(u.attachment.ContentType); got != tt.wantThumb {
+				t.Errorf("thumbnail served as %q; want %q", got, tt.wantThumb)
+			}
+			if want := attachmentTypes[tt.wantThumb]; !strings.HasSuffix(u.attachment.ThumbKey, "_thumb"+want) {
+				t.Errorf("got thumbnail key %q; want suffix %q", u.attachment.ThumbKey, want)
+			}
+
+			thumb, _, err := image.DecodeConfig(bytes.NewReader(u.thumbnail))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if thumb.Width != thumbnailSize || thumb.Height != thumbnailSize/2 {
+				t.Errorf("got thumbnail of %dx%d; want %dx%d", thumb.Width, thumb.Height, thumbnailSize, thumbnailSize/2)
+			}
+		})
+	}
+}
+
+func TestGIFSize(t *testing.T) {
+	var buf bytes.Buffer
+	animation := &gif.GIF{
+		Image: []*image.Paletted{testImage(10, 20), testImage(10, 20), testImage(10, 20)},
+		Delay: []int{10, 10, 10},
+	}
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, pixels, err := gifSize(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames != 3 || pixels != 600 {
+		t.Errorf("got %d frames of %d pixels; want 3 frames of 600 pixels", frames, pixels)
+	}
+
+	if _, _, err := gifSize(buf.Bytes()[:buf.Len()-10]); err == nil {
+		t.Error("got no error for a truncated GIF")
+	}
+}
+
+func TestProcessUploadGIFFrames(t *testing.T) {
+	app := &application{}
+	app.config.uploads.maxSize = 1 << 20
+
+	animation := &gif.GIF{}
+	for i := 0; i <= maxGIFFrames; i++ {
+		animation.Image = append(animation.Image, testImage(1, 1))
+		animation.Delay = append(animation.Delay, 0)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := app.processUpload(fileHeader(t, "frames.gif", buf.Bytes()))
+	if !errors.Is(err, errAttachmentImage) {
+		t.Errorf("got error %v; want %v", err, errAttachmentImage)
+	}
+}
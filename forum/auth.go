@@ -2,13 +2,20 @@ package main
 
 import (
 	"net/http"
+
+	"github.com/groth00/forum/internal/models"
 )
 
 type contextKey string
 
 const (
-	isAuthenticatedKey = contextKey("isAuthenticated")
-	authUser           = "authenticatedUserID"
+	isAuthenticatedKey     = contextKey("isAuthenticated")
+	authenticatedUserIDKey = contextKey("authenticatedUserID")
+	tokenAuthenticatedKey  = contextKey("tokenAuthenticated")
+	topicIDKey             = contextKey("topicID")
+	topicRoleKey           = contextKey("topicRole")
+	authUser               = "authenticatedUserID"
+	sessionGeneration      = "sessionGeneration"
 )
 
 func (app *application) isAuthenticated(r *http.Request) bool {
@@ -18,3 +25,80 @@ func (app *application) isAuthenticated(r *http.Request) bool {
 	}
 	return isAuthenticated
 }
+
+// isTokenAuthenticated reports whether authenticateToken accepted a bearer
+// token for the request, rather than the session cookie
+func (app *application) isTokenAuthenticated(r *http.Request) bool {
+	tokenAuthenticated, ok := r.Context().Value(tokenAuthenticatedKey).(bool)
+	if !ok {
+		return false
+	}
+	return tokenAuthenticated
+}
+
+// authenticatedUserID returns the ID placed in the request context by the
+// authenticate middlewares, which is 0 for anonymous requests; handlers should
+// use it instead of reading the session so bearer tokens work as well
+func (app *application) authenticatedUserID(r *http.Request) int {
+	user_id, ok := r.Context().Value(authenticatedUserIDKey).(int)
+	if !ok {
+		return 0
+	}
+	return user_id
+}
+
+// logIn puts the user in the session with their current session generation
+func (app *application) logIn(r *http.Request, user_id int) error {
+	generation, err := app.users.SessionGeneration(user_id)
+	if err != nil {
+		return err
+	}
+
+	app.sessionManager.Put(r.Context(), authUser, user_id)
+	app.sessionManager.Put(r.Context(), sessionGeneration, generation)
+	return nil
+}
+
+// destroyOtherSessions logs the user out of every session except the one of
+// the current request, which an anonymous request does not share with them;
+// authenticate stops accepting the sessions of the previous generation
+func (app *application) destroyOtherSessions(r *http.Request, user_id int) error {
+	generation, err := app.users.EndSessions(user_id)
+	if err != nil {
+		return err
+	}
+
+	if app.sessionManager.GetInt(r.Context(), authUser) == user_id {
+		app.sessionManager.Put(r.Context(), sessionGeneration, generation)
+	}
+	return nil
+}
+
+// topicRole returns the role of the user in the topic resolved by
+// requireTopicRole, or member when the middleware did not run
+func (app *application) topicRole(r *http.Request) string {
+	role, ok := r.Context().Value(topicRoleKey).(string)
+	if !ok {
+		return models.RoleMember
+	}
+	return role
+}
+
+// topicID returns the topic resolved by requireTopicRole
+func (app *application) topicID(r *http.Request) int {
+	topic_id, ok := r.Context().Value(topicIDKey).(int)
+	if !ok {
+		return 0
+	}
+	return topic_id
+}
+
+// roleIn looks up the role of the user of the request in a topic, for pages
+// that are open to everyone but show more to moderators
+func (app *application) roleIn(r *http.Request, topic_id int) (string, error) {
+	user_id := app.authenticatedUserID(r)
+	if user_id == 0 {
+		return models.RoleMember, nil
+	}
+	return app.topics.Role(topic_id, user_id)
+}
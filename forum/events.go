@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+	"github.com/justinas/nosurf"
+	"github.com/lib/pq"
+)
+
+const (
+	// the PostgreSQL channel the instances share their events on
+	eventsChannel = "forum_events"
+	// events waiting to be published, more are dropped
+	eventQueueSize = 256
+	// events waiting to be sent to one reader, a reader that falls further
+	// behind misses events until it catches up
+	subscriberBuffer = 16
+	// comment lines sent on idle streams so proxies do not close them
+	eventsKeepAlive = 30 * time.Second
+)
+
+// eventHub passes the events of the models to the readers of the posts and
+// topics they happen in. With notify set the events go through PostgreSQL
+// LISTEN/NOTIFY, which delivers them to the readers of every instance
+// including this one; otherwise they are delivered in-process.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan *models.Event]struct{}
+	queue       chan models.Event
+	done        chan struct{}
+	notify      *sql.DB
+	// prepare loads what the readers need to render an event, once per event
+	prepare  func(event *models.Event) error
+	errorLog *log.Logger
+}
+
+func newEventHub(notify *sql.DB, errorLog *log.Logger) *eventHub {
+	return &eventHub{
+		subscribers: map[string]map[chan *models.Event]struct{}{},
+		queue:       make(chan models.Event, eventQueueSize),
+		done:        make(chan struct{}),
+		notify:      notify,
+		errorLog:    errorLog,
+	}
+}
+
+func postEventsKey(post_id int) string {
+	return fmt.Sprintf("post:%d", post_id)
+}
+
+func topicEventsKey(topic_id int) string {
+	return fmt.Sprintf("topic:%d", topic_id)
+}
+
+// Publish implements models.Publisher, it is called by the models right
+// after their transactions commit so it only queues the event
+func (h *eventHub) Publish(event models.Event) {
+	select {
+	case h.queue <- event:
+	default:
+		h.errorLog.Printf("event queue is full, dropped %s event of post %d", event.Kind, event.PostID)
+	}
+}
+
+// Subscribe returns the events of the key and the function that ends the
+// subscription
+func (h *eventHub) Subscribe(key string) (<-chan *models.Event, func()) {
+	events := make(chan *models.Event, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[key] == nil {
+		h.subscribers[key] = map[chan *models.Event]struct{}{}
+	}
+	h.subscribers[key][events] = struct{}{}
+	h.mu.Unlock()
+
+	return events, func() {
+		h.mu.Lock()
+		delete(h.subscribers[key], events)
+		if len(h.subscribers[key]) == 0 {
+			delete(h.subscribers, key)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// run publishes the queued events until ctx is cancelled by the shutdown,
+// which also ends the streams of the readers
+func (h *eventHub) run(ctx context.Context) {
+	defer close(h.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-h.queue:
+			if h.notify == nil {
+				h.deliver(event)
+				continue
+			}
+
+			payload, err := json.Marshal(event)
+			if err != nil {
+				h.errorLog.Println(err)
+				continue
+			}
+
+			_, err = h.notify.ExecContext(ctx, "SELECT pg_notify($1, $2)", eventsChannel, string(payload))
+			if err != nil {
+				h.errorLog.Println(err)
+			}
+		}
+	}
+}
+
+// listen delivers the events published by every instance until ctx is
+// cancelled, the listener reconnects on its own when the connection drops
+func (h *eventHub) listen(ctx context.Context, dsn string) {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			h.errorLog.Println(err)
+		}
+	})
+	defer listener.Close()
+
+	err := listener.Listen(eventsChannel)
+	if err != nil {
+		h.errorLog.Println(err)
+		return
+	}
+
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-listener.Notify:
+			// nil after a reconnection, events sent in between are lost
+			if n == nil {
+				continue
+			}
+
+			var event models.Event
+			if err := json.Unmarshal([]byte(n.Extra), &event); err != nil {
+				h.errorLog.Println(err)
+				continue
+			}
+			h.deliver(event)
+		case <-ticker.C:
+			// notices a dead connection even when nothing is published
+			go func() {
+				if err := listener.Ping(); err != nil {
+					h.errorLog.Println(err)
+				}
+			}()
+		}
+	}
+}
+
+// deliver sends the event to the readers of its post and, unless it is about
+// the likes of a comment, to the readers of its topic
+func (h *eventHub) deliver(event models.Event) {
+	keys := []string{postEventsKey(event.PostID)}
+	if event.Kind == models.EventComment || event.CommentID == 0 {
+		keys = append(keys, topicEventsKey(event.TopicID))
+	}
+
+	h.mu.Lock()
+	readers := 0
+	for _, key := range keys {
+		readers += len(h.subscribers[key])
+	}
+	h.mu.Unlock()
+
+	if readers == 0 {
+		return
+	}
+
+	if h.prepare != nil {
+		if err := h.prepare(&event); err != nil {
+			h.errorLog.Println(err)
+			return
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range keys {
+		for events := range h.subscribers[key] {
+			select {
+			case events <- &event:
+			default:
+			}
+		}
+	}
+}
+
+// prepareEvent loads and renders the new comment of a comment event
+func (app *application) prepareEvent(event *models.Event) error {
+	if event.Kind != models.EventComment {
+		return nil
+	}
+
+	node, err := app.comments.GetSubtree(event.CommentID, models.SortTop, models.ThreadOptions{})
+	if err != nil {
+		return err
+	}
+
+	nodes := []*models.CommentNode{node}
+	err = app.renderCommentNodes(nodes)
+	if err != nil {
+		return err
+	}
+
+	err = app.loadAttachments(nil, nodes)
+	if err != nil {
+		return err
+	}
+
+	event.Comment = node
+	return nil
+}
+
+func (app *application) postEvents(w http.ResponseWriter, r *http.Request) {
+	post_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	post, err := app.posts.Get(post_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	if post.Removed || post.Deleted {
+		app.notFound(w, r)
+		return
+	}
+
+	app.streamEvents(w, r, postEventsKey(post_id), false)
+}
+
+func (app *application) topicEvents(w http.ResponseWriter, r *http.Request) {
+	topic_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	_, err = app.topics.Get(topic_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.streamEvents(w, r, topicEventsKey(topic_id), true)
+}
+
+// streamEvents sends the events of the key as Server-Sent Events until the
+// reader goes away or the server shuts down
+func (app *application) streamEvents(w http.ResponseWriter, r *http.Request, key string, topic bool) {
+	rc := http.NewResponseController(w)
+
+	// the stream outlives the write timeout of the server
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.serverError(w, err)
+		return
+	}
+
+	events, unsubscribe := app.events.Subscribe(key)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	csrf_token := nosurf.Token(r)
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-app.events.done:
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			fragment, err := app.renderEvent(event, csrf_token, topic)
+			if err != nil {
+				app.errorLog.Println(err)
+				continue
+			}
+			writeEvent(w, event.Kind, fragment)
+		}
+	}
+}
+
+// renderEvent returns the HTML that liveUpdates.js puts in the page: elements
+// with a data-append selector add their children to that element, others
+// replace the element with the same id
+func (app *application) renderEvent(event *models.Event, csrf_token string, topic bool) (string, error) {
+	switch {
+	case event.Kind == models.EventComment && topic:
+		return fmt.Sprintf(`<span id="post-comments-%d">%d</span>`, event.PostID, event.NumComments), nil
+	case event.Kind == models.EventComment:
+		if event.Comment == nil {
+			return "", fmt.Errorf("comment %d of the event was not loaded", event.CommentID)
+		}
+
+		parent := "#comments"
+		if event.Comment.ParentID > 0 {
+			parent = fmt.Sprintf("#comment-%d > div", event.Comment.ParentID)
+		}
+
+		ts, ok := app.templateCache["post.tmpl"]
+		if !ok {
+			return "", fmt.Errorf("the template %s does not exist", "post.tmpl")
+		}
+
+		buf := new(bytes.Buffer)
+		fmt.Fprintf(buf, `<div data-append="%s">`, html.EscapeString(parent))
+		err := ts.ExecuteTemplate(buf, "comment", varargs([]*models.CommentNode{event.Comment}, csrf_token, models.SortTop))
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString("</div>")
+		return buf.String(), nil
+	case event.CommentID > 0:
+		return fmt.Sprintf(`<span id="comment-likes-%d">%d</span>`, event.CommentID, event.Likes), nil
+	default:
+		return fmt.Sprintf(`<span id="post-likes-%d">%d</span>`, event.PostID, event.Likes), nil
+	}
+}
+
+// writeEvent writes one Server-Sent Event, every line of the data gets its
+// own data field
+func writeEvent(w http.ResponseWriter, name, data string) {
+	fmt.Fprintf(w, "event: %s\n", name)
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r", ""), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
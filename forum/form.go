@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"unicode/utf8"
@@ -90,3 +91,18 @@ func PermittedValue[T comparable](value T, permittedValues ...T) bool {
 func Matches(value string, regex *regexp.Regexp) bool {
 	return regex.MatchString(value)
 }
+
+// LocalPath reports whether value is a path on this site that is safe to
+// redirect to; browsers read a backslash as a slash, so "/\evil.example" is
+// another host just like "//evil.example"
+func LocalPath(value string) bool {
+	if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") || strings.Contains(value, "\\") {
+		return false
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" && u.Host == "" && u.User == nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"/topics/1/modqueue", true},
+		{"/posts/2?sort=new#comment-3", true},
+		{"", false},
+		{"topics/1", false},
+		{"//evil.example", false},
+		{"/\\evil.example", false},
+		{"/\\/evil.example", false},
+		{"https://evil.example/", false},
+		{"/\tevil", false},
+	}
+
+	for _, tt := range tests {
+		if got := LocalPath(tt.value); got != tt.want {
+			t.Errorf("LocalPath(%q) = %t; want %t", tt.value, got, tt.want)
+		}
+	}
+}
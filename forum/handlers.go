@@ -7,6 +7,7 @@ import (
 	"runtime/debug"
 	"strconv"
 
+	"github.com/groth00/forum/internal/models"
 	"github.com/julienschmidt/httprouter"
 	"go.opentelemetry.io/otel"
 )
@@ -25,7 +26,41 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	_, span := tracer.Start(r.Context(), "home")
 	defer span.End()
 
-	topics, err := app.topics.List(10)
+	page, err := app.readPageRequest(r, models.SortHot, postSortMethods...)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// users subscribed to topics get a front page made of those topics,
+	// everyone else sees posts from every topic
+	var subscribed []*models.Topic
+	if user_id := app.authenticatedUserID(r); user_id > 0 {
+		subscribed, err = app.topics.GetSubscribed(user_id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	var posts []*models.Post
+	var metadata models.Page
+	if len(subscribed) > 0 {
+		posts, metadata, err = app.posts.Feed(app.authenticatedUserID(r), page)
+	} else {
+		posts, metadata, err = app.posts.List(page)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCursor):
+			app.clientError(w, http.StatusBadRequest)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	topics, _, err := app.topics.List(models.PageRequest{Sort: models.SortOld, Limit: 10})
 	if err != nil {
 		app.serverError(w, err)
 		return
@@ -33,6 +68,9 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 
 	data := app.newTemplateData(r)
 	data.Topics = topics
+	data.Subscribed = subscribed
+	data.Posts = posts
+	data.Page = metadata
 	app.render(w, http.StatusOK, "home.tmpl", data)
 }
 
@@ -82,6 +120,46 @@ func (app *application) getQueryParameterInt(w http.ResponseWriter, r *http.Requ
 	return -1, errors.New(fmt.Errorf("key %s not found in query parameters", key).Error())
 }
 
+// readPageRequest reads the sort, t, after, before and limit query parameters;
+// sort must be one of permitted and falls back to defaultSort, t is the time
+// window used by the post listings
+func (app *application) readPageRequest(r *http.Request, defaultSort string, permitted ...string) (models.PageRequest, error) {
+	qp := r.URL.Query()
+
+	page := models.PageRequest{
+		Sort:   qp.Get("sort"),
+		Window: qp.Get("t"),
+		After:  qp.Get("after"),
+		Before: qp.Get("before"),
+		Limit:  models.DefaultPageSize,
+	}
+
+	if page.Sort == "" {
+		page.Sort = defaultSort
+	}
+	if !PermittedValue(page.Sort, permitted...) {
+		return page, models.ErrInvalidSort
+	}
+
+	if page.Window != "" && !PermittedValue(page.Window, models.Windows...) {
+		return page, models.ErrInvalidWindow
+	}
+
+	if page.After != "" && page.Before != "" {
+		return page, errors.New("after and before cannot be used together")
+	}
+
+	if raw := qp.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > models.MaxPageSize {
+			return page, fmt.Errorf("limit must be between 1 and %d", models.MaxPageSize)
+		}
+		page.Limit = limit
+	}
+
+	return page, nil
+}
+
 func (app *application) serverError(w http.ResponseWriter, err error) {
 	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
 	app.errorLog.Output(2, trace)
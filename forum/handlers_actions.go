@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/groth00/forum/internal/models"
+	"github.com/justinas/nosurf"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// postAction runs one of the like, dislike, unvote, save and unsave actions
+// of the user on a post. htmx requests get the updated buttons of the post,
+// other requests are sent back to the post so the buttons work without
+// JavaScript.
+func (app *application) postAction(action func(user_id, post_id int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post_id, err := app.getIDParam(w, r, "id")
+		if err != nil {
+			return
+		}
+
+		if _, err := app.posts.Get(post_id); err != nil {
+			switch {
+			case errors.Is(err, models.ErrNoRecordFound):
+				app.notFound(w, r)
+			default:
+				app.serverError(w, err)
+			}
+			return
+		}
+
+		user_id := app.authenticatedUserID(r)
+		if err := action(user_id, post_id); err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		if r.Header.Get("HX-Request") != "true" {
+			http.Redirect(w, r, fmt.Sprintf("/posts/%d", post_id), http.StatusSeeOther)
+			return
+		}
+
+		post, err := app.posts.Get(post_id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		post.Interaction, err = app.posts.Interaction(user_id, post_id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		app.renderFragment(w, http.StatusOK, "post.tmpl", "post_actions", varargs(post, nosurf.Token(r)))
+	}
+}
+
+// commentAction is postAction for comments, requests without htmx are sent
+// back to the comment in its post
+func (app *application) commentAction(name string, action func(user_id, comment_id int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, trace := tracer.Start(r.Context(), "comment_"+name)
+		defer trace.End()
+
+		comment_id, err := app.getIDParam(w, r, "id")
+		if err != nil {
+			return
+		}
+
+		comment, err := app.comments.Get(comment_id)
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrNoRecordFound):
+				app.notFound(w, r)
+			default:
+				app.serverError(w, err)
+			}
+			return
+		}
+
+		user_id := app.authenticatedUserID(r)
+		trace.SetAttributes(
+			attribute.Int("comment_id", comment_id),
+			attribute.Int("user_id", user_id),
+		)
+
+		if err := action(user_id, comment_id); err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		if r.Header.Get("HX-Request") != "true" {
+			http.Redirect(w, r, fmt.Sprintf("/posts/%d#comment-%d", comment.PostID, comment_id), http.StatusSeeOther)
+			return
+		}
+
+		comment, err = app.comments.Get(comment_id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		interactions, err := app.comments.Interactions(user_id, []int{comment_id})
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		comment.Interaction = interactions[comment_id]
+
+		app.renderFragment(w, http.StatusOK, "post.tmpl", "comment_actions", varargs(comment, nosurf.Token(r)))
+	}
+}
+
+func (app *application) topicSubscribe(w http.ResponseWriter, r *http.Request) {
+	app.topicSubscription(w, r, app.topics.Subscribe)
+}
+
+func (app *application) topicUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	app.topicSubscription(w, r, func(topic_id, user_id int) error {
+		err := app.topics.Unsubscribe(topic_id, user_id)
+		// not being subscribed is what the user asked for
+		if errors.Is(err, models.ErrNoRecordFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// topicSubscription answers htmx requests with the toggled subscribe button
+// and the new number of subscribers, other requests go back to the topic
+func (app *application) topicSubscription(w http.ResponseWriter, r *http.Request, action func(topic_id, user_id int) error) {
+	topic_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	if _, err := app.topics.Get(topic_id); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	if err := action(topic_id, user_id); err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if r.Header.Get("HX-Request") != "true" {
+		http.Redirect(w, r, fmt.Sprintf("/topics/%d", topic_id), http.StatusSeeOther)
+		return
+	}
+
+	topic, err := app.topics.Get(topic_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	topic.Subscribed, err = app.topics.Subscribed(topic_id, user_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.renderFragment(w, http.StatusOK, "topic.tmpl", "topic_subscription", varargs(topic, nosurf.Token(r)))
+}
+
+// loadInteractions fills in how the user voted on the post and the comments
+// in the trees, anonymous users have not voted on anything
+func (app *application) loadInteractions(r *http.Request, post *models.Post, nodes []*models.CommentNode) error {
+	user_id := app.authenticatedUserID(r)
+	if user_id == 0 {
+		return nil
+	}
+
+	if post != nil {
+		interaction, err := app.posts.Interaction(user_id, post.ID)
+		if err != nil {
+			return err
+		}
+		post.Interaction = interaction
+	}
+
+	ids := []int{}
+	var collect func(nodes []*models.CommentNode)
+	collect = func(nodes []*models.CommentNode) {
+		for _, node := range nodes {
+			ids = append(ids, node.ID)
+			collect(node.CommentNodes)
+		}
+	}
+	collect(nodes)
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	interactions, err := app.comments.Interactions(user_id, ids)
+	if err != nil {
+		return err
+	}
+
+	var assign func(nodes []*models.CommentNode)
+	assign = func(nodes []*models.CommentNode) {
+		for _, node := range nodes {
+			node.Interaction = interactions[node.ID]
+			assign(node.CommentNodes)
+		}
+	}
+	assign(nodes)
+	return nil
+}
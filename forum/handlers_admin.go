@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+type siteSettingsForm struct {
+	RequireModerator2FA bool `form:"require_moderator_2fa"`
+	Validator           `form:"-"`
+}
+
+func (app *application) adminGet(w http.ResponseWriter, r *http.Request) {
+	settings, err := app.settings.Get()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.SiteSettings = settings
+	app.render(w, http.StatusOK, "admin.tmpl", data)
+}
+
+func (app *application) adminSettingsPost(w http.ResponseWriter, r *http.Request) {
+	var form siteSettingsForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.settings.Update(&models.SiteSettings{RequireModerator2FA: form.RequireModerator2FA})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Settings saved.")
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
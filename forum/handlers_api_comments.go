@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+func (app *application) apiCommentGet(w http.ResponseWriter, r *http.Request) {
+	comment_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	comment, err := app.comments.Get(comment_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	topic_id, err := app.topics.ForComment(comment_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	err = app.hideRemovedComment(r, comment, topic_id)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.renderComment(comment)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"comment": comment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiCommentReplies(w http.ResponseWriter, r *http.Request) {
+	comment_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	sort := app.getQueryParameterWithDefault(w, r, "sort", models.SortTop)
+	if !PermittedValue(sort, commentSortMethods...) {
+		app.modelErrorResponse(w, models.ErrInvalidSort)
+		return
+	}
+
+	topic_id, err := app.topics.ForComment(comment_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	opts, err := app.threadOptions(r, topic_id)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	thread, err := app.comments.GetSubtree(comment_id, sort, opts)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	err = app.renderCommentNodes([]*models.CommentNode{thread})
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.loadAttachments(nil, []*models.CommentNode{thread})
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"comment": thread}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiCommentCreate(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		PostID   int    `json:"post_id"`
+		ParentID int    `json:"parent_id"`
+		Content  string `json:"content"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	v := Validator{}
+	v.CheckField(ValidInt(input.PostID), "post_id", "must be a positive integer")
+	v.CheckField(NotBlank(input.Content), "content", "content cannot be blank")
+	v.CheckField(MaxChars(input.Content, 2048), "content", "can be at most 2048 characters")
+
+	if input.PostID > 0 {
+		if _, err := app.posts.Get(input.PostID); err != nil {
+			switch {
+			case errors.Is(err, models.ErrNoRecordFound):
+				v.AddFieldError("post_id", "post does not exist")
+			default:
+				app.serverErrorResponse(w, err)
+				return
+			}
+		}
+	}
+
+	if input.ParentID > 0 {
+		parent, err := app.comments.Get(input.ParentID)
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrNoRecordFound):
+				v.AddFieldError("parent_id", "parent comment does not exist")
+			default:
+				app.serverErrorResponse(w, err)
+				return
+			}
+		} else if parent.PostID != input.PostID {
+			v.AddFieldError("parent_id", "parent comment belongs to a different post")
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, v)
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	user, err := app.users.Get(user_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	comment_id, err := app.comments.Insert(user.ID, input.PostID, input.ParentID, user.Name, input.Content, nil)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	comment, err := app.comments.Get(comment_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	err = app.renderComment(comment)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/comments/%d", comment_id))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"comment": comment}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiCommentUpdate(w http.ResponseWriter, r *http.Request) {
+	comment_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	comment, err := app.comments.Get(comment_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if comment.UserID != app.authenticatedUserID(r) {
+		app.notPermittedResponse(w)
+		return
+	}
+
+	var input struct {
+		Content string `json:"content"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	v := Validator{}
+	v.CheckField(NotBlank(input.Content), "content", "content cannot be blank")
+	v.CheckField(MaxChars(input.Content, 2048), "content", "content can be at most 2048 characters")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, v)
+		return
+	}
+
+	comment.Content = input.Content
+	err = app.comments.Update(comment)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	err = app.renderComment(comment)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"comment": comment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiCommentDelete(w http.ResponseWriter, r *http.Request) {
+	comment_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	comment, err := app.comments.Get(comment_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if comment.UserID != app.authenticatedUserID(r) {
+		app.notPermittedResponse(w)
+		return
+	}
+
+	err = app.comments.Delete(comment.UserID, comment_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiCommentAction is the comment counterpart of apiPostAction
+func (app *application) apiCommentAction(action func(user_id, comment_id int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		comment_id, ok := app.apiIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		if _, err := app.comments.Get(comment_id); err != nil {
+			app.modelErrorResponse(w, err)
+			return
+		}
+
+		user_id := app.authenticatedUserID(r)
+		if err := action(user_id, comment_id); err != nil {
+			app.modelErrorResponse(w, err)
+			return
+		}
+
+		comment, err := app.comments.Get(comment_id)
+		if err != nil {
+			app.modelErrorResponse(w, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"comment": comment}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+func (app *application) apiPostList(w http.ResponseWriter, r *http.Request) {
+	page, err := app.readPageRequest(r, models.SortHot, postSortMethods...)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	posts, metadata, err := app.posts.List(page)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	body := envelope{"posts": posts, "metadata": metadata, "links": app.pageLinks(r, metadata)}
+	err = app.writeJSON(w, http.StatusOK, body, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiPostGet(w http.ResponseWriter, r *http.Request) {
+	post_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	post, err := app.posts.Get(post_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	err = app.hideRemoved(r, post)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.renderPost(post)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.loadAttachments(post, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.loadPoll(r, post)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"post": post}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiPostComments(w http.ResponseWriter, r *http.Request) {
+	post_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := app.readPageRequest(r, models.SortTop, commentSortMethods...)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	post, err := app.posts.Get(post_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	opts, err := app.threadOptions(r, post.TopicID)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	comments, metadata, err := app.comments.GetForPost(post_id, page, opts)
+	if err != nil && !errors.Is(err, models.ErrNoCommentsForPost) {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if comments == nil {
+		comments = []*models.CommentNode{}
+	}
+
+	err = app.renderCommentNodes(comments)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.loadAttachments(nil, comments)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	body := envelope{"comments": comments, "metadata": metadata, "links": app.pageLinks(r, metadata)}
+	err = app.writeJSON(w, http.StatusOK, body, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiPostCreate(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TopicID int    `json:"topic_id"`
+		Title   string `json:"title"`
+		Content string `json:"content"`
+		Link    string `json:"link"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	v := Validator{}
+	v.CheckField(ValidInt(input.TopicID), "topic_id", "must be a positive integer")
+	v.CheckField(NotBlank(input.Title), "title", "title cannot be blank")
+	v.CheckField(MaxChars(input.Title, 64), "title", "title can be at most 64 characters")
+	v.CheckField(input.Link != "" || NotBlank(input.Content), "content", "content cannot be blank")
+	v.CheckField(MaxChars(input.Content, 2048), "content", "content can be at most 2048 characters")
+	v.CheckField(input.Link == "" || validLink(input.Link), "link", "link must be an http or https URL")
+	v.CheckField(MaxChars(input.Link, 2048), "link", "link can be at most 2048 characters")
+
+	if input.TopicID > 0 {
+		if _, err := app.topics.Get(input.TopicID); err != nil {
+			switch {
+			case errors.Is(err, models.ErrNoRecordFound):
+				v.AddFieldError("topic_id", "topic does not exist")
+			default:
+				app.serverErrorResponse(w, err)
+				return
+			}
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, v)
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	user, err := app.users.Get(user_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	post_id, err := app.posts.Insert(user.ID, input.TopicID, user.Name, input.Title, input.Content, input.Link, nil, nil)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if input.Link != "" {
+		app.background(func() { app.fetchLinkPreview(post_id, input.Link) })
+	}
+
+	post, err := app.posts.Get(post_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	err = app.renderPost(post)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/posts/%d", post_id))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"post": post}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiPostUpdate(w http.ResponseWriter, r *http.Request) {
+	post_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	post, err := app.posts.Get(post_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if post.UserID != app.authenticatedUserID(r) {
+		app.notPermittedResponse(w)
+		return
+	}
+
+	// fields left out of the request body keep their current value
+	var input struct {
+		Title   *string `json:"title"`
+		Content *string `json:"content"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	if input.Title != nil {
+		post.Title = *input.Title
+	}
+	if input.Content != nil {
+		post.Content = *input.Content
+	}
+
+	// link and poll posts can do without text, as when they were created
+	err = app.loadPoll(r, post)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	v := Validator{}
+	v.CheckField(NotBlank(post.Title), "title", "title cannot be blank")
+	v.CheckField(MaxChars(post.Title, 64), "title", "title can be at most 64 characters")
+	v.CheckField(post.Link != "" || post.Poll != nil || NotBlank(post.Content), "content", "content cannot be blank")
+	v.CheckField(MaxChars(post.Content, 2048), "content", "content can be at most 2048 characters")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, v)
+		return
+	}
+
+	err = app.posts.Update(post)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	err = app.renderPost(post)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"post": post}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiPostDelete(w http.ResponseWriter, r *http.Request) {
+	post_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	post, err := app.posts.Get(post_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if post.UserID != app.authenticatedUserID(r) {
+		app.notPermittedResponse(w)
+		return
+	}
+
+	err = app.posts.Delete(post.UserID, post.ID, post.TopicID)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiPostAction runs one of the like/dislike/save/unsave model methods and
+// responds with the post so clients can pick up the new like count
+func (app *application) apiPostAction(action func(user_id, post_id int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post_id, ok := app.apiIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		if _, err := app.posts.Get(post_id); err != nil {
+			app.modelErrorResponse(w, err)
+			return
+		}
+
+		user_id := app.authenticatedUserID(r)
+		if err := action(user_id, post_id); err != nil {
+			app.modelErrorResponse(w, err)
+			return
+		}
+
+		post, err := app.posts.Get(post_id)
+		if err != nil {
+			app.modelErrorResponse(w, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"post": post}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+func (app *application) apiSearch(w http.ResponseWriter, r *http.Request) {
+	var form searchForm
+	filters, err := app.decodeSearchForm(r, &form)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	if !form.Valid() {
+		app.failedValidationResponse(w, form.Validator)
+		return
+	}
+
+	results, more, err := app.search.Search(filters)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	metadata := envelope{"page": form.Page, "limit": filters.Limit}
+	links := envelope{}
+	if form.Page > 1 {
+		links["prev"] = app.searchPageLink(r, form.Page-1)
+	}
+	if more {
+		links["next"] = app.searchPageLink(r, form.Page+1)
+	}
+
+	body := envelope{"results": results, "metadata": metadata, "links": links}
+	err = app.writeJSON(w, http.StatusOK, body, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+// searchPageLink is the offset based counterpart of pageLinks
+func (app *application) searchPageLink(r *http.Request, page int) string {
+	qs := r.URL.Query()
+	qs.Set("page", strconv.Itoa(page))
+	return r.URL.Path + "?" + qs.Encode()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+const authenticationTokenTTL = 24 * time.Hour
+
+func (app *application) apiAuthenticationTokenCreate(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		// the code of the authenticator or a recovery code, when 2FA is on
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	v := Validator{}
+	v.CheckField(NotBlank(input.Email), "email", "email cannot be blank")
+	v.CheckField(Matches(input.Email, EmailRegex), "email", "invalid email format")
+	v.CheckField(NotBlank(input.Password), "password", "password cannot be blank")
+	v.CheckField(MaxChars(input.Password, 72), "password", "cannot be longer than 72 bytes")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, v)
+		return
+	}
+
+	user_id, locked_until, err := app.login(input.Email, input.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCredentials):
+			app.invalidCredentialsResponse(w)
+		case errors.Is(err, models.ErrAccountLocked):
+			app.accountLockedResponse(w, time.Until(locked_until))
+		default:
+			app.serverErrorResponse(w, err)
+		}
+		return
+	}
+
+	two_factor, err := app.twoFactor.Get(user_id)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	if two_factor.Enabled() {
+		if input.Code == "" {
+			app.twoFactorRequiredResponse(w)
+			return
+		}
+
+		accepted, _, err := app.checkSecondFactor(user_id, two_factor, input.Code)
+		if err != nil {
+			app.serverErrorResponse(w, err)
+			return
+		}
+
+		if !accepted {
+			locked_until, err := app.loginFailed(input.Email)
+			switch {
+			case errors.Is(err, models.ErrInvalidCredentials):
+				app.invalidCredentialsResponse(w)
+			case errors.Is(err, models.ErrAccountLocked):
+				app.accountLockedResponse(w, time.Until(locked_until))
+			default:
+				app.serverErrorResponse(w, err)
+			}
+			return
+		}
+	}
+
+	err = app.users.LoginSucceeded(user_id)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	token, err := app.tokens.New(user_id, authenticationTokenTTL, models.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+// apiAuthenticationTokenDelete revokes every authentication token of the user
+func (app *application) apiAuthenticationTokenDelete(w http.ResponseWriter, r *http.Request) {
+	user_id := app.authenticatedUserID(r)
+
+	err := app.tokens.DeleteAllForUser(user_id, models.ScopeAuthentication)
+	if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+		app.serverErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+func (app *application) apiTopicList(w http.ResponseWriter, r *http.Request) {
+	page, err := app.readPageRequest(r, models.SortOld, models.SortOld, models.SortNew)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	topics, metadata, err := app.topics.List(page)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	body := envelope{"topics": topics, "metadata": metadata, "links": app.pageLinks(r, metadata)}
+	err = app.writeJSON(w, http.StatusOK, body, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiTopicGet(w http.ResponseWriter, r *http.Request) {
+	topic_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := app.readPageRequest(r, models.SortHot, postSortMethods...)
+	if err != nil {
+		app.badRequestResponse(w, err)
+		return
+	}
+
+	topic, err := app.topics.Get(topic_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	posts, metadata, err := app.posts.GetByTopic(topic_id, page)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	body := envelope{"topic": topic, "posts": posts, "metadata": metadata, "links": app.pageLinks(r, metadata)}
+	err = app.writeJSON(w, http.StatusOK, body, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiTopicSubscribe(w http.ResponseWriter, r *http.Request) {
+	topic_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := app.topics.Get(topic_id); err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	err := app.topics.Subscribe(topic_id, user_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) apiTopicUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	topic_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	err := app.topics.Unsubscribe(topic_id, user_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+func (app *application) apiUserGet(w http.ResponseWriter, r *http.Request) {
+	user_id, ok := app.apiIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := app.users.Get(user_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiUserMe(w http.ResponseWriter, r *http.Request) {
+	user_id := app.authenticatedUserID(r)
+	user, err := app.users.Get(user_id)
+	if err != nil {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	// the email is hidden from the public representation of a user
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "email": user.Email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiUserSavedPosts(w http.ResponseWriter, r *http.Request) {
+	user_id := app.authenticatedUserID(r)
+	posts, err := app.users.GetSavedPosts(user_id)
+	if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if posts == nil {
+		posts = []*models.Post{}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"posts": posts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiUserLikedPosts(w http.ResponseWriter, r *http.Request) {
+	user_id := app.authenticatedUserID(r)
+	posts, err := app.users.GetLikedPosts(user_id)
+	if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if posts == nil {
+		posts = []*models.Post{}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"posts": posts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiUserSavedComments(w http.ResponseWriter, r *http.Request) {
+	user_id := app.authenticatedUserID(r)
+	comments, err := app.users.GetSavedComments(user_id)
+	if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if comments == nil {
+		comments = []*models.Comment{}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"comments": comments}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
+
+func (app *application) apiUserLikedComments(w http.ResponseWriter, r *http.Request) {
+	user_id := app.authenticatedUserID(r)
+	comments, err := app.users.GetLikedComments(user_id)
+	if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+		app.modelErrorResponse(w, err)
+		return
+	}
+
+	if comments == nil {
+		comments = []*models.Comment{}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"comments": comments}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/groth00/forum/internal/models"
+	"github.com/groth00/forum/internal/storage"
+)
+
+func (app *application) attachmentGet(w http.ResponseWriter, r *http.Request) {
+	app.serveAttachment(w, r, false)
+}
+
+func (app *application) attachmentThumbnail(w http.ResponseWriter, r *http.Request) {
+	app.serveAttachment(w, r, true)
+}
+
+// serveAttachment sends the file, or its thumbnail, to the users who can see
+// the post or comment it belongs to; attachments of removed and deleted
+// content are only served to the moderators of the topic
+func (app *application) serveAttachment(w http.ResponseWriter, r *http.Request, thumbnail bool) {
+	attachment_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	attachment, err := app.attachments.Get(attachment_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	post, err := app.posts.Get(attachment.PostID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	hidden := post.Removed || post.Deleted
+	if attachment.CommentID > 0 {
+		comment, err := app.comments.Get(attachment.CommentID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		hidden = hidden || comment.Removed || comment.Deleted
+	}
+
+	if hidden {
+		moderator, err := app.isModerator(r, post.TopicID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !moderator {
+			app.notFound(w, r)
+			return
+		}
+	}
+
+	key, content_type := attachment.StorageKey, attachment.ContentType
+	if thumbnail {
+		key, content_type = attachment.ThumbKey, thumbnailType(attachment.ContentType)
+		if key == "" {
+			app.notFound(w, r)
+			return
+		}
+	}
+
+	file, err := app.storage.Get(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	// only images are shown in the page, everything else is downloaded
+	disposition := "attachment"
+	if attachment.IsImage() {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", content_type)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	// visibility can change when the post is removed, so shared caches are out
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	if !thumbnail {
+		w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	}
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// postPreviewImage serves the thumbnail of the image of a link post, with the
+// same visibility as the post
+func (app *application) postPreviewImage(w http.ResponseWriter, r *http.Request) {
+	post_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	post, err := app.posts.Get(post_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	err = app.hideRemoved(r, post)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if post.Preview == nil || post.Preview.ImageKey == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	file, err := app.storage.Get(r.Context(), post.Preview.ImageKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+// how long a ban lasts, by the value of the duration field of the ban form
+var banDurations = map[string]time.Duration{
+	"1d":        24 * time.Hour,
+	"3d":        3 * 24 * time.Hour,
+	"7d":        7 * 24 * time.Hour,
+	"30d":       30 * 24 * time.Hour,
+	"permanent": 0,
+}
+
+type banForm struct {
+	UserID    int    `form:"user_id"`
+	Duration  string `form:"duration"`
+	Reason    string `form:"reason"`
+	Validator `form:"-"`
+}
+
+// bansURL is the ban management page of the topic, or of the site-wide bans
+// when topic_id is 0
+func bansURL(topic_id int) string {
+	if topic_id == 0 {
+		return "/admin/bans"
+	}
+	return fmt.Sprintf("/topics/%d/bans", topic_id)
+}
+
+// banned explains to a user why they cannot post
+func (app *application) banned(w http.ResponseWriter, r *http.Request) {
+	bans, err := app.bans.GetForUser(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Bans = bans
+	app.render(w, http.StatusOK, "banned.tmpl", data)
+}
+
+// banList shows the bans in force in the topic resolved by the moderator
+// middleware, or the site-wide bans for admins
+func (app *application) banList(w http.ResponseWriter, r *http.Request) {
+	topic_id := app.topicID(r)
+
+	data := app.newTemplateData(r)
+
+	if topic_id > 0 {
+		topic, err := app.topics.Get(topic_id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		data.Topic = topic
+		data.IsModerator = true
+	}
+
+	bans, err := app.bans.GetForTopic(topic_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	// the mod queue links here with the author of the reported content
+	form := banForm{Duration: "7d"}
+	if user_id, err := app.getQueryParameterInt(w, r, "user_id"); err == nil {
+		form.UserID = user_id
+	}
+
+	data.Bans = bans
+	data.Form = form
+	app.render(w, http.StatusOK, "bans.tmpl", data)
+}
+
+func (app *application) banCreatePost(w http.ResponseWriter, r *http.Request) {
+	topic_id := app.topicID(r)
+
+	var form banForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	duration, ok := banDurations[form.Duration]
+
+	form.CheckField(form.UserID > 0, "user_id", "a user ID is required")
+	form.CheckField(form.UserID != app.authenticatedUserID(r), "user_id", "you cannot ban yourself")
+	form.CheckField(ok, "duration", "invalid duration")
+	form.CheckField(NotBlank(form.Reason), "reason", "a reason is required")
+	form.CheckField(MaxChars(form.Reason, 256), "reason", "reason can be at most 256 characters")
+
+	// moderators cannot ban each other from their topic and admins cannot
+	// be banned from the site
+	if form.UserID > 0 {
+		role, err := app.topics.Role(topic_id, form.UserID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		form.CheckField(role == models.RoleMember, "user_id", "moderators cannot be banned")
+	}
+
+	if !form.Valid() {
+		app.renderBans(w, r, topic_id, form)
+		return
+	}
+
+	target, err := app.users.Get(form.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			form.AddFieldError("user_id", "there is no user with that ID")
+			app.renderBans(w, r, topic_id, form)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	moderator, err := app.users.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	ban := &models.Ban{
+		UserID:       target.ID,
+		TopicID:      topic_id,
+		BannedBy:     moderator.ID,
+		BannedByName: moderator.Name,
+		Reason:       form.Reason,
+	}
+	if duration > 0 {
+		ban.Expires = time.Now().Add(duration)
+	}
+
+	err = app.bans.Insert(ban)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s is banned.", target.Name))
+	http.Redirect(w, r, bansURL(topic_id), http.StatusSeeOther)
+}
+
+func (app *application) banLiftPost(w http.ResponseWriter, r *http.Request) {
+	topic_id := app.topicID(r)
+
+	var form banForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	moderator, err := app.users.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.bans.Lift(form.UserID, topic_id, moderator.ID, moderator.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.sessionManager.Put(r.Context(), "flash", "That user is not banned.")
+			http.Redirect(w, r, bansURL(topic_id), http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Ban lifted.")
+	http.Redirect(w, r, bansURL(topic_id), http.StatusSeeOther)
+}
+
+// renderBans shows the ban form again with its errors
+func (app *application) renderBans(w http.ResponseWriter, r *http.Request, topic_id int, form banForm) {
+	data := app.newTemplateData(r)
+
+	if topic_id > 0 {
+		topic, err := app.topics.Get(topic_id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		data.Topic = topic
+		data.IsModerator = true
+	}
+
+	bans, err := app.bans.GetForTopic(topic_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data.Bans = bans
+	data.Form = form
+	app.render(w, http.StatusUnprocessableEntity, "bans.tmpl", data)
+}
@@ -6,9 +6,19 @@ import (
 	"net/http"
 
 	"github.com/groth00/forum/internal/models"
+	"github.com/justinas/nosurf"
 	"go.opentelemetry.io/otel/attribute"
 )
 
+// cutoffs for comment trees rendered in a single response, deeper or wider
+// threads end in "load more replies" links served by commentReplies
+var commentThreadOptions = models.ThreadOptions{
+	MaxDepth:   6,
+	MaxReplies: 10,
+}
+
+var commentSortMethods = []string{models.SortTop, models.SortNew, models.SortOld, models.SortControversial}
+
 type commentCreateForm struct {
 	PostID    int    `form:"post_id"`
 	ParentID  int    `form:"parent_id"`
@@ -28,6 +38,12 @@ func (app *application) commentGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sort := app.getQueryParameterWithDefault(w, r, "sort", models.SortTop)
+	if !PermittedValue(sort, commentSortMethods...) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
 	comment, err := app.comments.Get(comment_id)
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecordFound) {
@@ -39,11 +55,127 @@ func (app *application) commentGet(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	post, err := app.posts.Get(comment.PostID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.hideRemoved(r, post)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	opts, err := app.threadOptions(r, post.TopicID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	thread, err := app.comments.GetSubtree(comment_id, sort, opts)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.renderCommentNodes([]*models.CommentNode{thread})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.loadAttachments(nil, []*models.CommentNode{thread})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.loadInteractions(r, nil, []*models.CommentNode{thread})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	data := app.newTemplateData(r)
 	data.Comment = comment
+	data.Post = post
+	data.CommentNodes = []*models.CommentNode{thread}
+	data.Page = models.Page{Sort: sort}
 	app.render(w, http.StatusOK, "comment.tmpl", data)
 }
 
+// commentReplies answers the "load more replies" links with the subtree
+// rooted at the comment, replacing the truncated one in the page
+func (app *application) commentReplies(w http.ResponseWriter, r *http.Request) {
+	comment_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	sort := app.getQueryParameterWithDefault(w, r, "sort", models.SortTop)
+	if !PermittedValue(sort, commentSortMethods...) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// without htmx the permalink page shows the same subtree
+	if r.Header.Get("HX-Request") != "true" {
+		http.Redirect(w, r, fmt.Sprintf("/comments/%d?sort=%s", comment_id, sort), http.StatusSeeOther)
+		return
+	}
+
+	topic_id, err := app.topics.ForComment(comment_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	opts, err := app.threadOptions(r, topic_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	thread, err := app.comments.GetSubtree(comment_id, sort, opts)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	err = app.renderCommentNodes([]*models.CommentNode{thread})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.loadAttachments(nil, []*models.CommentNode{thread})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.loadInteractions(r, nil, []*models.CommentNode{thread})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := varargs([]*models.CommentNode{thread}, nosurf.Token(r), sort)
+	app.renderFragment(w, http.StatusOK, "post.tmpl", "comment", data)
+}
+
 func (app *application) commentCreatePost(w http.ResponseWriter, r *http.Request) {
 	_, span := tracer.Start(r.Context(), "commentCreate")
 	defer span.End()
@@ -78,6 +210,12 @@ func (app *application) commentCreatePost(w http.ResponseWriter, r *http.Request
 		form.AddNonFieldError("tried to create a comment for a non-existent post")
 	}
 
+	if post.Locked {
+		app.sessionManager.Put(r.Context(), "flash", "This post is locked, it does not accept new comments.")
+		http.Redirect(w, r, fmt.Sprintf("/posts/%d", post.ID), http.StatusSeeOther)
+		return
+	}
+
 	span.AddEvent("Checking for valid parent ID if specified")
 	if form.ParentID > 0 {
 		_, err = app.comments.Get(form.ParentID)
@@ -92,17 +230,49 @@ func (app *application) commentCreatePost(w http.ResponseWriter, r *http.Request
 		}
 	}
 
+	uploads, err := app.readAttachments(r, &form.Validator)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if !form.Valid() {
+		// the form is not shown again, the first error goes in the flash
+		messages := form.NonFieldErrors
+		for _, message := range form.FieldErrors {
+			messages = append(messages, message)
+		}
+		app.sessionManager.Put(r.Context(), "flash", messages[0])
+		http.Redirect(w, r, fmt.Sprintf("/posts/%d", form.PostID), http.StatusSeeOther)
+		return
+	}
+
 	span.AddEvent("Inserting comment into database")
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+	user_id := app.authenticatedUserID(r)
 	user, err := app.users.Get(user_id)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	_, err = app.comments.Insert(user_id, form.PostID, form.ParentID, user.Name, form.Content)
+	err = app.storeUploads(r.Context(), uploads)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	_, err = app.comments.Insert(user_id, form.PostID, form.ParentID, user.Name, form.Content, uploadedAttachments(uploads))
 	if err != nil {
+		// the comment was not created, nothing refers to the files
+		app.deleteUploads(r.Context(), uploads)
 		switch {
+		case errors.Is(err, models.ErrPostLocked):
+			app.sessionManager.Put(r.Context(), "flash", "This post is locked, it does not accept new comments.")
+			http.Redirect(w, r, fmt.Sprintf("/posts/%d", form.PostID), http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrBanned):
+			http.Redirect(w, r, "/banned", http.StatusSeeOther)
+			return
 		case errors.Is(err, models.ErrStartTransaction), errors.Is(err, models.ErrCommitTransaction):
 			app.errorLog.Println("failed to start/commit transaction")
 			return
@@ -141,14 +311,19 @@ func (app *application) commentDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if comment.UserID != app.sessionManager.GetInt(r.Context(), "authenticatedUserID") {
+	if comment.UserID != app.authenticatedUserID(r) {
 		app.clientError(w, http.StatusUnauthorized)
 		return
 	}
 
-	err = app.comments.Delete(comment_id)
+	err = app.comments.Delete(comment.UserID, comment_id)
 	if err != nil {
-		app.serverError(w, err)
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
 		return
 	}
 }
@@ -166,7 +341,7 @@ func (app *application) commentUpdatePost(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if comment.UserID != app.sessionManager.GetInt(r.Context(), "authenticatedUserID") {
+	if comment.UserID != app.authenticatedUserID(r) {
 		app.clientError(w, http.StatusUnauthorized)
 		return
 	}
@@ -199,83 +374,3 @@ func (app *application) commentUpdatePost(w http.ResponseWriter, r *http.Request
 	app.sessionManager.Put(r.Context(), "flash", "Comment successfully updated!")
 	http.Redirect(w, r, fmt.Sprintf("/comments/%d", comment.ID), http.StatusSeeOther)
 }
-
-func (app *application) commentLike(w http.ResponseWriter, r *http.Request) {
-	_, trace := tracer.Start(r.Context(), "comment_like")
-	defer trace.End()
-
-	comment_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-	trace.SetAttributes(
-		attribute.Int("comment_id", comment_id),
-		attribute.Int("user_id", user_id),
-	)
-
-	trace.AddEvent("Adding comment like to table")
-	err = app.comments.Like(user_id, comment_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-}
-
-func (app *application) commentDislike(w http.ResponseWriter, r *http.Request) {
-	comment_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-
-	err = app.comments.Dislike(user_id, comment_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-}
-
-func (app *application) commentSave(w http.ResponseWriter, r *http.Request) {
-	_, trace := tracer.Start(r.Context(), "comment_save")
-	defer trace.End()
-
-	comment_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-	trace.SetAttributes(
-		attribute.Int("comment_id", comment_id),
-		attribute.Int("user_id", user_id),
-	)
-
-	trace.AddEvent("Saving comment to table")
-	err = app.comments.Save(user_id, comment_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-}
-
-func (app *application) commentUnsave(w http.ResponseWriter, r *http.Request) {
-	comment_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-
-	err = app.comments.Unsave(user_id, comment_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-}
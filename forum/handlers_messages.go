@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+type messageForm struct {
+	Content   string `form:"content"`
+	Validator `form:"-"`
+}
+
+const (
+	maxMessageLength = 2048
+	// accounts younger than this can only send a few messages and get the
+	// stricter rate limits, which keeps throwaway accounts from spamming
+	newAccountAge           = 7 * 24 * time.Hour
+	newAccountMessages      = 10 // per hour
+	newAccountConversations = 3  // per day
+)
+
+func (app *application) messageList(w http.ResponseWriter, r *http.Request) {
+	conversations, err := app.messages.Conversations(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Conversations = conversations
+	data.Form = messageForm{}
+	app.render(w, http.StatusOK, "user_messages.tmpl", data)
+}
+
+// messageGet shows a conversation of the user and marks it as read
+func (app *application) messageGet(w http.ResponseWriter, r *http.Request) {
+	conversation_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	conversation, err := app.messages.Get(conversation_id, user_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	messages, err := app.messages.Messages(conversation_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if len(messages) > 0 {
+		err = app.messages.MarkRead(conversation_id, user_id, messages[len(messages)-1].ID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	blocked, err := app.messages.HasBlocked(user_id, conversation.OtherID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Conversation = conversation
+	data.Messages = messages
+	data.Blocked = blocked
+	data.Form = messageForm{}
+	app.render(w, http.StatusOK, "user_messages.tmpl", data)
+}
+
+func (app *application) messageReplyPost(w http.ResponseWriter, r *http.Request) {
+	conversation_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	form, ok := app.readMessageForm(w, r)
+	if !ok {
+		return
+	}
+
+	conversation_url := fmt.Sprintf("/messages/%d", conversation_id)
+
+	if !form.Valid() {
+		app.sessionManager.Put(r.Context(), "flash", form.FieldErrors["content"])
+		http.Redirect(w, r, conversation_url, http.StatusSeeOther)
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	if message, err := app.messageLimit(user_id, false); err != nil {
+		app.serverError(w, err)
+		return
+	} else if message != "" {
+		app.sessionManager.Put(r.Context(), "flash", message)
+		http.Redirect(w, r, conversation_url, http.StatusSeeOther)
+		return
+	}
+
+	err = app.messages.Reply(user_id, conversation_id, form.Content)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		case errors.Is(err, models.ErrBlocked):
+			app.sessionManager.Put(r.Context(), "flash", "You cannot message this user.")
+			http.Redirect(w, r, conversation_url, http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	http.Redirect(w, r, conversation_url+"#latest", http.StatusSeeOther)
+}
+
+// userMessagePost sends a message from the profile page of a user, it goes to
+// the existing conversation with them if there is one
+func (app *application) userMessagePost(w http.ResponseWriter, r *http.Request) {
+	recipient_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	form, ok := app.readMessageForm(w, r)
+	if !ok {
+		return
+	}
+
+	profile_url := fmt.Sprintf("/users/profile/%d", recipient_id)
+
+	if !form.Valid() {
+		app.sessionManager.Put(r.Context(), "flash", form.FieldErrors["content"])
+		http.Redirect(w, r, profile_url, http.StatusSeeOther)
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	if recipient_id == user_id {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	_, err = app.messages.Find(user_id, recipient_id)
+	starting := errors.Is(err, models.ErrNoRecordFound)
+	if err != nil && !starting {
+		app.serverError(w, err)
+		return
+	}
+
+	if message, err := app.messageLimit(user_id, starting); err != nil {
+		app.serverError(w, err)
+		return
+	} else if message != "" {
+		app.sessionManager.Put(r.Context(), "flash", message)
+		http.Redirect(w, r, profile_url, http.StatusSeeOther)
+		return
+	}
+
+	conversation_id, err := app.messages.Send(user_id, recipient_id, form.Content)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		case errors.Is(err, models.ErrBlocked):
+			app.sessionManager.Put(r.Context(), "flash", "You cannot message this user.")
+			http.Redirect(w, r, profile_url, http.StatusSeeOther)
+		case errors.Is(err, models.ErrConcurrencyControl):
+			app.sessionManager.Put(r.Context(), "flash", err.Error())
+			http.Redirect(w, r, profile_url, http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/messages/%d#latest", conversation_id), http.StatusSeeOther)
+}
+
+func (app *application) userBlockPost(w http.ResponseWriter, r *http.Request) {
+	blocked_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	if blocked_id == user_id {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	_, err = app.users.Get(blocked_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	err = app.messages.Block(user_id, blocked_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "User blocked, neither of you can message the other.")
+	http.Redirect(w, r, fmt.Sprintf("/users/profile/%d", blocked_id), http.StatusSeeOther)
+}
+
+func (app *application) userUnblockPost(w http.ResponseWriter, r *http.Request) {
+	blocked_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	err = app.messages.Unblock(app.authenticatedUserID(r), blocked_id)
+	if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "User unblocked.")
+	http.Redirect(w, r, fmt.Sprintf("/users/profile/%d", blocked_id), http.StatusSeeOther)
+}
+
+func (app *application) readMessageForm(w http.ResponseWriter, r *http.Request) (messageForm, bool) {
+	var form messageForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return form, false
+	}
+
+	form.CheckField(NotBlank(form.Content), "content", "The message cannot be blank")
+	form.CheckField(MaxChars(form.Content, maxMessageLength), "content", fmt.Sprintf("The message cannot be longer than %d characters", maxMessageLength))
+	return form, true
+}
+
+// messageLimit returns the reason a new account cannot send a message right
+// now, or an empty string when it can; older accounts are not limited
+func (app *application) messageLimit(user_id int, starting bool) (string, error) {
+	user, err := app.users.Get(user_id)
+	if err != nil {
+		return "", err
+	}
+
+	if time.Since(user.Created) >= newAccountAge {
+		return "", nil
+	}
+
+	messages, _, err := app.messages.SentSince(user_id, time.Now().Add(-time.Hour))
+	if err != nil {
+		return "", err
+	}
+	if messages >= newAccountMessages {
+		return "New accounts can only send a few messages per hour, please try again later.", nil
+	}
+
+	if starting {
+		_, conversations, err := app.messages.SentSince(user_id, time.Now().Add(-24*time.Hour))
+		if err != nil {
+			return "", err
+		}
+		if conversations >= newAccountConversations {
+			return "New accounts can only start a few conversations per day, please try again tomorrow.", nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+var reportReasons = []string{"spam", "harassment", "off-topic", "misinformation", "other"}
+
+type reportForm struct {
+	Reason    string `form:"reason"`
+	Validator `form:"-"`
+}
+
+type modActionForm struct {
+	Action    string `form:"action"`
+	Reason    string `form:"reason"`
+	Return    string `form:"return"` // page to go back to, the queue when empty
+	Validator `form:"-"`
+}
+
+type modLogForm struct {
+	Action    string `form:"action"`
+	Moderator string `form:"moderator"`
+	Username  string `form:"user"`
+}
+
+// isModerator reports whether the user of the request moderates the topic
+func (app *application) isModerator(r *http.Request, topic_id int) (bool, error) {
+	role, err := app.roleIn(r, topic_id)
+	if err != nil {
+		return false, err
+	}
+	return models.RoleAllows(role, models.RoleModerator), nil
+}
+
+// hideRemoved replaces the title, content and link of a removed or deleted
+// post for everyone but the moderators of its topic, deleted posts lose their
+// author as well
+func (app *application) hideRemoved(r *http.Request, post *models.Post) error {
+	if !post.Removed && !post.Deleted {
+		return nil
+	}
+
+	moderator, err := app.isModerator(r, post.TopicID)
+	if err != nil {
+		return err
+	}
+
+	if moderator {
+		return nil
+	}
+
+	post.Title = "[removed]"
+	if post.Deleted {
+		post.Title = "[deleted]"
+		post.UserID = 0
+		post.Username = "[deleted]"
+	}
+	post.Content = ""
+	post.Link = ""
+	post.Preview = nil
+	post.Hidden = true
+	return nil
+}
+
+// hideRemovedComment is the comment counterpart of hideRemoved
+func (app *application) hideRemovedComment(r *http.Request, comment *models.Comment, topic_id int) error {
+	if !comment.Removed && !comment.Deleted {
+		return nil
+	}
+
+	moderator, err := app.isModerator(r, topic_id)
+	if err != nil {
+		return err
+	}
+
+	if moderator {
+		return nil
+	}
+
+	if comment.Deleted {
+		comment.UserID = 0
+		comment.Username = "[deleted]"
+	}
+	comment.Content = ""
+	return nil
+}
+
+// threadOptions returns the cutoffs for the comment trees of a topic, its
+// moderators also get the original text of removed and deleted comments
+func (app *application) threadOptions(r *http.Request, topic_id int) (models.ThreadOptions, error) {
+	opts := commentThreadOptions
+
+	moderator, err := app.isModerator(r, topic_id)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.ShowHidden = moderator
+	return opts, nil
+}
+
+func (app *application) postReportPost(w http.ResponseWriter, r *http.Request) {
+	post_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	var form reportForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(PermittedValue(form.Reason, reportReasons...), "reason", "invalid reason")
+	if !form.Valid() {
+		app.clientError(w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	_, err = app.posts.Get(post_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	err = app.moderation.ReportPost(app.authenticatedUserID(r), post_id, form.Reason)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Thanks, the moderators will take a look.")
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", post_id), http.StatusSeeOther)
+}
+
+func (app *application) commentReportPost(w http.ResponseWriter, r *http.Request) {
+	comment_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	var form reportForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(PermittedValue(form.Reason, reportReasons...), "reason", "invalid reason")
+	if !form.Valid() {
+		app.clientError(w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	comment, err := app.comments.Get(comment_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	err = app.moderation.ReportComment(app.authenticatedUserID(r), comment_id, form.Reason)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Thanks, the moderators will take a look.")
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d#comment-%d", comment.PostID, comment_id), http.StatusSeeOther)
+}
+
+func (app *application) modQueue(w http.ResponseWriter, r *http.Request) {
+	topic_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	topic, err := app.topics.Get(topic_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	page, err := app.readPageRequest(r, models.SortNew, models.SortNew, models.SortOld)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	moderators, err := app.topics.GetModerators(topic_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	items, metadata, err := app.moderation.Queue(topic_id, page)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCursor):
+			app.clientError(w, http.StatusBadRequest)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Topic = topic
+	data.ModQueue = items
+	data.Page = metadata
+	data.IsModerator = true
+	data.TopicRole = app.topicRole(r)
+	data.Moderators = moderators
+	app.render(w, http.StatusOK, "modqueue.tmpl", data)
+}
+
+// postModeratePost applies a moderation action to the post in the route
+func (app *application) postModeratePost(w http.ResponseWriter, r *http.Request) {
+	post_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	app.moderate(w, r, post_id, 0)
+}
+
+// commentModeratePost applies a moderation action to the comment in the route
+func (app *application) commentModeratePost(w http.ResponseWriter, r *http.Request) {
+	comment_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	app.moderate(w, r, 0, comment_id)
+}
+
+// moderate runs behind requireTopicModerator, which resolved the topic of
+// the post or comment
+func (app *application) moderate(w http.ResponseWriter, r *http.Request, post_id, comment_id int) {
+	var form modActionForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	topic_id := app.topicID(r)
+	queue := fmt.Sprintf("/topics/%d/modqueue", topic_id)
+
+	form.CheckField(PermittedValue(form.Action, models.ModActions...), "action", "invalid action")
+	form.CheckField(MaxChars(form.Reason, 256), "reason", "reason can be at most 256 characters")
+	form.CheckField(form.Return == "" || LocalPath(form.Return), "return", "invalid return page")
+
+	if !form.Valid() {
+		for _, message := range form.FieldErrors {
+			app.sessionManager.Put(r.Context(), "flash", message)
+			break
+		}
+		http.Redirect(w, r, queue, http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.users.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	action := &models.ModAction{
+		TopicID:       topic_id,
+		ModeratorID:   user.ID,
+		ModeratorName: user.Name,
+		Action:        form.Action,
+		PostID:        post_id,
+		CommentID:     comment_id,
+		Reason:        form.Reason,
+	}
+
+	err = app.moderation.Act(action)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		case errors.Is(err, models.ErrInvalidModAction):
+			app.sessionManager.Put(r.Context(), "flash", "Only posts can be locked.")
+			http.Redirect(w, r, queue, http.StatusSeeOther)
+		case errors.Is(err, models.ErrDuplicateLink):
+			app.sessionManager.Put(r.Context(), "flash", "Another post of the topic has the same link, remove it before approving this one.")
+			http.Redirect(w, r, queue, http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	target := "Post"
+	if comment_id > 0 {
+		target = "Comment"
+	}
+
+	flash := map[string]string{
+		models.ModRemove:  "%s removed.",
+		models.ModApprove: "%s approved.",
+		models.ModLock:    "%s locked.",
+		models.ModUnlock:  "%s unlocked.",
+	}[form.Action]
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf(flash, target))
+
+	if form.Return != "" {
+		queue = form.Return
+	}
+	http.Redirect(w, r, queue, http.StatusSeeOther)
+}
+
+func (app *application) modLog(w http.ResponseWriter, r *http.Request) {
+	topic_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	topic, err := app.topics.Get(topic_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	var form modLogForm
+	err = app.formDecoder.Decode(&form, r.URL.Query())
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if form.Action != "" && !PermittedValue(form.Action, models.LogActions...) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	page, err := app.readPageRequest(r, models.SortNew, models.SortNew, models.SortOld)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	filter := models.LogFilter{
+		Action:    form.Action,
+		Moderator: strings.TrimSpace(form.Moderator),
+		Username:  strings.TrimSpace(form.Username),
+	}
+
+	entries, metadata, err := app.moderation.Log(topic_id, filter, page)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCursor):
+			app.clientError(w, http.StatusBadRequest)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Topic = topic
+	data.ModLog = entries
+	data.Page = metadata
+	data.Form = form
+	data.IsModerator = true
+	app.render(w, http.StatusOK, "modlog.tmpl", data)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+func (app *application) notificationList(w http.ResponseWriter, r *http.Request) {
+	page, err := app.readPageRequest(r, models.SortNew, models.SortNew)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	notifications, metadata, err := app.notifications.List(user_id, page)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCursor):
+			app.clientError(w, http.StatusBadRequest)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Notifications = notifications
+	data.Page = metadata
+	app.render(w, http.StatusOK, "notifications.tmpl", data)
+}
+
+// notificationGet marks a notification as read and redirects to the post or
+// comment it is about
+func (app *application) notificationGet(w http.ResponseWriter, r *http.Request) {
+	notification_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	notification, err := app.notifications.Get(user_id, notification_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	err = app.notifications.MarkRead(user_id, notification_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	target := fmt.Sprintf("/posts/%d", notification.PostID)
+	if notification.CommentID > 0 {
+		target = fmt.Sprintf("/comments/%d", notification.CommentID)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func (app *application) notificationReadAllPost(w http.ResponseWriter, r *http.Request) {
+	user_id := app.authenticatedUserID(r)
+	err := app.notifications.MarkAllRead(user_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "All notifications marked as read.")
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+const (
+	pollMaxOptions = 10
+	// layout of the datetime-local input of the closing date, read as UTC
+	pollClosesLayout = "2006-01-02T15:04"
+)
+
+type pollVoteForm struct {
+	Options []int `form:"option"`
+}
+
+// readPoll checks the poll fields of the post form and returns the poll, or
+// nil when no option was filled in and the post is not a poll
+func readPoll(form *postCreateForm) *models.Poll {
+	labels := []string{}
+	for _, label := range form.Options {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+
+	if len(labels) == 0 {
+		form.CheckField(form.Closes == "", "options", "a poll needs options")
+		return nil
+	}
+
+	form.CheckField(form.Link == "", "options", "a post can either be a link or a poll")
+	form.CheckField(len(labels) >= 2, "options", "a poll needs at least 2 options")
+	form.CheckField(len(labels) <= pollMaxOptions, "options", fmt.Sprintf("a poll can have at most %d options", pollMaxOptions))
+
+	poll := &models.Poll{Multiple: form.Multiple}
+	for i, label := range labels {
+		form.CheckField(MaxChars(label, 128), "options", "options can be at most 128 characters")
+		form.CheckField(!slices.Contains(labels[:i], label), "options", "options must be different")
+		poll.Options = append(poll.Options, &models.PollOption{Label: label})
+	}
+
+	if form.Closes != "" {
+		closes, err := time.ParseInLocation(pollClosesLayout, form.Closes, time.UTC)
+		form.CheckField(err == nil, "closes", "invalid closing date")
+		form.CheckField(err != nil || closes.After(time.Now()), "closes", "the closing date must be in the future")
+		poll.Closes = closes
+	}
+
+	return poll
+}
+
+// loadPoll fills in the poll of the post for the user of the request, with
+// the results left out until they voted or the poll closed
+func (app *application) loadPoll(r *http.Request, post *models.Post) error {
+	if post.Hidden {
+		return nil
+	}
+
+	poll, err := app.polls.Get(post.ID, app.authenticatedUserID(r))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecordFound) {
+			return nil
+		}
+		return err
+	}
+
+	poll.HideResults()
+	post.Poll = poll
+	return nil
+}
+
+func (app *application) postVotePost(w http.ResponseWriter, r *http.Request) {
+	post_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	var form pollVoteForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	post_url := fmt.Sprintf("/posts/%d", post_id)
+
+	// a checkbox sent twice is still one vote
+	slices.Sort(form.Options)
+	options := slices.Compact(form.Options)
+
+	err = app.polls.Vote(app.authenticatedUserID(r), post_id, options)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		case errors.Is(err, models.ErrBanned):
+			http.Redirect(w, r, "/banned", http.StatusSeeOther)
+		case errors.Is(err, models.ErrPollClosed):
+			app.sessionManager.Put(r.Context(), "flash", "This poll is closed.")
+			http.Redirect(w, r, post_url, http.StatusSeeOther)
+		case errors.Is(err, models.ErrAlreadyVoted):
+			app.sessionManager.Put(r.Context(), "flash", "You already voted in this poll.")
+			http.Redirect(w, r, post_url, http.StatusSeeOther)
+		case errors.Is(err, models.ErrInvalidPollVote):
+			app.sessionManager.Put(r.Context(), "flash", "Choose one of the options to vote.")
+			http.Redirect(w, r, post_url, http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Thanks for voting!")
+	http.Redirect(w, r, post_url+"#poll", http.StatusSeeOther)
+}
@@ -4,22 +4,24 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"slices"
-	"strconv"
 
 	"github.com/groth00/forum/internal/models"
 )
 
-const (
-	sortMethodLikes = "likes"
-	sortMethodNew   = "new"
-	sortMethodOld   = "old"
-)
+var postSortMethods = []string{models.SortHot, models.SortNew, models.SortTop, models.SortRising, models.SortOld}
 
 type postCreateForm struct {
-	TopicID   int    `form:"topic_id"`
-	Title     string `form:"title"`
-	Content   string `form:"content"`
+	TopicID int    `form:"topic_id"`
+	Title   string `form:"title"`
+	Content string `form:"content"`
+	// URL of link posts, their content is optional
+	Link string `form:"link"`
+	// post that already links to the same URL
+	Duplicate int `form:"-"`
+	// poll posts have options, a poll can close at a date given in UTC
+	Options   []string `form:"options"`
+	Multiple  bool     `form:"multiple"`
+	Closes    string   `form:"closes"`
 	Validator `form:"-"`
 }
 
@@ -37,7 +39,11 @@ func (app *application) postGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sortMethod := app.getQueryParameterWithDefault(w, r, "sortMethod", sortMethodLikes)
+	page, err := app.readPageRequest(r, models.SortTop, commentSortMethods...)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
 
 	post, err := app.posts.Get(id)
 	if err != nil {
@@ -45,69 +51,129 @@ func (app *application) postGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	comments, err := app.comments.GetForPost(post.ID)
+	moderator, err := app.isModerator(r, post.TopicID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.hideRemoved(r, post)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	opts := commentThreadOptions
+	opts.ShowHidden = moderator
+
+	comments, metadata, err := app.comments.GetForPost(post.ID, page, opts)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrNoCommentsForPost):
 			break
+		case errors.Is(err, models.ErrInvalidCursor):
+			app.clientError(w, http.StatusBadRequest)
+			return
 		default:
 			app.serverError(w, err)
 			return
 		}
 	}
 
-	if comments != nil {
-		switch sortMethod {
-		case sortMethodOld:
-			slices.SortFunc(comments, func(a, b *models.CommentNode) int {
-				return int(b.Created.Unix() - a.Created.Unix())
-			})
-		case sortMethodNew:
-			slices.SortFunc(comments, func(a, b *models.CommentNode) int {
-				return int(a.Created.Unix() - b.Created.Unix())
-			})
-		case sortMethodLikes:
-			slices.SortFunc(comments, func(a, b *models.CommentNode) int {
-				return b.Likes - a.Likes
-			})
-		}
+	err = app.renderPost(post)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.renderCommentNodes(comments)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.loadAttachments(post, comments)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.loadInteractions(r, post, comments)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.loadPoll(r, post)
+	if err != nil {
+		app.serverError(w, err)
+		return
 	}
 
 	data := app.newTemplateData(r)
 	data.Form = &commentCreateForm{}
 	data.Post = post
 	data.CommentNodes = comments
+	data.Page = metadata
+	data.IsModerator = moderator
 	app.render(w, http.StatusOK, "post.tmpl", data)
 }
 
 func (app *application) postList(w http.ResponseWriter, r *http.Request) {
-	var limit int
+	page, err := app.readPageRequest(r, models.SortHot, postSortMethods...)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
 
-	qp := r.URL.Query()
-	if temp := qp.Get("limit"); temp != "" {
-		converted, err := strconv.Atoi(temp)
-		if err != nil {
+	posts, metadata, err := app.posts.List(page)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCursor):
 			app.clientError(w, http.StatusBadRequest)
-			return
-		} else {
-			limit = converted
+		default:
+			app.serverError(w, err)
 		}
+		return
 	}
 
-	posts, err := app.posts.List(limit)
+	data := app.newTemplateData(r)
+	data.Posts = posts
+	data.Page = metadata
+	app.render(w, http.StatusOK, "posts.tmpl", data)
+}
+
+type previewForm struct {
+	Content string `form:"content"`
+}
+
+// markdownPreview renders the content of the post and comment forms as it
+// will be shown once submitted, for the live preview below the forms
+func (app *application) markdownPreview(w http.ResponseWriter, r *http.Request) {
+	var form previewForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if !MaxChars(form.Content, 2048) {
+		app.clientError(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	html, err := app.markdown.Render(form.Content)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	data := app.newTemplateData(r)
-	data.Posts = posts
-	app.render(w, http.StatusOK, "posts.tmpl", data)
+	app.renderFragment(w, http.StatusOK, "post_create.tmpl", "markdown_preview", html)
 }
 
 func (app *application) postCreate(w http.ResponseWriter, r *http.Request) {
 	data := app.newTemplateData(r)
-	data.Form = &postCreateForm{}
+	data.Form = &postCreateForm{Options: make([]string, 4)}
 	app.render(w, http.StatusOK, "post_create.tmpl", data)
 }
 
@@ -124,8 +190,11 @@ func (app *application) postCreatePost(w http.ResponseWriter, r *http.Request) {
 	form.CheckField(ValidInt(form.TopicID), "topic", "must be an integer")
 	form.CheckField(NotBlank(form.Title), "title", "title cannot be blank")
 	form.CheckField(MaxChars(form.Title, 64), "title", "title can be at most 64 characters")
-	form.CheckField(NotBlank(form.Content), "content", "content cannot be blank")
+	poll := readPoll(&form)
+	form.CheckField(form.Link != "" || poll != nil || NotBlank(form.Content), "content", "content cannot be blank")
 	form.CheckField(MaxChars(form.Content, 2048), "content", "content can be at most 2048 characters")
+	form.CheckField(form.Link == "" || validLink(form.Link), "link", "link must be an http or https URL")
+	form.CheckField(MaxChars(form.Link, 2048), "link", "link can be at most 2048 characters")
 
 	_, err = app.topics.Get(form.TopicID)
 	if err != nil {
@@ -138,6 +207,23 @@ func (app *application) postCreatePost(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if form.Link != "" && form.Valid() {
+		form.Duplicate, err = app.posts.FindLink(form.TopicID, form.Link)
+		switch {
+		case err == nil:
+			form.AddFieldError("link", "this link was already submitted to the topic")
+		case !errors.Is(err, models.ErrNoRecordFound):
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	uploads, err := app.readAttachments(r, &form.Validator)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	if !form.Valid() {
 		data := app.newTemplateData(r)
 		data.Form = form
@@ -145,19 +231,41 @@ func (app *application) postCreatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+	user_id := app.authenticatedUserID(r)
 	user, err := app.users.Get(user_id)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	post_id, err := app.posts.Insert(user.ID, form.TopicID, user.Name, form.Title, form.Content)
+	err = app.storeUploads(r.Context(), uploads)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
+	post_id, err := app.posts.Insert(user.ID, form.TopicID, user.Name, form.Title, form.Content, form.Link, poll, uploadedAttachments(uploads))
+	if err != nil {
+		// the post was not created, nothing refers to the files
+		app.deleteUploads(r.Context(), uploads)
+		switch {
+		case errors.Is(err, models.ErrBanned):
+			http.Redirect(w, r, "/banned", http.StatusSeeOther)
+		case errors.Is(err, models.ErrDuplicateLink):
+			form.AddFieldError("link", "this link was already submitted to the topic")
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, http.StatusUnprocessableEntity, "post_create.tmpl", data)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	if form.Link != "" {
+		app.background(func() { app.fetchLinkPreview(post_id, form.Link) })
+	}
+
 	app.sessionManager.Put(r.Context(), "flash", "Post successfully created!")
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", post_id), http.StatusSeeOther)
 }
@@ -175,14 +283,19 @@ func (app *application) postDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if post.UserID != app.sessionManager.GetInt(r.Context(), "authenticatedUserID") {
+	if post.UserID != app.authenticatedUserID(r) {
 		app.clientError(w, http.StatusUnauthorized)
 		return
 	}
 
 	err = app.posts.Delete(post.UserID, post.ID, post.TopicID)
 	if err != nil {
-		app.serverError(w, err)
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
 		return
 	}
 
@@ -202,7 +315,7 @@ func (app *application) postUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if post.UserID != app.sessionManager.GetInt(r.Context(), "authenticatedUserID") {
+	if post.UserID != app.authenticatedUserID(r) {
 		app.clientError(w, http.StatusUnauthorized)
 		return
 	}
@@ -225,7 +338,7 @@ func (app *application) postUpdatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if post.UserID != app.sessionManager.GetInt(r.Context(), "authenticatedUserID") {
+	if post.UserID != app.authenticatedUserID(r) {
 		app.clientError(w, http.StatusUnauthorized)
 		return
 	}
@@ -237,10 +350,17 @@ func (app *application) postUpdatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// link and poll posts can do without text, as when they were created
+	err = app.loadPoll(r, post)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	validator := Validator{}
 	validator.CheckField(NotBlank(form.Title), "title", "title cannot be blank")
 	validator.CheckField(MaxChars(form.Title, 64), "title", "title can be at most 64 characters")
-	validator.CheckField(NotBlank(form.Content), "content", "content cannot be blank")
+	validator.CheckField(post.Link != "" || post.Poll != nil || NotBlank(form.Content), "content", "content cannot be blank")
 	validator.CheckField(MaxChars(form.Content, 2048), "content", "content can be at most 2048 characters")
 
 	if !validator.Valid() {
@@ -261,67 +381,3 @@ func (app *application) postUpdatePost(w http.ResponseWriter, r *http.Request) {
 	app.sessionManager.Put(r.Context(), "flash", "Post successfully updated!")
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", post_id), http.StatusSeeOther)
 }
-
-func (app *application) postLike(w http.ResponseWriter, r *http.Request) {
-	post_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-
-	err = app.posts.Like(user_id, post_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-}
-
-func (app *application) postDislike(w http.ResponseWriter, r *http.Request) {
-	post_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-
-	err = app.posts.Dislike(user_id, post_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-}
-
-func (app *application) postSave(w http.ResponseWriter, r *http.Request) {
-	post_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-
-	err = app.posts.Save(user_id, post_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-}
-
-func (app *application) postUnsave(w http.ResponseWriter, r *http.Request) {
-	post_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-
-	err = app.posts.Unsave(user_id, post_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestPostUpdatePost(t *testing.T) {
+	tests := []struct {
+		name    string
+		link    string
+		poll    bool
+		content string
+		valid   bool
+	}{
+		{"link post without text", "https://example.com/article", false, "", true},
+		{"link post with text", "https://example.com/article", false, "about the article", true},
+		{"poll post without text", "", true, "", true},
+		{"text post without text", "", false, "", false},
+		{"text post", "", false, "new text", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updated []driver.Value
+			app := newTestApplication(t, func(query string, args []driver.Value) (fakeResult, error) {
+				switch {
+				case strings.Contains(query, "LEFT JOIN link_previews"):
+					now := time.Now()
+					return row(
+						int64(3), int64(1), int64(7), "alice", int64(1), 0.0, 0.0, now, now, "title", "", int64(0),
+						false, false, false, nil, int64(1),
+						tt.link, "", "", "", "", nil,
+					), nil
+				case strings.Contains(query, "FROM polls"):
+					if !tt.poll {
+						return fakeResult{columns: make([]string, 3)}, nil
+					}
+					return row(int64(3), false, nil), nil
+				case strings.Contains(query, "FROM poll_options"):
+					return fakeResult{columns: make([]string, 4)}, nil
+				case strings.Contains(query, "UPDATE posts SET title"):
+					updated = args
+					now := time.Now()
+					return row(now, now, int64(2)), nil
+				case strings.Contains(query, "INSERT INTO post_revisions"):
+					return fakeResult{affected: 1}, nil
+				}
+				return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+			})
+
+			handler := app.sessionManager.LoadAndSave(http.HandlerFunc(app.postUpdatePost))
+
+			form := url.Values{"title": {"new title"}, "content": {tt.content}}
+			r := httptest.NewRequest(http.MethodPut, "/posts/3", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, httprouter.Params{{Key: "id", Value: "3"}}))
+			r = asUser(r, 7)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if !tt.valid {
+				if rr.Code == http.StatusSeeOther || updated != nil {
+					t.Errorf("got status %d and update %v; want the form rejected", rr.Code, updated)
+				}
+				return
+			}
+
+			if rr.Code != http.StatusSeeOther {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusSeeOther)
+			}
+			if len(updated) < 2 || updated[1] != tt.content {
+				t.Errorf("got update %v; want content %q", updated, tt.content)
+			}
+		})
+	}
+}
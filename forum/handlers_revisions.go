@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+// revisionDiff compares two versions of a post or comment
+type revisionDiff struct {
+	From  *models.Revision
+	To    *models.Revision
+	Lines []diffLine
+}
+
+type revisionForm struct {
+	From int `form:"from"`
+	To   int `form:"to"`
+}
+
+func (app *application) postRevisions(w http.ResponseWriter, r *http.Request) {
+	post_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	post, err := app.posts.Get(post_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	// the history of hidden posts is kept for the moderators
+	moderator, err := app.isModerator(r, post.TopicID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if (post.Removed || post.Deleted) && !moderator {
+		app.notFound(w, r)
+		return
+	}
+
+	revisions, err := app.posts.Revisions(post_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	diff, ok := app.compareRevisions(r, revisions)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Post = post
+	data.Revisions = revisions
+	data.Diff = diff
+	data.IsModerator = moderator
+	app.render(w, http.StatusOK, "revisions.tmpl", data)
+}
+
+func (app *application) commentRevisions(w http.ResponseWriter, r *http.Request) {
+	comment_id, err := app.getIDParam(w, r, "id")
+	if err != nil {
+		return
+	}
+
+	comment, err := app.comments.Get(comment_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	post, err := app.posts.Get(comment.PostID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	moderator, err := app.isModerator(r, post.TopicID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if (comment.Removed || comment.Deleted) && !moderator {
+		app.notFound(w, r)
+		return
+	}
+
+	err = app.hideRemoved(r, post)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	revisions, err := app.comments.Revisions(comment_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	diff, ok := app.compareRevisions(r, revisions)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Post = post
+	data.Comment = comment
+	data.Revisions = revisions
+	data.Diff = diff
+	data.IsModerator = moderator
+	app.render(w, http.StatusOK, "revisions.tmpl", data)
+}
+
+// compareRevisions diffs the revisions picked by the from and to query
+// parameters, by default the latest edit. It returns nil when there is
+// nothing to compare and false when the parameters are invalid.
+func (app *application) compareRevisions(r *http.Request, revisions []*models.Revision) (*revisionDiff, bool) {
+	var form revisionForm
+	err := app.formDecoder.Decode(&form, r.URL.Query())
+	if err != nil {
+		return nil, false
+	}
+
+	if len(revisions) < 2 {
+		return nil, form.From == 0 && form.To == 0
+	}
+
+	// revisions are numbered from 1 without gaps
+	if form.To == 0 {
+		form.To = len(revisions)
+	}
+	if form.From == 0 {
+		form.From = form.To - 1
+	}
+
+	if form.From < 1 || form.To > len(revisions) || form.From >= form.To {
+		return nil, false
+	}
+
+	from, to := revisions[form.From-1], revisions[form.To-1]
+	return &revisionDiff{
+		From:  from,
+		To:    to,
+		Lines: lineDiff(from.Content, to.Content),
+	}, true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/form/v4"
+	"github.com/groth00/forum/internal/models"
+)
+
+const searchDateLayout = "2006-01-02"
+
+var (
+	searchKinds       = []string{models.SearchAll, models.SearchPosts, models.SearchComments}
+	searchSortMethods = []string{models.SortRelevance, models.SortNew}
+)
+
+type searchForm struct {
+	Query     string `form:"q"`
+	Kind      string `form:"type"`
+	TopicID   int    `form:"topic"`
+	Author    string `form:"author"`
+	From      string `form:"from"`
+	To        string `form:"to"`
+	Sort      string `form:"sort"`
+	Page      int    `form:"page"`
+	Prev      string `form:"-"`
+	Next      string `form:"-"`
+	Validator `form:"-"`
+}
+
+// decodeSearchForm reads the search parameters from the query string and
+// validates them, returning the filters to pass to the model
+func (app *application) decodeSearchForm(r *http.Request, f *searchForm) (models.SearchFilters, error) {
+	err := app.formDecoder.Decode(f, r.URL.Query())
+	if err != nil {
+		var invalidDecoderError *form.InvalidDecoderError
+		if errors.As(err, &invalidDecoderError) {
+			panic(err)
+		}
+		return models.SearchFilters{}, err
+	}
+
+	if f.Kind == "" {
+		f.Kind = models.SearchAll
+	}
+	if f.Sort == "" {
+		f.Sort = models.SortRelevance
+	}
+	if f.Page < 1 {
+		f.Page = 1
+	}
+
+	f.CheckField(NotBlank(f.Query), "q", "enter something to search for")
+	f.CheckField(MaxChars(f.Query, 256), "q", "search can be at most 256 characters")
+	f.CheckField(PermittedValue(f.Kind, searchKinds...), "type", "must be one of all, posts or comments")
+	f.CheckField(PermittedValue(f.Sort, searchSortMethods...), "sort", "must be relevance or new")
+	f.CheckField(f.TopicID >= 0, "topic", "must be a positive integer")
+
+	filters := models.SearchFilters{
+		Query:   f.Query,
+		Kind:    f.Kind,
+		TopicID: f.TopicID,
+		Author:  f.Author,
+		Sort:    f.Sort,
+		Limit:   models.DefaultPageSize,
+		Offset:  (f.Page - 1) * models.DefaultPageSize,
+	}
+
+	if f.From != "" {
+		filters.From, err = time.Parse(searchDateLayout, f.From)
+		f.CheckField(err == nil, "from", "must be a date like 2024-01-31")
+	}
+	if f.To != "" {
+		// the end date is inclusive, the model expects an exclusive bound
+		filters.To, err = time.Parse(searchDateLayout, f.To)
+		f.CheckField(err == nil, "to", "must be a date like 2024-01-31")
+		filters.To = filters.To.AddDate(0, 0, 1)
+	}
+	if !filters.From.IsZero() && !filters.To.IsZero() {
+		f.CheckField(filters.From.Before(filters.To), "to", "must not be before the start date")
+	}
+
+	return filters, nil
+}
+
+// pageURL links to another page of the same search
+func (f *searchForm) pageURL(page int) string {
+	qs := url.Values{}
+	qs.Set("q", f.Query)
+	qs.Set("type", f.Kind)
+	qs.Set("sort", f.Sort)
+	if f.TopicID > 0 {
+		qs.Set("topic", strconv.Itoa(f.TopicID))
+	}
+	if f.Author != "" {
+		qs.Set("author", f.Author)
+	}
+	if f.From != "" {
+		qs.Set("from", f.From)
+	}
+	if f.To != "" {
+		qs.Set("to", f.To)
+	}
+	qs.Set("page", strconv.Itoa(page))
+	return "/search?" + qs.Encode()
+}
+
+func (app *application) searchGet(w http.ResponseWriter, r *http.Request) {
+	_, span := tracer.Start(r.Context(), "searchGet")
+	defer span.End()
+
+	data := app.newTemplateData(r)
+
+	// topics for the filter dropdown
+	topics, _, err := app.topics.List(models.PageRequest{Sort: models.SortOld, Limit: models.MaxPageSize})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	data.Topics = topics
+
+	var form searchForm
+	filters, err := app.decodeSearchForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// a bare visit to /search only shows the form
+	if !r.URL.Query().Has("q") {
+		form.Validator = Validator{}
+		data.Form = form
+		app.render(w, http.StatusOK, "search.tmpl", data)
+		return
+	}
+
+	if !form.Valid() {
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "search.tmpl", data)
+		return
+	}
+
+	results, more, err := app.search.Search(filters)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if form.Page > 1 {
+		form.Prev = form.pageURL(form.Page - 1)
+	}
+	if more {
+		form.Next = form.pageURL(form.Page + 1)
+	}
+
+	data.Form = form
+	data.SearchResults = results
+	app.render(w, http.StatusOK, "search.tmpl", data)
+}
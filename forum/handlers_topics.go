@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
 
 	"github.com/groth00/forum/internal/models"
 )
@@ -14,6 +13,12 @@ type topicCreateForm struct {
 	Validator `form:"-"`
 }
 
+type topicModeratorForm struct {
+	UserID    int    `form:"user_id"`
+	Role      string `form:"role"`
+	Validator `form:"-"`
+}
+
 type topicUpdateForm struct {
 	Name      string `form:"name"`
 	Validator `form:"-"`
@@ -32,41 +37,67 @@ func (app *application) topicGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	posts, err := app.posts.GetByTopic(topic_id)
+	role, err := app.roleIn(r, topic_id)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
+	if user_id := app.authenticatedUserID(r); user_id > 0 {
+		topic.Subscribed, err = app.topics.Subscribed(topic_id, user_id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	page, err := app.readPageRequest(r, models.SortHot, postSortMethods...)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	posts, metadata, err := app.posts.GetByTopic(topic_id, page)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCursor):
+			app.clientError(w, http.StatusBadRequest)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
 	data := app.newTemplateData(r)
 	data.Topic = topic
 	data.Posts = posts
+	data.Page = metadata
+	data.IsModerator = models.RoleAllows(role, models.RoleModerator)
+	data.TopicRole = role
 	app.render(w, http.StatusOK, "topic.tmpl", data)
 }
 
 func (app *application) topicList(w http.ResponseWriter, r *http.Request) {
-	qp := r.URL.Query()
-
-	var limit int
-	if raw := qp.Get("limit"); raw != "" {
-		if temp, err := strconv.Atoi(raw); err != nil {
-			app.serverError(w, err)
-			return
-		} else {
-			limit = temp
-		}
-	} else {
-		limit = 10
+	page, err := app.readPageRequest(r, models.SortOld, models.SortOld, models.SortNew)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
 	}
 
-	topics, err := app.topics.List(limit)
+	topics, metadata, err := app.topics.List(page)
 	if err != nil {
-		app.serverError(w, err)
+		switch {
+		case errors.Is(err, models.ErrInvalidCursor):
+			app.clientError(w, http.StatusBadRequest)
+		default:
+			app.serverError(w, err)
+		}
 		return
 	}
 
 	data := app.newTemplateData(r)
 	data.Topics = topics
+	data.Page = metadata
 	app.render(w, http.StatusOK, "topics.tmpl", data)
 }
 
@@ -161,88 +192,82 @@ func (app *application) topicDelete(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// topicAddModerator gives a user a role in the topic, or changes the role
+// they already have; it runs behind requireTopicOwner
 func (app *application) topicAddModerator(w http.ResponseWriter, r *http.Request) {
-	topic_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
+	topic_id := app.topicID(r)
+	queue := fmt.Sprintf("/topics/%d/modqueue", topic_id)
 
-	user_id, err := app.getQueryParameterInt(w, r, "user_id")
+	var form topicModeratorForm
+	err := app.decodePostForm(r, &form)
 	if err != nil {
-		app.serverError(w, err)
+		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	user, err := app.users.Get(user_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
+	if form.Role == "" {
+		form.Role = models.RoleModerator
 	}
 
-	err = app.topics.AddModerator(topic_id, user_id, user.Name)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-}
+	form.CheckField(form.UserID > 0, "user_id", "a user ID is required")
+	form.CheckField(PermittedValue(form.Role, models.RoleOwner, models.RoleModerator), "role", "role must be owner or moderator")
 
-func (app *application) topicRemoveModerator(w http.ResponseWriter, r *http.Request) {
-	topic_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.serverError(w, err)
+	if !form.Valid() {
+		for _, message := range form.FieldErrors {
+			app.sessionManager.Put(r.Context(), "flash", message)
+			break
+		}
+		http.Redirect(w, r, queue, http.StatusSeeOther)
 		return
 	}
 
-	user_id, err := app.getQueryParameterInt(w, r, "user_id")
+	user, err := app.users.Get(form.UserID)
 	if err != nil {
-		app.serverError(w, err)
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.sessionManager.Put(r.Context(), "flash", "There is no user with that ID.")
+			http.Redirect(w, r, queue, http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
 		return
 	}
 
-	err = app.topics.RemoveModerator(topic_id, user_id)
+	err = app.topics.AddModerator(topic_id, user.ID, user.Name, form.Role)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
-}
 
-func (app *application) topicSubscribe(w http.ResponseWriter, r *http.Request) {
-	topic_id, err := app.getIDParam(w, r, "id")
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s is now a %s of this topic.", user.Name, form.Role))
+	http.Redirect(w, r, queue, http.StatusSeeOther)
+}
 
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-	if user_id == 0 {
-		app.clientError(w, http.StatusUnauthorized)
-		return
-	}
+// topicRemoveModerator makes a moderator or owner of the topic a member
+// again; it runs behind requireTopicOwner
+func (app *application) topicRemoveModerator(w http.ResponseWriter, r *http.Request) {
+	topic_id := app.topicID(r)
+	queue := fmt.Sprintf("/topics/%d/modqueue", topic_id)
 
-	err = app.topics.Subscribe(topic_id, user_id)
+	var form topicModeratorForm
+	err := app.decodePostForm(r, &form)
 	if err != nil {
-		app.serverError(w, err)
+		app.clientError(w, http.StatusBadRequest)
 		return
 	}
-}
 
-func (app *application) topicUnsubscribe(w http.ResponseWriter, r *http.Request) {
-	topic_id, err := app.getIDParam(w, r, "id")
+	err = app.topics.RemoveModerator(topic_id, form.UserID)
 	if err != nil {
-		app.serverError(w, err)
-		return
-	}
-
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
-	if user_id == 0 {
-		app.clientError(w, http.StatusUnauthorized)
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.sessionManager.Put(r.Context(), "flash", "That user is not a moderator of this topic.")
+			http.Redirect(w, r, queue, http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
 		return
 	}
 
-	err = app.topics.Unsubscribe(topic_id, user_id)
-	if err != nil {
-		app.serverError(w, err)
-		return
-	}
+	app.sessionManager.Put(r.Context(), "flash", "Moderator removed.")
+	http.Redirect(w, r, queue, http.StatusSeeOther)
 }
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// shown by the authenticator app next to the email of the account
+	totpIssuer = "Gorum"
+	totpPeriod = 30 * time.Second
+	// how long the second login step waits for the code after the password
+	twoFactorLoginTTL = 5 * time.Minute
+	totpQRSize        = 200
+)
+
+// session keys of a login waiting for its second step and of an enrollment
+// waiting for its first code
+const (
+	twoFactorUser    = "twoFactorUserID"
+	twoFactorExpires = "twoFactorExpires"
+	totpEnrollment   = "totpURL"
+)
+
+type twoFactorForm struct {
+	Code      string `form:"code"`
+	Validator `form:"-"`
+}
+
+// totpSetup is the authenticator being enrolled, for the user to scan or type
+type totpSetup struct {
+	// otpauth:// URLs are not allowed in links unless they are marked safe
+	URL    template.URL
+	Secret string
+}
+
+// totpStep returns the time step of the code when it is the code of the
+// secret now, or one step before or after for clocks that are a little off,
+// and 0 otherwise
+func totpStep(secret, code string, now time.Time) int64 {
+	opts := totp.ValidateOpts{
+		Period:    uint(totpPeriod.Seconds()),
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+
+	for _, skew := range []time.Duration{0, -totpPeriod, totpPeriod} {
+		at := now.Add(skew)
+		valid, err := totp.ValidateCustom(code, secret, at, opts)
+		if err == nil && valid {
+			return at.Unix() / int64(totpPeriod.Seconds())
+		}
+	}
+	return 0
+}
+
+// checkSecondFactor accepts a code of the authenticator of the user or one of
+// their recovery codes, either can only be used once; recovery reports which
+// one it was
+func (app *application) checkSecondFactor(user_id int, two_factor *models.TwoFactor, code string) (accepted, recovery bool, err error) {
+	code = strings.TrimSpace(code)
+
+	if len(code) == otp.DigitsSix.Length() {
+		step := totpStep(two_factor.Secret, code, time.Now())
+		if step == 0 {
+			return false, false, nil
+		}
+		accepted, err = app.twoFactor.UseStep(user_id, step)
+		return accepted, false, err
+	}
+
+	accepted, err = app.twoFactor.UseRecoveryCode(user_id, models.HashRecoveryCode(code))
+	return accepted, accepted, err
+}
+
+// pendingLogin returns the user who passed the first login step and has not
+// yet entered their code, logins that took too long have to start over
+func (app *application) pendingLogin(r *http.Request) (int, bool) {
+	user_id := app.sessionManager.GetInt(r.Context(), twoFactorUser)
+	if user_id == 0 {
+		return 0, false
+	}
+
+	if time.Now().After(app.sessionManager.GetTime(r.Context(), twoFactorExpires)) {
+		app.sessionManager.Remove(r.Context(), twoFactorUser)
+		app.sessionManager.Remove(r.Context(), twoFactorExpires)
+		return 0, false
+	}
+
+	return user_id, true
+}
+
+func (app *application) userLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.pendingLogin(r); !ok {
+		http.Redirect(w, r, "/users/login", http.StatusSeeOther)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = twoFactorForm{}
+	app.render(w, http.StatusOK, "totp.tmpl", data)
+}
+
+// userLoginTwoFactorPost is the second login step, wrong codes count as
+// failed logins of the account like wrong passwords
+func (app *application) userLoginTwoFactorPost(w http.ResponseWriter, r *http.Request) {
+	user_id, ok := app.pendingLogin(r)
+	if !ok {
+		app.sessionManager.Put(r.Context(), "flash", "Your login expired, please log in again.")
+		http.Redirect(w, r, "/users/login", http.StatusSeeOther)
+		return
+	}
+
+	var form twoFactorForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(NotBlank(form.Code), "code", "code cannot be blank")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "totp.tmpl", data)
+		return
+	}
+
+	two_factor, err := app.twoFactor.Get(user_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	accepted, recovery, err := app.checkSecondFactor(user_id, two_factor, form.Code)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if !accepted {
+		user, err := app.users.Get(user_id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		locked_until, err := app.loginFailed(user.Email)
+		switch {
+		case errors.Is(err, models.ErrInvalidCredentials):
+			form.AddNonFieldError("invalid code")
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, http.StatusUnprocessableEntity, "totp.tmpl", data)
+		case errors.Is(err, models.ErrAccountLocked):
+			app.sessionManager.Remove(r.Context(), twoFactorUser)
+			app.sessionManager.Remove(r.Context(), twoFactorExpires)
+			app.sessionManager.Put(r.Context(), "flash", lockoutMessage(locked_until))
+			http.Redirect(w, r, "/users/login", http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	err = app.users.LoginSucceeded(user_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Remove(r.Context(), twoFactorUser)
+	app.sessionManager.Remove(r.Context(), twoFactorExpires)
+	err = app.logIn(r, user_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if recovery {
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("You logged in with a recovery code, %d are left.", two_factor.RecoveryCodes-1))
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// twoFactorSettings adds the two-factor authentication of the user to the
+// settings page, with the authenticator they are enrolling if there is one
+func (app *application) twoFactorSettings(r *http.Request, data *templateData) error {
+	two_factor, err := app.twoFactor.Get(app.authenticatedUserID(r))
+	if err != nil {
+		return err
+	}
+	data.TwoFactor = two_factor
+
+	url := app.sessionManager.GetString(r.Context(), totpEnrollment)
+	if two_factor.Enabled() || url == "" {
+		return nil
+	}
+
+	key, err := otp.NewKeyFromURL(url)
+	if err != nil {
+		return err
+	}
+
+	data.TOTPSetup = &totpSetup{URL: template.URL(key.URL()), Secret: key.Secret()}
+	return nil
+}
+
+// userTwoFactorSetupPost starts the enrollment of an authenticator, the
+// secret is kept in the session until the user enters a code from it
+func (app *application) userTwoFactorSetupPost(w http.ResponseWriter, r *http.Request) {
+	user, err := app.users.Get(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+		Period:      uint(totpPeriod.Seconds()),
+	})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), totpEnrollment, key.URL())
+	http.Redirect(w, r, "/users/settings#two-factor", http.StatusSeeOther)
+}
+
+// userTwoFactorQR is the QR code of the authenticator being enrolled
+func (app *application) userTwoFactorQR(w http.ResponseWriter, r *http.Request) {
+	url := app.sessionManager.GetString(r.Context(), totpEnrollment)
+	if url == "" {
+		app.notFound(w, r)
+		return
+	}
+
+	key, err := otp.NewKeyFromURL(url)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	img, err := key.Image(totpQRSize, totpQRSize)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	err = png.Encode(w, img)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// userTwoFactorEnablePost turns on two-factor authentication once the user
+// enters a code of the authenticator they enrolled, and shows the recovery
+// codes this one time
+func (app *application) userTwoFactorEnablePost(w http.ResponseWriter, r *http.Request) {
+	form, ok := app.readTwoFactorForm(w, r)
+	if !ok {
+		return
+	}
+
+	url := app.sessionManager.GetString(r.Context(), totpEnrollment)
+	if url == "" {
+		http.Redirect(w, r, "/users/settings", http.StatusSeeOther)
+		return
+	}
+
+	key, err := otp.NewKeyFromURL(url)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	step := totpStep(key.Secret(), strings.TrimSpace(form.Code), time.Now())
+	if !form.Valid() || step == 0 {
+		app.sessionManager.Put(r.Context(), "flash", "The code is not valid, check the time of your device and try again with a new code.")
+		http.Redirect(w, r, "/users/settings#two-factor", http.StatusSeeOther)
+		return
+	}
+
+	codes, hashes, err := models.NewRecoveryCodes()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	user_id := app.authenticatedUserID(r)
+	err = app.twoFactor.Enable(user_id, key.Secret(), step, hashes)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	// sessions and tokens from before only needed the password, they are
+	// ended so the second factor protects every way into the account
+	err = app.destroyOtherSessions(r, user_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.tokens.DeleteAllForUser(user_id, models.ScopeAuthentication)
+	if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Remove(r.Context(), totpEnrollment)
+	app.renderRecoveryCodes(w, r, codes, "Two-factor authentication is on.")
+}
+
+// userTwoFactorCodesPost replaces the recovery codes of the user, for when
+// they run out or lose them
+func (app *application) userTwoFactorCodesPost(w http.ResponseWriter, r *http.Request) {
+	if !app.confirmSecondFactor(w, r) {
+		return
+	}
+
+	codes, hashes, err := models.NewRecoveryCodes()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.twoFactor.ReplaceRecoveryCodes(app.authenticatedUserID(r), hashes)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.renderRecoveryCodes(w, r, codes, "Your old recovery codes no longer work.")
+}
+
+func (app *application) userTwoFactorDisablePost(w http.ResponseWriter, r *http.Request) {
+	if !app.confirmSecondFactor(w, r) {
+		return
+	}
+
+	err := app.twoFactor.Disable(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Two-factor authentication is off.")
+	http.Redirect(w, r, "/users/settings", http.StatusSeeOther)
+}
+
+// confirmSecondFactor checks the code the user entered to change their
+// two-factor authentication, it writes the response and returns false when
+// the code is not accepted
+func (app *application) confirmSecondFactor(w http.ResponseWriter, r *http.Request) bool {
+	form, ok := app.readTwoFactorForm(w, r)
+	if !ok {
+		return false
+	}
+
+	user_id := app.authenticatedUserID(r)
+	two_factor, err := app.twoFactor.Get(user_id)
+	if err != nil {
+		app.serverError(w, err)
+		return false
+	}
+
+	if !two_factor.Enabled() {
+		http.Redirect(w, r, "/users/settings", http.StatusSeeOther)
+		return false
+	}
+
+	accepted := false
+	if form.Valid() {
+		accepted, _, err = app.checkSecondFactor(user_id, two_factor, form.Code)
+		if err != nil {
+			app.serverError(w, err)
+			return false
+		}
+	}
+
+	if !accepted {
+		app.sessionManager.Put(r.Context(), "flash", "The code is not valid.")
+		http.Redirect(w, r, "/users/settings#two-factor", http.StatusSeeOther)
+		return false
+	}
+
+	return true
+}
+
+func (app *application) readTwoFactorForm(w http.ResponseWriter, r *http.Request) (twoFactorForm, bool) {
+	var form twoFactorForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return form, false
+	}
+
+	form.CheckField(NotBlank(form.Code), "code", "code cannot be blank")
+	return form, true
+}
+
+// renderRecoveryCodes shows the settings page with the new recovery codes,
+// they are not kept anywhere so they are not redirected to
+func (app *application) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string, flash string) {
+	prefs, err := app.users.GetEmailPreferences(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Flash = flash
+	data.Form = &userPasswordResetForm{}
+	data.EmailPreferences = prefs
+	data.RecoveryCodes = codes
+
+	err = app.twoFactorSettings(r, data)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.render(w, http.StatusOK, "user_settings.tmpl", data)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// totpCode is the code of the authenticator at the time
+func totpCode(t *testing.T, at time.Time) string {
+	code, err := totp.GenerateCodeCustom(testTOTPSecret, at, totp.ValidateOpts{
+		Period:    uint(totpPeriod.Seconds()),
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTPStep(t *testing.T) {
+	now := time.Unix(1_700_000_010, 0)
+	step := now.Unix() / int64(totpPeriod.Seconds())
+
+	tests := []struct {
+		name string
+		code string
+		want int64
+	}{
+		{"current code", totpCode(t, now), step},
+		{"previous code", totpCode(t, now.Add(-totpPeriod)), step - 1},
+		{"next code", totpCode(t, now.Add(totpPeriod)), step + 1},
+		{"too old", totpCode(t, now.Add(-2*totpPeriod)), 0},
+		{"too early", totpCode(t, now.Add(2*totpPeriod)), 0},
+		{"not a code", "abcdef", 0},
+		{"empty", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := totpStep(testTOTPSecret, tt.code, now); got != tt.want {
+				t.Errorf("got step %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSecondFactor(t *testing.T) {
+	var lastStep int64
+	recoveryCodes := map[string]bool{string(models.HashRecoveryCode("abcd2345-efgh6789")): true}
+
+	app := newTestApplication(t, func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.Contains(query, "UPDATE users SET totp_step"):
+			if step := args[1].(int64); step > lastStep {
+				lastStep = step
+				return fakeResult{affected: 1}, nil
+			}
+			return fakeResult{}, nil
+		case strings.Contains(query, "UPDATE recovery_codes"):
+			hash := string(args[1].([]byte))
+			if recoveryCodes[hash] {
+				recoveryCodes[hash] = false
+				return fakeResult{affected: 1}, nil
+			}
+			return fakeResult{}, nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+	})
+	two_factor := &models.TwoFactor{Secret: testTOTPSecret}
+	code := totpCode(t, time.Now())
+
+	tests := []struct {
+		name         string
+		code         string
+		wantAccepted bool
+		wantRecovery bool
+	}{
+		{"code", " " + code + " ", true, false},
+		{"code used twice", code, false, false},
+		{"wrong code", "000000", false, false},
+		{"recovery code", "ABCD2345 EFGH6789", true, true},
+		{"recovery code used twice", "abcd2345-efgh6789", false, false},
+		{"unknown recovery code", "zzzz2345-efgh6789", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted, recovery, err := app.checkSecondFactor(7, two_factor, tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted != tt.wantAccepted || recovery != tt.wantRecovery {
+				t.Errorf("got accepted %t recovery %t; want %t %t", accepted, recovery, tt.wantAccepted, tt.wantRecovery)
+			}
+		})
+	}
+}
+
+func TestTwoFactorEnableEndsOtherSessions(t *testing.T) {
+	var endedSessions, deletedTokens bool
+	app := newTestApplication(t, func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.Contains(query, "UPDATE users SET totp_secret"),
+			strings.Contains(query, "recovery_codes(user_id, hash)"),
+			strings.Contains(query, "DELETE FROM recovery_codes"):
+			return fakeResult{affected: 1}, nil
+		case strings.Contains(query, "session_generation + 1"):
+			endedSessions = true
+			return row(int64(1)), nil
+		case strings.Contains(query, "DELETE FROM tokens"):
+			deletedTokens = args[1] == models.ScopeAuthentication
+			return fakeResult{affected: 2}, nil
+		case strings.Contains(query, "email_digest FROM users"):
+			return row(int64(7), true, true, "off"), nil
+		case strings.Contains(query, "totp_secret, u.totp_step"):
+			return row(nil, int64(0), int64(models.RecoveryCodeCount)), nil
+		case strings.Contains(query, "count(*)"):
+			return row(int64(0)), nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+	})
+
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.templateCache = templateCache
+
+	key := fmt.Sprintf("otpauth://totp/%s:alice@example.com?issuer=%s&secret=%s", totpIssuer, totpIssuer, testTOTPSecret)
+	cookie := sessionCookie(t, app, map[string]any{authUser: 7, sessionGeneration: 0, totpEnrollment: key})
+
+	handler := app.sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.userTwoFactorEnablePost(w, asUser(r, 7))
+	}))
+
+	form := url.Values{"code": {totpCode(t, time.Now())}}
+	r := httptest.NewRequest(http.MethodPost, "/users/two-factor/enable", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+	}
+	if !endedSessions {
+		t.Error("the other sessions were not ended")
+	}
+	if !deletedTokens {
+		t.Error("the authentication tokens were not deleted")
+	}
+
+	// the session goes on under a new token and the current generation
+	var renewed *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == cookie.Name {
+			renewed = c
+		}
+	}
+	if renewed == nil || renewed.Value == cookie.Value {
+		t.Fatal("the session token was not renewed")
+	}
+
+	// session returns the user and generation of the session of the cookie
+	session := func(cookie *http.Cookie) (user_id, generation int) {
+		handler := app.sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user_id = app.sessionManager.GetInt(r.Context(), authUser)
+			generation = app.sessionManager.GetInt(r.Context(), sessionGeneration)
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return user_id, generation
+	}
+
+	if user_id, _ := session(cookie); user_id != 0 {
+		t.Errorf("the old session token still logs in user %d", user_id)
+	}
+	if user_id, generation := session(renewed); user_id != 7 || generation != 1 {
+		t.Errorf("got user %d generation %d; want user 7 generation 1", user_id, generation)
+	}
+}
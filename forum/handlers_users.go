@@ -26,12 +26,51 @@ type userActivateForm struct {
 	Validator `form:"-"`
 }
 
+type userEmailPreferencesForm struct {
+	Replies   bool   `form:"replies"`
+	Mentions  bool   `form:"mentions"`
+	Digest    string `form:"digest"`
+	Validator `form:"-"`
+}
+
+type unsubscribeForm struct {
+	UserID    int    `form:"user"`
+	List      string `form:"list"`
+	Signature string `form:"sig"`
+	Done      bool   `form:"-"`
+}
+
+type userResendActivationForm struct {
+	Email     string `form:"email"`
+	Validator `form:"-"`
+}
+
 type userPasswordResetForm struct {
+	Current   string `form:"current"`
 	New       string `form:"password"`
 	Confirm   string `form:"confirm"`
 	Validator `form:"-"`
 }
 
+type userForgotPasswordForm struct {
+	Email     string `form:"email"`
+	Validator `form:"-"`
+}
+
+type userNewPasswordForm struct {
+	Token     string `form:"token"`
+	New       string `form:"password"`
+	Confirm   string `form:"confirm"`
+	Validator `form:"-"`
+}
+
+const (
+	activationTTL = 24 * time.Hour
+	// minimum time between two activation emails for the same user
+	activationResendCooldown = 5 * time.Minute
+	passwordResetTTL         = 45 * time.Minute
+)
+
 func (app *application) userGet(w http.ResponseWriter, r *http.Request) {
 	user_id, err := app.getIDParam(w, r, "id")
 	if err != nil {
@@ -46,6 +85,17 @@ func (app *application) userGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the profile offers to message or block the user to everyone else
+	if viewer_id := app.authenticatedUserID(r); viewer_id > 0 && viewer_id != user.ID {
+		blocked, err := app.messages.HasBlocked(viewer_id, user.ID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		data.Blocked = blocked
+		data.Form = messageForm{}
+	}
+
 	data.User = user
 	app.render(w, http.StatusOK, "user.tmpl", data)
 }
@@ -62,7 +112,7 @@ func (app *application) userList(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) userCommentSaved(w http.ResponseWriter, r *http.Request) {
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+	user_id := app.authenticatedUserID(r)
 	comments, err := app.users.GetSavedComments(user_id)
 	if err != nil {
 		switch {
@@ -80,7 +130,7 @@ func (app *application) userCommentSaved(w http.ResponseWriter, r *http.Request)
 }
 
 func (app *application) userPostSaved(w http.ResponseWriter, r *http.Request) {
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+	user_id := app.authenticatedUserID(r)
 	posts, err := app.users.GetSavedPosts(user_id)
 	if err != nil {
 		switch {
@@ -98,7 +148,7 @@ func (app *application) userPostSaved(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) userCommentLiked(w http.ResponseWriter, r *http.Request) {
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+	user_id := app.authenticatedUserID(r)
 	comments, err := app.users.GetLikedComments(user_id)
 	if err != nil {
 		switch {
@@ -116,7 +166,7 @@ func (app *application) userCommentLiked(w http.ResponseWriter, r *http.Request)
 }
 
 func (app *application) userPostLiked(w http.ResponseWriter, r *http.Request) {
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+	user_id := app.authenticatedUserID(r)
 	posts, err := app.users.GetLikedPosts(user_id)
 	if err != nil {
 		switch {
@@ -159,17 +209,27 @@ func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user_id, err := app.users.Authenticate(form.Email, form.Password)
+	user_id, locked_until, err := app.login(form.Email, form.Password)
 	if err != nil {
-		if errors.Is(err, models.ErrInvalidCredentials) {
+		switch {
+		case errors.Is(err, models.ErrInvalidCredentials):
 			form.AddNonFieldError("invalid email or password")
-			data := app.newTemplateData(r)
-			data.Form = form
-			app.render(w, http.StatusUnprocessableEntity, "login.tmpl", data)
-			return
-		} else {
+		case errors.Is(err, models.ErrAccountLocked):
+			form.AddNonFieldError(lockoutMessage(locked_until))
+		default:
 			app.serverError(w, err)
+			return
 		}
+
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "login.tmpl", data)
+		return
+	}
+
+	two_factor, err := app.twoFactor.Get(user_id)
+	if err != nil {
+		app.serverError(w, err)
 		return
 	}
 
@@ -179,7 +239,26 @@ func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	app.sessionManager.Put(r.Context(), "authenticatedUserID", user_id)
+	// the user is only logged in once the second step accepts their code
+	if two_factor.Enabled() {
+		app.sessionManager.Put(r.Context(), twoFactorUser, user_id)
+		app.sessionManager.Put(r.Context(), twoFactorExpires, time.Now().Add(twoFactorLoginTTL))
+		http.Redirect(w, r, "/users/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	err = app.users.LoginSucceeded(user_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.logIn(r, user_id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -191,6 +270,7 @@ func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.sessionManager.Remove(r.Context(), sessionGeneration)
 	app.sessionManager.Put(r.Context(), "flash", "You have logged out.")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -249,38 +329,52 @@ func (app *application) userCreatePost(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	token, err := app.tokens.New(user_id, time.Hour*24, models.ScopeActivation)
+	err = app.sendActivationEmail(user_id, form.Email)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	err = app.tokens.Insert(token)
+	app.sessionManager.Put(r.Context(), "flash", "User was successfully created!")
+	http.Redirect(w, r, "/users/activate", http.StatusSeeOther)
+}
+
+// sendActivationEmail issues a new activation token and mails the link to
+// the user in the background
+func (app *application) sendActivationEmail(user_id int, email string) error {
+	token, err := app.tokens.New(user_id, activationTTL, models.ScopeActivation)
 	if err != nil {
-		app.serverError(w, err)
-		return
+		return err
 	}
 
 	app.background(func() {
-		data := map[string]interface{}{
+		data := map[string]any{
 			"activationToken": token.Plaintext,
+			"activationURL":   app.config.baseURL + "/users/activate?token=" + token.Plaintext,
 			"userID":          user_id,
 		}
 
-		err := app.mailer.Send(app.config.smtp.sender, form.Email, "register_email.tmpl", data)
+		err := app.mailer.Send(app.config.smtp.sender, email, "register_email.tmpl", data)
 		if err != nil {
 			app.errorLog.Printf("Error sending mail: %v", err)
 		}
 	})
 
-	app.sessionManager.Put(r.Context(), "flash", "User was successfully created!")
-	http.Redirect(w, r, "/users/activate", http.StatusSeeOther)
+	return nil
 }
 
+// userActivate shows the form to paste the token, or activates the account
+// right away when the link from the email carries the token
 func (app *application) userActivate(w http.ResponseWriter, r *http.Request) {
-	data := app.newTemplateData(r)
-	data.Form = &userActivateForm{}
-	app.render(w, http.StatusOK, "activate.tmpl", data)
+	form := userActivateForm{Token: r.URL.Query().Get("token")}
+	if form.Token == "" {
+		data := app.newTemplateData(r)
+		data.Form = &form
+		app.render(w, http.StatusOK, "activate.tmpl", data)
+		return
+	}
+
+	app.activateUser(w, r, form)
 }
 
 func (app *application) userActivatePost(w http.ResponseWriter, r *http.Request) {
@@ -292,6 +386,10 @@ func (app *application) userActivatePost(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	app.activateUser(w, r, form)
+}
+
+func (app *application) activateUser(w http.ResponseWriter, r *http.Request, form userActivateForm) {
 	form.CheckField(NotBlank(form.Token), "token", "token cannot be blank")
 	form.CheckField(len(form.Token) == 52, "token", "token length must be 52 bytes")
 
@@ -306,7 +404,7 @@ func (app *application) userActivatePost(w http.ResponseWriter, r *http.Request)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrNoRecordFound):
-			form.AddFieldError("token", "invalid token")
+			form.AddFieldError("token", "invalid or expired token, you can request a new one below")
 			data := app.newTemplateData(r)
 			data.Form = form
 			app.render(w, http.StatusUnprocessableEntity, "activate.tmpl", data)
@@ -330,13 +428,88 @@ func (app *application) userActivatePost(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	app.sessionManager.Put(r.Context(), "authenticatedUserID", user.ID)
+	err = app.logIn(r, user.ID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	app.sessionManager.Put(r.Context(), "flash", "Your account has been successfully activated!")
 	http.Redirect(w, r, "/users/login", http.StatusSeeOther)
 }
 
+// userActivateResendPost replaces the activation token of a user that is not
+// activated yet and emails it again, at most once per cooldown period
+func (app *application) userActivateResendPost(w http.ResponseWriter, r *http.Request) {
+	var form userResendActivationForm
+
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(NotBlank(form.Email), "email", "email cannot be blank")
+	form.CheckField(Matches(form.Email, EmailRegex), "email", "must be a valid email")
+
+	if !form.Valid() {
+		app.sessionManager.Put(r.Context(), "flash", form.FieldErrors["email"])
+		http.Redirect(w, r, "/users/activate", http.StatusSeeOther)
+		return
+	}
+
+	// like the forgot password form, the answer does not reveal whether the
+	// email belongs to an account
+	flash := "If that email belongs to an account waiting for activation, we sent it a new activation link."
+
+	user, err := app.users.GetByEmail(form.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.sessionManager.Put(r.Context(), "flash", flash)
+			http.Redirect(w, r, "/users/activate", http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		app.sessionManager.Put(r.Context(), "flash", flash)
+		http.Redirect(w, r, "/users/activate", http.StatusSeeOther)
+		return
+	}
+
+	last, err := app.tokens.LastIssued(user.ID, models.ScopeActivation)
+	if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+		app.serverError(w, err)
+		return
+	}
+
+	if err == nil && time.Since(last) < activationResendCooldown {
+		app.sessionManager.Put(r.Context(), "flash", flash)
+		http.Redirect(w, r, "/users/activate", http.StatusSeeOther)
+		return
+	}
+
+	err = app.tokens.DeleteAllForUser(user.ID, models.ScopeActivation)
+	if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.sendActivationEmail(user.ID, user.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, "/users/activate", http.StatusSeeOther)
+}
+
 func (app *application) userDelete(w http.ResponseWriter, r *http.Request) {
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+	user_id := app.authenticatedUserID(r)
 
 	if user_id == 1 {
 		app.infoLog.Println("cannot delete admin user")
@@ -353,11 +526,127 @@ func (app *application) userDelete(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) userSettings(w http.ResponseWriter, r *http.Request) {
+	prefs, err := app.users.GetEmailPreferences(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	data := app.newTemplateData(r)
 	data.Form = &userPasswordResetForm{}
+	data.EmailPreferences = prefs
+
+	err = app.twoFactorSettings(r, data)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	app.render(w, http.StatusOK, "user_settings.tmpl", data)
 }
 
+func (app *application) userEmailPreferencesPost(w http.ResponseWriter, r *http.Request) {
+	var form userEmailPreferencesForm
+
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if !PermittedValue(form.Digest, models.DigestFrequencies...) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	prefs := &models.EmailPreferences{
+		UserID:   app.authenticatedUserID(r),
+		Replies:  form.Replies,
+		Mentions: form.Mentions,
+		Digest:   form.Digest,
+	}
+
+	err = app.users.UpdateEmailPreferences(prefs)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your email preferences have been saved.")
+	http.Redirect(w, r, "/users/settings", http.StatusSeeOther)
+}
+
+// decodeUnsubscribeForm reads the signed parameters of an unsubscribe link,
+// they are always in the query string so one-click POSTs from mail clients
+// work the same as the confirmation form
+func (app *application) decodeUnsubscribeForm(r *http.Request, form *unsubscribeForm) bool {
+	err := app.formDecoder.Decode(form, r.URL.Query())
+	if err != nil {
+		return false
+	}
+
+	if !PermittedValue(form.List, listReplies, listMentions, listDigest, listAll) {
+		return false
+	}
+
+	return app.validUnsubscribeSignature(form.UserID, form.List, form.Signature)
+}
+
+// unsubscribe asks for confirmation instead of unsubscribing right away
+// because link scanners follow every link in an email
+func (app *application) unsubscribe(w http.ResponseWriter, r *http.Request) {
+	var form unsubscribeForm
+	if !app.decodeUnsubscribeForm(r, &form) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = form
+	app.render(w, http.StatusOK, "unsubscribe.tmpl", data)
+}
+
+func (app *application) unsubscribePost(w http.ResponseWriter, r *http.Request) {
+	var form unsubscribeForm
+	if !app.decodeUnsubscribeForm(r, &form) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	prefs, err := app.users.GetEmailPreferences(form.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecordFound):
+			app.clientError(w, http.StatusBadRequest)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	switch form.List {
+	case listReplies:
+		prefs.Replies = false
+	case listMentions:
+		prefs.Mentions = false
+	case listDigest:
+		prefs.Digest = models.DigestOff
+	case listAll:
+		prefs.Replies, prefs.Mentions, prefs.Digest = false, false, models.DigestOff
+	}
+
+	err = app.users.UpdateEmailPreferences(prefs)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	form.Done = true
+	data := app.newTemplateData(r)
+	data.Form = form
+	app.render(w, http.StatusOK, "unsubscribe.tmpl", data)
+}
+
 func (app *application) userPasswordResetPost(w http.ResponseWriter, r *http.Request) {
 	var form userPasswordResetForm
 
@@ -367,26 +656,214 @@ func (app *application) userPasswordResetPost(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	form.CheckField(NotBlank(form.Current), "current", "current password cannot be blank")
 	form.CheckField(NotBlank(form.New), "password", "new password cannot be blank")
 	form.CheckField(MinChars(form.New, 8), "password", "new password must be at least 8 bytes")
+	form.CheckField(MaxChars(form.New, 72), "password", "new password cannot be longer than 72 bytes")
 	form.CheckField(NotBlank(form.Confirm), "confirm", "confirmation password cannot be blank")
 
 	if form.New != form.Confirm {
 		form.AddNonFieldError("passwords do not match")
 	}
 
-	user_id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+	user_id := app.authenticatedUserID(r)
 	user, err := app.users.Get(user_id)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	err = app.users.UpdatePassword(user)
+	if form.Valid() {
+		matches, err := user.Password.Matches(form.Current)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		form.CheckField(matches, "current", "current password is incorrect")
+	}
+
+	if !form.Valid() {
+		app.renderSettings(w, r, http.StatusUnprocessableEntity, form)
+		return
+	}
+
+	if !app.setPassword(w, r, user, form.New) {
+		return
+	}
+
+	// the current session stays logged in under a new token
+	err = app.sessionManager.RenewToken(r.Context())
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
+	app.sessionManager.Put(r.Context(), "flash", "Your password has been changed.")
 	http.Redirect(w, r, "/users/settings", http.StatusSeeOther)
 }
+
+// renderSettings renders the settings page with the password form
+func (app *application) renderSettings(w http.ResponseWriter, r *http.Request, status int, form userPasswordResetForm) {
+	prefs, err := app.users.GetEmailPreferences(app.authenticatedUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	form.Current, form.New, form.Confirm = "", "", ""
+
+	data := app.newTemplateData(r)
+	data.Form = form
+	data.EmailPreferences = prefs
+
+	err = app.twoFactorSettings(r, data)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.render(w, status, "user_settings.tmpl", data)
+}
+
+// setPassword changes the password of the user, which deletes all of their
+// tokens, and logs them out of every other session; it writes an error
+// response and returns false on failure
+func (app *application) setPassword(w http.ResponseWriter, r *http.Request, user *models.User, password string) bool {
+	err := user.Password.Set(password)
+	if err != nil {
+		app.serverError(w, err)
+		return false
+	}
+
+	err = app.users.UpdatePassword(user)
+	if err != nil {
+		app.serverError(w, err)
+		return false
+	}
+
+	err = app.destroyOtherSessions(r, user.ID)
+	if err != nil {
+		app.serverError(w, err)
+		return false
+	}
+
+	return true
+}
+
+func (app *application) userForgotPassword(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = &userForgotPasswordForm{}
+	app.render(w, http.StatusOK, "password_forgot.tmpl", data)
+}
+
+func (app *application) userForgotPasswordPost(w http.ResponseWriter, r *http.Request) {
+	var form userForgotPasswordForm
+
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(NotBlank(form.Email), "email", "email cannot be blank")
+	form.CheckField(Matches(form.Email, EmailRegex), "email", "must be a valid email")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "password_forgot.tmpl", data)
+		return
+	}
+
+	// the response is the same whether or not the email belongs to a user,
+	// so the form cannot be used to find out who has an account
+	user, err := app.users.GetByEmail(form.Email)
+	switch {
+	case err == nil:
+		err = app.tokens.DeleteAllForUser(user.ID, models.ScopePasswordReset)
+		if err != nil && !errors.Is(err, models.ErrNoRecordFound) {
+			app.serverError(w, err)
+			return
+		}
+
+		token, err := app.tokens.New(user.ID, passwordResetTTL, models.ScopePasswordReset)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]any{
+				"username": user.Name,
+				"link":     app.config.baseURL + "/users/password/reset?token=" + token.Plaintext,
+				"ttl":      "45 minutes",
+			}
+
+			err := app.mailer.Send(app.config.smtp.sender, user.Email, "password_reset_email.tmpl", data)
+			if err != nil {
+				app.errorLog.Printf("Error sending mail: %v", err)
+			}
+		})
+	case !errors.Is(err, models.ErrNoRecordFound):
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "If an account exists for that email, we sent it a link to reset the password.")
+	http.Redirect(w, r, "/users/login", http.StatusSeeOther)
+}
+
+func (app *application) userNewPassword(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = &userNewPasswordForm{Token: r.URL.Query().Get("token")}
+	app.render(w, http.StatusOK, "password_reset.tmpl", data)
+}
+
+func (app *application) userNewPasswordPost(w http.ResponseWriter, r *http.Request) {
+	var form userNewPasswordForm
+
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(len(form.Token) == 52, "token", "the link is invalid, please request a new one")
+	form.CheckField(NotBlank(form.New), "password", "new password cannot be blank")
+	form.CheckField(MinChars(form.New, 8), "password", "new password must be at least 8 bytes")
+	form.CheckField(MaxChars(form.New, 72), "password", "new password cannot be longer than 72 bytes")
+	form.CheckField(NotBlank(form.Confirm), "confirm", "confirmation password cannot be blank")
+
+	if form.New != form.Confirm {
+		form.AddNonFieldError("passwords do not match")
+	}
+
+	var user *models.User
+	if form.Valid() {
+		user, err = app.users.GetByToken(form.Token, models.ScopePasswordReset)
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrNoRecordFound):
+				form.AddFieldError("token", "the link is invalid or has expired, please request a new one")
+			default:
+				app.serverError(w, err)
+				return
+			}
+		}
+	}
+
+	if !form.Valid() {
+		form.New, form.Confirm = "", ""
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "password_reset.tmpl", data)
+		return
+	}
+
+	if !app.setPassword(w, r, user, form.New) {
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your password has been reset, please log in.")
+	http.Redirect(w, r, "/users/login", http.StatusSeeOther)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/groth00/forum/internal/models"
+)
+
+const (
+	// emails claimed from the database per query
+	emailBatchSize = 100
+	// posts listed in a digest
+	digestSize = 10
+	// characters of a comment or post quoted in a notification email
+	excerptLength = 300
+	// how often the rate limit buckets that are full again are forgotten
+	rateLimitCleanupInterval = 10 * time.Minute
+)
+
+// mailing lists a user can unsubscribe from with the link in an email
+const (
+	listReplies  = "replies"
+	listMentions = "mentions"
+	listDigest   = "digest"
+	listAll      = "all"
+)
+
+// refreshPostScores periodically recomputes the scores behind the hot and
+// rising sorts until ctx is cancelled by the shutdown
+func (app *application) refreshPostScores(ctx context.Context) {
+	ticker := time.NewTicker(app.config.jobs.scoreInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := app.posts.RefreshScores(); err != nil {
+			app.errorLog.Println(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeDeleted periodically erases the text of the posts and comments that
+// were deleted longer than the retention period ago, until ctx is cancelled
+// by the shutdown
+func (app *application) purgeDeleted(ctx context.Context) {
+	ticker := time.NewTicker(app.config.jobs.purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		before := time.Now().Add(-app.config.jobs.purgeRetention)
+
+		if keys, err := app.posts.PurgeLinkPreviews(before); err != nil {
+			app.errorLog.Println(err)
+		} else {
+			for _, key := range keys {
+				if err := app.storage.Delete(ctx, key); err != nil {
+					app.errorLog.Println(err)
+				}
+			}
+		}
+
+		if n, err := app.posts.PurgeDeleted(before); err != nil {
+			app.errorLog.Println(err)
+		} else if n > 0 {
+			app.infoLog.Printf("Purged %d deleted posts", n)
+		}
+
+		if n, err := app.comments.PurgeDeleted(before); err != nil {
+			app.errorLog.Println(err)
+		} else if n > 0 {
+			app.infoLog.Printf("Purged %d deleted comments", n)
+		}
+
+		if keys, err := app.attachments.PurgeDeleted(before); err != nil {
+			app.errorLog.Println(err)
+		} else {
+			for _, key := range keys {
+				if err := app.storage.Delete(ctx, key); err != nil {
+					app.errorLog.Println(err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanupRateLimits periodically forgets the buckets that are full again until
+// ctx is cancelled by the shutdown
+func (app *application) cleanupRateLimits(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := app.limiter.Cleanup(ctx, time.Now()); err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+	}
+}
+
+// sendEmails periodically emails the notifications and digests users asked
+// for until ctx is cancelled by the shutdown
+func (app *application) sendEmails(ctx context.Context) {
+	ticker := time.NewTicker(app.config.jobs.emailInterval)
+	defer ticker.Stop()
+
+	for {
+		app.sendNotificationEmails(ctx)
+		app.sendDigests(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *application) sendNotificationEmails(ctx context.Context) {
+	for ctx.Err() == nil {
+		emails, err := app.notifications.ClaimEmails(emailBatchSize)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
+		for _, email := range emails {
+			// claimed anyway so opted out notifications are not looked at again
+			if !email.Send {
+				continue
+			}
+
+			templateFile, list := "reply_email.tmpl", listReplies
+			if email.Kind == models.NotifyMention {
+				templateFile, list = "mention_email.tmpl", listMentions
+			}
+
+			link := fmt.Sprintf("%s/posts/%d", app.config.baseURL, email.PostID)
+			if email.CommentID > 0 {
+				link = fmt.Sprintf("%s/comments/%d", app.config.baseURL, email.CommentID)
+			}
+
+			unsubscribe := app.unsubscribeURL(email.UserID, list)
+			data := map[string]any{
+				"username":       email.Username,
+				"actorName":      email.ActorName,
+				"postTitle":      email.PostTitle,
+				"toComment":      email.Kind == models.NotifyCommentReply,
+				"excerpt":        excerpt(email.Excerpt),
+				"link":           link,
+				"unsubscribeURL": unsubscribe,
+			}
+
+			err := app.mailer.SendWithUnsubscribe(app.config.smtp.sender, email.Email, templateFile, unsubscribe, data)
+			if err != nil {
+				app.errorLog.Printf("Error sending mail: %v", err)
+			}
+		}
+
+		if len(emails) < emailBatchSize {
+			return
+		}
+	}
+}
+
+func (app *application) sendDigests(ctx context.Context) {
+	for ctx.Err() == nil {
+		recipients, err := app.users.ClaimDigests(emailBatchSize)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
+		for _, recipient := range recipients {
+			// a digest never covers more than a week
+			since := recipient.Since
+			if weekAgo := time.Now().AddDate(0, 0, -7); since.Before(weekAgo) {
+				since = weekAgo
+			}
+
+			posts, err := app.posts.Digest(recipient.UserID, since, digestSize)
+			if err != nil {
+				app.errorLog.Println(err)
+				continue
+			}
+
+			// nothing happened, skip rather than send an empty email
+			if len(posts) == 0 {
+				continue
+			}
+
+			unsubscribe := app.unsubscribeURL(recipient.UserID, listDigest)
+			data := map[string]any{
+				"username":       recipient.Name,
+				"period":         recipient.Digest,
+				"posts":          posts,
+				"baseURL":        app.config.baseURL,
+				"unsubscribeURL": unsubscribe,
+			}
+
+			err = app.mailer.SendWithUnsubscribe(app.config.smtp.sender, recipient.Email, "digest_email.tmpl", unsubscribe, data)
+			if err != nil {
+				app.errorLog.Printf("Error sending mail: %v", err)
+			}
+		}
+
+		if len(recipients) < emailBatchSize {
+			return
+		}
+	}
+}
+
+// excerpt shortens the content quoted in notification emails
+func excerpt(content string) string {
+	if utf8.RuneCountInString(content) <= excerptLength {
+		return content
+	}
+	return string([]rune(content)[:excerptLength]) + "..."
+}
+
+func (app *application) unsubscribeSignature(user_id int, list string) string {
+	mac := hmac.New(sha256.New, app.config.secretKey)
+	fmt.Fprintf(mac, "unsubscribe:%d:%s", user_id, list)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// unsubscribeURL returns the signed link that turns off the given list for a
+// user without requiring them to log in
+func (app *application) unsubscribeURL(user_id int, list string) string {
+	qs := url.Values{}
+	qs.Set("user", strconv.Itoa(user_id))
+	qs.Set("list", list)
+	qs.Set("sig", app.unsubscribeSignature(user_id, list))
+	return app.config.baseURL + "/unsubscribe?" + qs.Encode()
+}
+
+func (app *application) validUnsubscribeSignature(user_id int, list, signature string) bool {
+	expected := app.unsubscribeSignature(user_id, list)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/groth00/forum/internal/models"
+	"golang.org/x/net/html"
+)
+
+const (
+	// the whole fetch of a page and its image
+	linkPreviewTimeout = 15 * time.Second
+	// only the head of the page is parsed, which is well within this
+	linkPreviewMaxPage  = 1 << 20
+	linkPreviewMaxImage = 5 << 20
+)
+
+var errForbiddenAddress = errors.New("link resolves to a forbidden address")
+
+// linkClient fetches the pages of link posts; it refuses to connect to
+// private, loopback and other non-public addresses, which is checked on the
+// resolved address of every connection so redirects and DNS tricks cannot
+// reach the internal network
+var linkClient = &http.Client{
+	Timeout: linkPreviewTimeout,
+	Transport: &http.Transport{
+		// a proxy would make the dialed address meaningless
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: guardAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// guardAddress is the net.Dialer Control hook of linkClient
+func guardAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+
+	if !publicAddress(ip) {
+		return errForbiddenAddress
+	}
+	return nil
+}
+
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// address ranges that are not reachable on the internet and not covered by
+// the netip.Addr predicates
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 can map to private IPv4 addresses
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// validLink reports whether the URL of a link post is an absolute http or
+// https URL; whether it can be fetched is only known in the background
+func validLink(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil
+}
+
+// fetchLinkPreview runs in the background after a link post is created, it
+// reads the OpenGraph metadata of the page and keeps a thumbnail of its image.
+// Pages that cannot be fetched get no preview, the post only shows its URL.
+func (app *application) fetchLinkPreview(post_id int, link string) {
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+	defer cancel()
+
+	page, err := url.Parse(link)
+	if err != nil {
+		return
+	}
+
+	preview, image_url, err := fetchOpenGraph(ctx, page)
+	if err != nil {
+		app.infoLog.Printf("no preview for post %d: %v", post_id, err)
+		return
+	}
+
+	if image_url != "" {
+		key, err := app.fetchPreviewImage(ctx, post_id, image_url)
+		if err != nil {
+			app.infoLog.Printf("no preview image for post %d: %v", post_id, err)
+		}
+		preview.ImageKey = key
+	}
+
+	err = app.posts.SetLinkPreview(post_id, preview)
+	if err != nil {
+		app.errorLog.Println(err)
+		if preview.ImageKey != "" {
+			_ = app.storage.Delete(context.Background(), preview.ImageKey)
+		}
+	}
+}
+
+func linkGet(ctx context.Context, target, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "forum-link-preview/1.0")
+
+	resp, err := linkClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return resp, nil
+}
+
+// fetchOpenGraph returns the metadata of the page and the absolute URL of its
+// og:image, falling back to the title and description of the page
+func fetchOpenGraph(ctx context.Context, page *url.URL) (*models.LinkPreview, string, error) {
+	resp, err := linkGet(ctx, page.String(), "text/html")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	media_type, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if media_type != "text/html" && media_type != "application/xhtml+xml" {
+		return nil, "", fmt.Errorf("unsupported content type %q", media_type)
+	}
+
+	meta := map[string]string{}
+	var title string
+
+	tokenizer := html.NewTokenizer(io.LimitReader(resp.Body, linkPreviewMaxPage))
+	in_title := false
+	for done := false; !done; {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			done = true
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "meta":
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(attr.Val)
+					case "content":
+						content = attr.Val
+					}
+				}
+				if _, ok := meta[key]; key != "" && !ok {
+					meta[key] = content
+				}
+			case "title":
+				in_title = title == ""
+			case "body":
+				done = true
+			}
+		case html.TextToken:
+			if in_title {
+				title = string(tokenizer.Text())
+				in_title = false
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "head" {
+				done = true
+			}
+		}
+	}
+
+	preview := &models.LinkPreview{
+		Title:       clip(firstNonBlank(meta["og:title"], meta["twitter:title"], title), 256),
+		Description: clip(firstNonBlank(meta["og:description"], meta["twitter:description"], meta["description"]), 1024),
+		SiteName:    clip(firstNonBlank(meta["og:site_name"], page.Hostname()), 128),
+	}
+	if preview.Title == "" && preview.Description == "" {
+		return nil, "", errors.New("page has no title or description")
+	}
+
+	var image_url string
+	if raw := firstNonBlank(meta["og:image"], meta["og:image:url"], meta["twitter:image"]); raw != "" {
+		if u, err := resp.Request.URL.Parse(raw); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			image_url = u.String()
+		}
+	}
+
+	return preview, image_url, nil
+}
+
+// fetchPreviewImage stores a thumbnail of the image of the page
+func (app *application) fetchPreviewImage(ctx context.Context, post_id int, image_url string) (string, error) {
+	resp, err := linkGet(ctx, image_url, "image/*")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, linkPreviewMaxImage+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > linkPreviewMaxImage {
+		return "", errAttachmentTooLarge
+	}
+
+	content_type := http.DetectContentType(data)
+	if !strings.HasPrefix(content_type, "image/") {
+		return "", errAttachmentType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width*config.Height > maxImagePixels {
+		return "", errAttachmentImage
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", errAttachmentImage
+	}
+
+	// previews are always jpegs, there is no need to keep their type around
+	thumbnail, err := makeThumbnail(img, "image/jpeg")
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("previews/%d.jpg", post_id)
+	err = app.storage.Put(ctx, key, bytes.NewReader(thumbnail), int64(len(thumbnail)), "image/jpeg")
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func firstNonBlank(values ...string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// clip cuts s down to n characters
+func clip(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+	}
+
+	for _, tt := range tests {
+		if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddress(%s) = %t; want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestGuardAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    error
+	}{
+		{"93.184.216.34:443", nil},
+		{"127.0.0.1:80", errForbiddenAddress},
+		{"[::1]:80", errForbiddenAddress},
+		{"[::ffff:192.168.0.1]:80", errForbiddenAddress},
+	}
+
+	for _, tt := range tests {
+		if err := guardAddress("tcp", tt.address, nil); !errors.Is(err, tt.want) {
+			t.Errorf("guardAddress(%s) = %v; want %v", tt.address, err, tt.want)
+		}
+	}
+}
+
+func TestLinkClientRefusesLoopback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the link client reached a loopback server")
+	}))
+	defer ts.Close()
+
+	_, err := linkGet(context.Background(), ts.URL, "text/html")
+	if !errors.Is(err, errForbiddenAddress) {
+		t.Errorf("got error %v; want %v", err, errForbiddenAddress)
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -22,6 +25,8 @@ import (
 	"github.com/go-playground/form/v4"
 	"github.com/groth00/forum/internal/mailer"
 	"github.com/groth00/forum/internal/models"
+	"github.com/groth00/forum/internal/ratelimit"
+	"github.com/groth00/forum/internal/storage"
 	"github.com/joho/godotenv"
 )
 
@@ -44,6 +49,42 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	jobs struct {
+		scoreInterval time.Duration
+		emailInterval time.Duration
+		purgeInterval time.Duration
+		// how long deleted posts and comments keep their text for moderators
+		purgeRetention time.Duration
+	}
+	uploads struct {
+		// local or s3, the S3 bucket is configured from the environment
+		backend  string
+		dir      string
+		maxSize  int64
+		maxFiles int
+	}
+	s3 struct {
+		endpoint  string
+		region    string
+		bucket    string
+		accessKey string
+		secretKey string
+	}
+	events struct {
+		// share live updates with the other instances through LISTEN/NOTIFY
+		notify bool
+	}
+	// memory or postgres, which shares the rate limits between instances
+	limiter string
+	// reverse proxies whose X-Forwarded-For header is believed, without any
+	// the rate limits are keyed on the address of the connection
+	trustedProxies []*net.IPNet
+	// absolute URL of the site, used for links in emails
+	baseURL string
+	// signs the unsubscribe links in emails
+	secretKey []byte
+	// encrypts the TOTP secrets of the users, 32 bytes given in hex
+	totpKey []byte
 }
 
 type application struct {
@@ -54,6 +95,19 @@ type application struct {
 	posts          *models.PostModel
 	comments       *models.CommentModel
 	tokens         *models.TokenModel
+	search         *models.SearchModel
+	notifications  *models.NotificationModel
+	moderation     *models.ModerationModel
+	bans           *models.BanModel
+	attachments    *models.AttachmentModel
+	polls          *models.PollModel
+	messages       *models.MessageModel
+	twoFactor      *models.TwoFactorModel
+	settings       *models.SettingModel
+	events         *eventHub
+	storage        storage.Storage
+	limiter        ratelimit.Limiter
+	markdown       *markdownRenderer
 	templateCache  map[string]*template.Template
 	formDecoder    *form.Decoder
 	sessionManager *scs.SessionManager
@@ -71,10 +125,29 @@ func main() {
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "maximum open DB connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "maximum idle DB connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "max idle time before closing connections")
+	flag.DurationVar(&cfg.jobs.scoreInterval, "score-interval", 5*time.Minute, "how often the hot and rising scores of posts are recomputed")
+	flag.DurationVar(&cfg.jobs.emailInterval, "email-interval", time.Minute, "how often notification emails and digests are sent")
+	flag.DurationVar(&cfg.jobs.purgeInterval, "purge-interval", time.Hour, "how often the text of old deleted posts and comments is erased")
+	flag.DurationVar(&cfg.jobs.purgeRetention, "purge-retention", 30*24*time.Hour, "how long deleted posts and comments are kept before their text is erased")
+	flag.StringVar(&cfg.uploads.backend, "storage", "local", "where attachments are stored (local|s3)")
+	flag.StringVar(&cfg.uploads.dir, "storage-dir", "./uploads", "directory of the local attachment storage")
+	flag.Int64Var(&cfg.uploads.maxSize, "upload-max-size", 5<<20, "maximum size of an attachment in bytes")
+	flag.IntVar(&cfg.uploads.maxFiles, "upload-max-files", 4, "maximum number of attachments of a post or comment")
+	flag.BoolVar(&cfg.events.notify, "events-notify", false, "fan out live updates to every instance through PostgreSQL LISTEN/NOTIFY")
+	flag.StringVar(&cfg.limiter, "limiter", "memory", "where the rate limits are kept (memory|postgres)")
+	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:4000", "absolute URL of the site used in emails")
 	flag.Func("cors-trusted-origins", "trusted origins, space separated", func(s string) error {
 		cfg.cors.trustedOrigins = append(cfg.cors.trustedOrigins, strings.Fields(s)...)
 		return nil
 	})
+	flag.Func("trusted-proxies", "addresses or CIDR ranges of the reverse proxies in front of the server, space separated", func(s string) error {
+		proxies, err := parseTrustedProxies(s)
+		if err != nil {
+			return err
+		}
+		cfg.trustedProxies = append(cfg.trustedProxies, proxies...)
+		return nil
+	})
 	flag.Parse()
 
 	_ = godotenv.Load(".env")
@@ -83,10 +156,39 @@ func main() {
 	cfg.smtp.username = os.Getenv("SMTP_USERNAME")
 	cfg.smtp.password = os.Getenv("SMTP_PASSWORD")
 	cfg.smtp.sender = os.Getenv("SMTP_SENDER")
+	cfg.secretKey = []byte(os.Getenv("SECRET_KEY"))
+	cfg.s3.endpoint = os.Getenv("S3_ENDPOINT")
+	cfg.s3.region = os.Getenv("S3_REGION")
+	cfg.s3.bucket = os.Getenv("S3_BUCKET")
+	cfg.s3.accessKey = os.Getenv("S3_ACCESS_KEY")
+	cfg.s3.secretKey = os.Getenv("S3_SECRET_KEY")
+	totpKey := os.Getenv("TOTP_KEY")
 
 	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 
+	if len(cfg.secretKey) == 0 {
+		errorLog.Println("SECRET_KEY is not set, using a random key; links in emails stop working after a restart")
+		cfg.secretKey = make([]byte, 32)
+		if _, err := rand.Read(cfg.secretKey); err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	if totpKey == "" {
+		errorLog.Println("TOTP_KEY is not set, using a random key; users with two-factor authentication cannot log in after a restart")
+		cfg.totpKey = make([]byte, 32)
+		if _, err := rand.Read(cfg.totpKey); err != nil {
+			errorLog.Fatal(err)
+		}
+	} else {
+		key, err := hex.DecodeString(totpKey)
+		if err != nil || len(key) != 32 {
+			errorLog.Fatal("TOTP_KEY must be 32 bytes in hex, generate one with: openssl rand -hex 32")
+		}
+		cfg.totpKey = key
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		log.Fatal(err)
@@ -110,20 +212,51 @@ func main() {
 		errorLog.Fatal(err)
 	}
 
+	store, err := openStorage(cfg)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	limiter, err := openLimiter(cfg, db)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	// without NOTIFY the live updates only reach the readers of this instance
+	var notify *sql.DB
+	if cfg.events.notify {
+		notify = db
+	}
+	events := newEventHub(notify, errorLog)
+
 	app := &application{
 		errorLog:       errorLog,
 		infoLog:        infoLog,
 		users:          &models.UserModel{DB: db},
 		topics:         &models.TopicModel{DB: db},
-		posts:          &models.PostModel{DB: db},
-		comments:       &models.CommentModel{DB: db},
+		posts:          &models.PostModel{DB: db, Events: events},
+		comments:       &models.CommentModel{DB: db, Events: events},
 		tokens:         &models.TokenModel{DB: db},
+		search:         &models.SearchModel{DB: db},
+		notifications:  &models.NotificationModel{DB: db},
+		moderation:     &models.ModerationModel{DB: db},
+		bans:           &models.BanModel{DB: db},
+		attachments:    &models.AttachmentModel{DB: db},
+		polls:          &models.PollModel{DB: db},
+		messages:       &models.MessageModel{DB: db},
+		twoFactor:      &models.TwoFactorModel{DB: db, Key: cfg.totpKey},
+		settings:       &models.SettingModel{DB: db},
+		events:         events,
+		storage:        store,
+		limiter:        limiter,
+		markdown:       newMarkdownRenderer(markdownCacheSize),
 		templateCache:  templateCache,
 		formDecoder:    formDecoder,
 		sessionManager: sessionManager,
 		config:         cfg,
 		mailer:         mailClient,
 	}
+	events.prepare = app.prepareEvent
 
 	err = app.serve()
 	errorLog.Println(err)
@@ -141,6 +274,15 @@ func (app *application) serve() error {
 		err = errors.Join(err, otelShutdown(context.Background()))
 	}()
 
+	app.background(func() { app.refreshPostScores(ctx) })
+	app.background(func() { app.sendEmails(ctx) })
+	app.background(func() { app.purgeDeleted(ctx) })
+	app.background(func() { app.cleanupRateLimits(ctx) })
+	app.background(func() { app.events.run(ctx) })
+	if app.config.events.notify {
+		app.background(func() { app.events.listen(ctx, app.config.db.dsn) })
+	}
+
 	serverError := make(chan error, 1)
 	srv := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", app.config.host, app.config.port),
@@ -209,3 +351,29 @@ func openDB(cfg config) (*sql.DB, error) {
 	}
 	return db, nil
 }
+
+func openStorage(cfg config) (storage.Storage, error) {
+	switch cfg.uploads.backend {
+	case "local":
+		return storage.NewLocal(cfg.uploads.dir)
+	case "s3":
+		region := cfg.s3.region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return storage.NewS3(cfg.s3.endpoint, region, cfg.s3.bucket, cfg.s3.accessKey, cfg.s3.secretKey)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.uploads.backend)
+	}
+}
+
+func openLimiter(cfg config, db *sql.DB) (ratelimit.Limiter, error) {
+	switch cfg.limiter {
+	case "memory":
+		return ratelimit.NewMemory(), nil
+	case "postgres":
+		return ratelimit.NewPostgres(db), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiter %q", cfg.limiter)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"html/template"
+	"regexp"
+	"sync"
+
+	"github.com/groth00/forum/internal/models"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// rendered posts and comments kept in memory
+const markdownCacheSize = 10000
+
+// markdownKey identifies one revision of a post or comment
+type markdownKey struct {
+	kind     string
+	id       int
+	revision int
+}
+
+type markdownEntry struct {
+	key  markdownKey
+	html template.HTML
+}
+
+// markdownRenderer turns CommonMark into HTML that only keeps an allow-list
+// of elements, so user content cannot run scripts, load resources from other
+// origins or style the page. Rendered revisions are kept in an LRU cache.
+type markdownRenderer struct {
+	md     goldmark.Markdown
+	policy *bluemonday.Policy
+
+	mu    sync.Mutex
+	items map[markdownKey]*list.Element
+	order *list.List
+	size  int
+}
+
+func newMarkdownRenderer(size int) *markdownRenderer {
+	// raw HTML in the source is dropped by goldmark, the policy cleans up
+	// whatever gets through anyway
+	md := goldmark.New(goldmark.WithExtensions(extension.Strikethrough, extension.Linkify))
+
+	policy := bluemonday.NewPolicy()
+	policy.AllowElements("p", "br", "hr", "em", "strong", "del", "blockquote", "pre", "code", "ul", "ol", "li",
+		"h1", "h2", "h3", "h4", "h5", "h6")
+	policy.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+	// images would be blocked by the CSP, links are the only way out
+	policy.AllowAttrs("href").OnElements("a")
+	policy.AllowURLSchemes("http", "https", "mailto")
+	policy.RequireParseableURLs(true)
+	policy.RequireNoFollowOnLinks(true)
+	policy.AddTargetBlankToFullyQualifiedLinks(false)
+
+	return &markdownRenderer{
+		md:     md,
+		policy: policy,
+		items:  map[markdownKey]*list.Element{},
+		order:  list.New(),
+		size:   size,
+	}
+}
+
+// Render converts the markdown source without caching it, for previews
+func (m *markdownRenderer) Render(source string) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := m.md.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(m.policy.SanitizeBytes(buf.Bytes())), nil
+}
+
+// cached renders a revision of a post or comment once
+func (m *markdownRenderer) cached(key markdownKey, source string) (template.HTML, error) {
+	m.mu.Lock()
+	if elem, ok := m.items[key]; ok {
+		m.order.MoveToFront(elem)
+		m.mu.Unlock()
+		return elem.Value.(*markdownEntry).html, nil
+	}
+	m.mu.Unlock()
+
+	html, err := m.Render(source)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.items[key]; !ok {
+		m.items[key] = m.order.PushFront(&markdownEntry{key, html})
+		if m.order.Len() > m.size {
+			oldest := m.order.Back()
+			m.order.Remove(oldest)
+			delete(m.items, oldest.Value.(*markdownEntry).key)
+		}
+	}
+	return html, nil
+}
+
+// renderPost fills in the HTML of the post, hidden posts have no content left
+// to render
+func (app *application) renderPost(post *models.Post) error {
+	if post.Content == "" {
+		return nil
+	}
+
+	html, err := app.markdown.cached(markdownKey{"post", post.ID, post.Revision}, post.Content)
+	if err != nil {
+		return err
+	}
+	post.ContentHTML = html
+	return nil
+}
+
+func (app *application) renderComment(comment *models.Comment) error {
+	if comment.Content == "" {
+		return nil
+	}
+
+	html, err := app.markdown.cached(markdownKey{"comment", comment.ID, comment.Revision}, comment.Content)
+	if err != nil {
+		return err
+	}
+	comment.ContentHTML = html
+	return nil
+}
+
+// renderCommentNodes fills in the HTML of every comment in the trees
+func (app *application) renderCommentNodes(nodes []*models.CommentNode) error {
+	for _, node := range nodes {
+		if node.Content != "" {
+			html, err := app.markdown.cached(markdownKey{"comment", node.ID, node.Revision}, node.Content)
+			if err != nil {
+				return err
+			}
+			node.ContentHTML = html
+		}
+
+		if err := app.renderCommentNodes(node.CommentNodes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+	"github.com/justinas/alice"
+)
+
+func TestAuthenticate(t *testing.T) {
+	// user 7 never ended their sessions, user 9 did once and user 8 is gone
+	generations := map[int64]int64{7: 0, 9: 1}
+	app := newTestApplication(t, func(query string, args []driver.Value) (fakeResult, error) {
+		if strings.Contains(query, "SELECT session_generation FROM users WHERE id = $1") {
+			generation, ok := generations[args[0].(int64)]
+			if !ok {
+				return fakeResult{columns: []string{"session_generation"}}, nil
+			}
+			return row(generation), nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+	})
+
+	tests := []struct {
+		name    string
+		session map[string]any
+		want    int
+	}{
+		{"anonymous", nil, 0},
+		{"logged in", map[string]any{authUser: 7}, 7},
+		{"deleted user", map[string]any{authUser: 8}, 0},
+		{"current generation", map[string]any{authUser: 9, sessionGeneration: 1}, 9},
+		{"ended session", map[string]any{authUser: 9, sessionGeneration: 0}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user_id int
+			var authenticated bool
+			handler := app.sessionManager.LoadAndSave(app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user_id = app.authenticatedUserID(r)
+				authenticated = app.isAuthenticated(r)
+			})))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.session != nil {
+				r.AddCookie(sessionCookie(t, app, tt.session))
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+			}
+			if user_id != tt.want {
+				t.Errorf("got user %d; want %d", user_id, tt.want)
+			}
+			if authenticated != (tt.want != 0) {
+				t.Errorf("got authenticated %t; want %t", authenticated, tt.want != 0)
+			}
+		})
+	}
+}
+
+func TestBearerTokenCSRF(t *testing.T) {
+	token := strings.Repeat("A", 52)
+	app := newTestApplication(t, func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.Contains(query, "JOIN tokens"):
+			return row(int64(7), "alice", "alice@example.com", []byte("hash"), time.Now(), true, false, int64(1)), nil
+		case strings.Contains(query, "SELECT session_generation FROM users"):
+			return row(int64(0)), nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+	})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	session := alice.New(app.sessionManager.LoadAndSave, noSurf, app.authenticate).Then(ok)
+	api := alice.New(app.sessionManager.LoadAndSave, app.authenticateToken, app.apiNoSurf).Then(ok)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		bearer  bool
+		want    int
+	}{
+		{"page with bearer token", session, true, http.StatusBadRequest},
+		{"api with bearer token", api, true, http.StatusOK},
+		{"api with session cookie", api, false, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.AddCookie(sessionCookie(t, app, map[string]any{authUser: 7}))
+			if tt.bearer {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, r)
+
+			if rr.Code != tt.want {
+				t.Errorf("got status %d; want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	token := strings.Repeat("A", 52)
+	hash := sha256.Sum256([]byte(token))
+
+	app := newTestApplication(t, func(query string, args []driver.Value) (fakeResult, error) {
+		if strings.Contains(query, "JOIN tokens") {
+			if !bytes.Equal(args[0].([]byte), hash[:]) || args[1] != models.ScopeAuthentication {
+				return fakeResult{columns: make([]string, 8)}, nil
+			}
+			return row(int64(7), "alice", "alice@example.com", []byte("hash"), time.Now(), true, false, int64(1)), nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantUser      int
+	}{
+		{"no header", "", http.StatusOK, 0},
+		{"valid token", "Bearer " + token, http.StatusOK, 7},
+		{"unknown token", "Bearer " + strings.Repeat("B", 52), http.StatusUnauthorized, 0},
+		{"short token", "Bearer " + token[:51], http.StatusUnauthorized, 0},
+		{"other scheme", "Basic " + token, http.StatusUnauthorized, 0},
+		{"missing token", "Bearer", http.StatusUnauthorized, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user_id int
+			handler := app.sessionManager.LoadAndSave(app.authenticateToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user_id = app.authenticatedUserID(r)
+			})))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if user_id != tt.wantUser {
+				t.Errorf("got user %d; want %d", user_id, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestUploadDeadline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends a body for longer than the read timeout of the server")
+	}
+
+	app := newTestApplication(t, nil)
+	handler := app.uploadDeadline(uploadTimeout)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, len(data))
+	}))
+
+	// the timeouts of the server in serve
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config.ReadTimeout = 5 * time.Second
+	ts.Config.WriteTimeout = 10 * time.Second
+	ts.Start()
+	defer ts.Close()
+
+	// a chunk a second for longer than the read timeout
+	body, writer := io.Pipe()
+	go func() {
+		chunk := bytes.Repeat([]byte("a"), 1024)
+		for i := 0; i < 6; i++ {
+			time.Sleep(time.Second)
+			if _, err := writer.Write(chunk); err != nil {
+				return
+			}
+		}
+		writer.Close()
+	}()
+
+	resp, err := http.Post(ts.URL, "application/octet-stream", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(got) != "6144" {
+		t.Errorf("got status %d and %q; want %d and %q", resp.StatusCode, got, http.StatusOK, "6144")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/groth00/forum/internal/models"
+	"github.com/groth00/forum/internal/ratelimit"
+)
+
+// rateLimit configures the limits of a route group, every group has its own
+// buckets. Requests are counted per IP and, once authenticated, per user as
+// well; accounts younger than newAccountAge get the newUser rate. A zero rate
+// does not limit.
+type rateLimit struct {
+	group   string
+	ip      ratelimit.Rate
+	user    ratelimit.Rate
+	newUser ratelimit.Rate
+}
+
+// rateLimit answers requests over the limit of the group with 429 Too Many
+// Requests; it needs the user of the request so it goes after authenticate
+func (app *application) rateLimit(limit rateLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wait := app.rateLimited(r, limit); wait > 0 {
+				w.Header().Set("Retry-After", retryAfter(wait))
+				app.clientError(w, http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiRateLimit is rateLimit with the error in JSON
+func (app *application) apiRateLimit(limit rateLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wait := app.rateLimited(r, limit); wait > 0 {
+				app.rateLimitExceededResponse(w, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimited takes a token from the buckets of the request and returns how
+// long to wait when one of them is empty. The limiter failing lets requests
+// through, the site should not go down with it.
+func (app *application) rateLimited(r *http.Request, limit rateLimit) time.Duration {
+	type bucket struct {
+		key  string
+		rate ratelimit.Rate
+	}
+
+	buckets := []bucket{}
+	if limit.ip.Burst > 0 {
+		buckets = append(buckets, bucket{fmt.Sprintf("%s:ip:%s", limit.group, app.clientIP(r)), limit.ip})
+	}
+
+	if user_id := app.authenticatedUserID(r); user_id > 0 && limit.user.Burst > 0 {
+		rate := limit.user
+		if limit.newUser.Burst > 0 {
+			user, err := app.users.Get(user_id)
+			if err != nil {
+				app.errorLog.Println(err)
+			} else if time.Since(user.Created) < newAccountAge {
+				rate = limit.newUser
+			}
+		}
+		buckets = append(buckets, bucket{fmt.Sprintf("%s:user:%d", limit.group, user_id), rate})
+	}
+
+	for _, b := range buckets {
+		allowed, wait, err := app.limiter.Allow(r.Context(), b.key, b.rate)
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		if !allowed {
+			return wait
+		}
+	}
+	return 0
+}
+
+// clientIP is the address the request came from without the port. Behind
+// trusted proxies it is the last address of X-Forwarded-For that is not one
+// of them, the addresses before it could have been sent by the client.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !app.trustedProxy(host) {
+		return host
+	}
+
+	forwarded := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(address))
+		}
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			break
+		}
+		host = forwarded[i]
+		if !app.trustedProxy(host) {
+			break
+		}
+	}
+	return host
+}
+
+// trustedProxy reports whether the address is one of the trusted proxies
+func (app *application) trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range app.config.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses addresses and CIDR ranges separated by spaces
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, field := range strings.Fields(s) {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, proxy, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+// retryAfter is the value of a Retry-After header, in whole seconds
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// waitMinutes tells a user how long to wait, rounded up to the minute
+func waitMinutes(wait time.Duration) string {
+	minutes := int(math.Ceil(wait.Minutes()))
+	if minutes <= 1 {
+		return "a minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// lockoutMessage tells a user who is locked out when to try again
+func lockoutMessage(locked_until time.Time) string {
+	return fmt.Sprintf("too many failed logins, the account is locked; try again in %s or reset your password", waitMinutes(time.Until(locked_until)))
+}
+
+// login checks the credentials of a login form or token request, a wrong
+// password counts as a failed login. The failed logins of the account are
+// only forgotten by LoginSucceeded once every factor has been checked.
+func (app *application) login(email, password string) (int, time.Time, error) {
+	user_id, err := app.users.Authenticate(email, password)
+	switch {
+	case err == nil:
+		return user_id, time.Time{}, nil
+	case errors.Is(err, models.ErrAccountLocked):
+		lockout, err := app.users.LockoutOf(email)
+		if err != nil {
+			return -1, time.Time{}, err
+		}
+		return -1, lockout.Until, models.ErrAccountLocked
+	case !errors.Is(err, models.ErrInvalidCredentials):
+		return -1, time.Time{}, err
+	}
+
+	locked_until, err := app.loginFailed(email)
+	return -1, locked_until, err
+}
+
+// loginFailed counts a failed login, a wrong password or two-factor code, of
+// the account with the email. Every failed login past models.LoginAttempts
+// locks the account for twice as long as the previous one; it returns
+// ErrAccountLocked and when the lockout ends, or ErrInvalidCredentials. The
+// owner of the account is emailed when it is first locked.
+func (app *application) loginFailed(email string) (time.Time, error) {
+	lockout, err := app.users.LoginFailed(email)
+	if err != nil {
+		// nobody has the email, there is no account to lock
+		if errors.Is(err, models.ErrNoRecordFound) {
+			return time.Time{}, models.ErrInvalidCredentials
+		}
+		return time.Time{}, err
+	}
+
+	if lockout.Until.IsZero() {
+		return time.Time{}, models.ErrInvalidCredentials
+	}
+
+	if lockout.Failed == models.LoginAttempts {
+		app.background(func() {
+			data := map[string]any{
+				"username": lockout.Name,
+				"attempts": lockout.Failed,
+				"wait":     waitMinutes(time.Until(lockout.Until)),
+				"link":     app.config.baseURL + "/users/password/forgot",
+			}
+
+			err := app.mailer.Send(app.config.smtp.sender, lockout.Email, "lockout_email.tmpl", data)
+			if err != nil {
+				app.errorLog.Printf("Error sending mail: %v", err)
+			}
+		})
+	}
+
+	return lockout.Until, models.ErrAccountLocked
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/groth00/forum/internal/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	app := newTestApplication(t, nil)
+	app.limiter = ratelimit.NewMemory()
+
+	limit := rateLimit{group: "test", ip: ratelimit.Rate{Burst: 2, Every: time.Minute}}
+	handler := app.rateLimit(limit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = remote
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := request("203.0.113.5:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d; want %d", i+1, rr.Code, http.StatusOK)
+		}
+	}
+
+	rr := request("203.0.113.5:4321")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("got Retry-After %q; want %q", got, "60")
+	}
+
+	if rr := request("198.51.100.7:1234"); rr.Code != http.StatusOK {
+		t.Errorf("another address: got status %d; want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		proxies   bool
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", false, "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"header without proxies", false, "203.0.113.5:1234", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"untrusted remote", true, "203.0.113.5:1234", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"behind a proxy", true, "10.0.0.2:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"single address proxy", true, "192.0.2.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed header", true, "10.0.0.2:1234", []string{"1.1.1.1, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of proxies", true, "10.0.0.2:1234", []string{"198.51.100.7, 10.0.0.3", "10.0.0.4"}, "198.51.100.7"},
+		{"invalid address", true, "10.0.0.2:1234", []string{"198.51.100.7, unknown"}, "10.0.0.2"},
+		{"missing header", true, "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"only proxies", true, "10.0.0.2:1234", []string{"10.0.0.3"}, "10.0.0.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, nil)
+			if tt.proxies {
+				app.config.trustedProxies = proxies
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, header := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+
+			if got := app.clientIP(r); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/33", "proxy.example", "10.0.0"} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+
+	proxies, err := parseTrustedProxies("::1 10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 2 || proxies[0].String() != "::1/128" || proxies[1].String() != "10.0.0.1/32" {
+		t.Errorf("got %v", proxies)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"net/http"
+	"time"
 
+	"github.com/groth00/forum/internal/ratelimit"
 	"github.com/groth00/forum/ui"
 	"github.com/julienschmidt/httprouter"
 	"github.com/justinas/alice"
@@ -18,11 +20,35 @@ func (app *application) routes() http.Handler {
 	router.Handler(http.MethodGet, "/static/*filepath", fileServer)
 
 	// middleware chains
-	// removing noSurf because it's not possible to store the CSRFToken in the recursive HTML
 	session := alice.New(app.sessionManager.LoadAndSave, noSurf, app.authenticate)
 	authenticated := session.Append(app.requireAuthentication)
 	activated := authenticated.Append(app.requireActivatedUser)
 	admin := activated.Append(app.requireAdmin)
+
+	// rate limits of the route groups, the API shares the buckets of the pages
+	registerLimit := rateLimit{group: "register", ip: ratelimit.Rate{Burst: 3, Every: 20 * time.Minute}}
+	loginLimit := rateLimit{group: "login", ip: ratelimit.Rate{Burst: 10, Every: time.Minute}}
+	emailLimit := rateLimit{group: "email", ip: ratelimit.Rate{Burst: 3, Every: 10 * time.Minute}}
+	// codes entered to change two-factor authentication, logins are limited by loginLimit
+	twoFactorLimit := rateLimit{group: "two-factor", user: ratelimit.Rate{Burst: 5, Every: time.Minute}}
+	writeLimit := rateLimit{
+		group:   "write",
+		ip:      ratelimit.Rate{Burst: 30, Every: 10 * time.Second},
+		user:    ratelimit.Rate{Burst: 10, Every: time.Minute},
+		newUser: ratelimit.Rate{Burst: 3, Every: 5 * time.Minute},
+	}
+	voteLimit := rateLimit{
+		group:   "vote",
+		ip:      ratelimit.Rate{Burst: 120, Every: time.Second},
+		user:    ratelimit.Rate{Burst: 60, Every: 2 * time.Second},
+		newUser: ratelimit.Rate{Burst: 20, Every: 6 * time.Second},
+	}
+
+	writing := activated.Append(app.rateLimit(writeLimit))
+	voting := activated.Append(app.rateLimit(voteLimit))
+	// posts and comments with attachments, room for every file and the text fields
+	uploadSize := int64(app.config.uploads.maxFiles)*app.config.uploads.maxSize + 1<<20
+	upload := alice.New(app.uploadDeadline(uploadTimeout), limitBody(uploadSize)).Extend(writing)
 	middle := alice.New(app.recoverPanic, app.enableCORS, app.logRequest, secureHeaders)
 
 	home := otelhttp.WithRouteTag("/", session.ThenFunc(app.home))
@@ -32,48 +58,117 @@ func (app *application) routes() http.Handler {
 	router.Handler(http.MethodGet, "/ping", ping)
 
 	router.Handler(http.MethodGet, "/users/register", session.ThenFunc(app.userCreate))
-	router.Handler(http.MethodPost, "/users/register", session.ThenFunc(app.userCreatePost))
+	router.Handler(http.MethodPost, "/users/register", session.Append(app.rateLimit(registerLimit)).ThenFunc(app.userCreatePost))
 	router.Handler(http.MethodGet, "/users/login", session.ThenFunc(app.userLogin))
-	router.Handler(http.MethodPost, "/users/login", session.ThenFunc(app.userLoginPost))
+	router.Handler(http.MethodPost, "/users/login", session.Append(app.rateLimit(loginLimit)).ThenFunc(app.userLoginPost))
+	router.Handler(http.MethodGet, "/users/login/2fa", session.ThenFunc(app.userLoginTwoFactor))
+	router.Handler(http.MethodPost, "/users/login/2fa", session.Append(app.rateLimit(loginLimit)).ThenFunc(app.userLoginTwoFactorPost))
 	router.Handler(http.MethodPost, "/users/logout", authenticated.ThenFunc(app.userLogoutPost))
 	router.Handler(http.MethodGet, "/users/activate", session.ThenFunc(app.userActivate))
 	router.Handler(http.MethodPost, "/users/activate", session.ThenFunc(app.userActivatePost))
+	router.Handler(http.MethodPost, "/users/activate/resend", session.Append(app.rateLimit(emailLimit)).ThenFunc(app.userActivateResendPost))
 	router.Handler(http.MethodGet, "/users/settings", authenticated.ThenFunc(app.userSettings))
 	router.Handler(http.MethodPost, "/users/settings/reset", authenticated.ThenFunc(app.userPasswordResetPost))
+	router.Handler(http.MethodGet, "/users/password/forgot", session.ThenFunc(app.userForgotPassword))
+	router.Handler(http.MethodPost, "/users/password/forgot", session.Append(app.rateLimit(emailLimit)).ThenFunc(app.userForgotPasswordPost))
+	router.Handler(http.MethodGet, "/users/password/reset", session.ThenFunc(app.userNewPassword))
+	router.Handler(http.MethodPost, "/users/password/reset", session.ThenFunc(app.userNewPasswordPost))
+	router.Handler(http.MethodPost, "/users/settings/email", authenticated.ThenFunc(app.userEmailPreferencesPost))
+	router.Handler(http.MethodPost, "/users/settings/2fa/setup", authenticated.ThenFunc(app.userTwoFactorSetupPost))
+	router.Handler(http.MethodGet, "/users/settings/2fa/qr", authenticated.ThenFunc(app.userTwoFactorQR))
+	router.Handler(http.MethodPost, "/users/settings/2fa/enable", authenticated.Append(app.rateLimit(twoFactorLimit)).ThenFunc(app.userTwoFactorEnablePost))
+	router.Handler(http.MethodPost, "/users/settings/2fa/codes", authenticated.Append(app.rateLimit(twoFactorLimit)).ThenFunc(app.userTwoFactorCodesPost))
+	router.Handler(http.MethodPost, "/users/settings/2fa/disable", authenticated.Append(app.rateLimit(twoFactorLimit)).ThenFunc(app.userTwoFactorDisablePost))
+
+	// unsubscribe links are signed, mail clients posting the one-click
+	// unsubscribe have no CSRF token
+	router.Handler(http.MethodGet, "/unsubscribe", session.ThenFunc(app.unsubscribe))
+	router.Handler(http.MethodPost, "/unsubscribe", alice.New(app.sessionManager.LoadAndSave).ThenFunc(app.unsubscribePost))
 	router.Handler(http.MethodGet, "/users/profile/:id", session.ThenFunc(app.userGet))
 	router.Handler(http.MethodDelete, "/users", activated.ThenFunc(app.userDelete))
+	router.Handler(http.MethodPost, "/users/message/:id", writing.ThenFunc(app.userMessagePost))
+	router.Handler(http.MethodPost, "/users/block/:id", activated.ThenFunc(app.userBlockPost))
+	router.Handler(http.MethodPost, "/users/unblock/:id", activated.ThenFunc(app.userUnblockPost))
 
 	router.Handler(http.MethodGet, "/topics", session.ThenFunc(app.topicList))
 	router.Handler(http.MethodGet, "/topics/:id", session.ThenFunc(app.topicGet))
+	router.Handler(http.MethodGet, "/topics/:id/events", session.ThenFunc(app.topicEvents))
 	router.Handler(http.MethodPost, "/topics", admin.ThenFunc(app.topicCreatePost))
-	router.Handler(http.MethodPut, "/topics/:id", admin.ThenFunc(app.topicUpdatePost))
-	router.Handler(http.MethodPost, "/topics/moderators/add/:id", admin.ThenFunc(app.topicAddModerator))
-	router.Handler(http.MethodPost, "/topics/moderators/remove/:id", admin.ThenFunc(app.topicRemoveModerator))
-	router.Handler(http.MethodPost, "/topics/subscribe/:id", activated.ThenFunc(app.topicSubscribe))
-	router.Handler(http.MethodPost, "/topics/unsubscribe/:id", activated.ThenFunc(app.topicUnsubscribe))
+	router.Handler(http.MethodPost, "/topics/subscribe/:id", voting.ThenFunc(app.topicSubscribe))
+	router.Handler(http.MethodPost, "/topics/unsubscribe/:id", voting.ThenFunc(app.topicUnsubscribe))
+
+	// topic moderation, the middlewares resolve the topic from the topic, post
+	// or comment in the route and check the role of the user in it
+	topicOwner := activated.Append(app.requireTopicOwner(app.topicFromRoute))
+	topicModerator := activated.Append(app.requireTopicModerator(app.topicFromRoute))
+	postModerator := activated.Append(app.requireTopicModerator(app.topicFromPost))
+	commentModerator := activated.Append(app.requireTopicModerator(app.topicFromComment))
+
+	router.Handler(http.MethodPut, "/topics/:id", topicOwner.ThenFunc(app.topicUpdatePost))
+	router.Handler(http.MethodPost, "/topics/moderators/add/:id", topicOwner.ThenFunc(app.topicAddModerator))
+	router.Handler(http.MethodPost, "/topics/moderators/remove/:id", topicOwner.ThenFunc(app.topicRemoveModerator))
+	router.Handler(http.MethodGet, "/topics/:id/modqueue", topicModerator.ThenFunc(app.modQueue))
+	router.Handler(http.MethodGet, "/topics/:id/modlog", topicModerator.ThenFunc(app.modLog))
+	router.Handler(http.MethodPost, "/posts/moderate/:id", postModerator.ThenFunc(app.postModeratePost))
+	router.Handler(http.MethodPost, "/comments/moderate/:id", commentModerator.ThenFunc(app.commentModeratePost))
+	router.Handler(http.MethodGet, "/topics/:id/bans", topicModerator.ThenFunc(app.banList))
+	router.Handler(http.MethodPost, "/topics/ban/:id", topicModerator.ThenFunc(app.banCreatePost))
+	router.Handler(http.MethodPost, "/topics/unban/:id", topicModerator.ThenFunc(app.banLiftPost))
+
+	// site-wide bans, banned users are sent to /banned by requireActivatedUser
+	router.Handler(http.MethodGet, "/banned", authenticated.ThenFunc(app.banned))
+	router.Handler(http.MethodGet, "/admin", admin.ThenFunc(app.adminGet))
+	router.Handler(http.MethodPost, "/admin/settings", admin.ThenFunc(app.adminSettingsPost))
+	router.Handler(http.MethodGet, "/admin/bans", admin.ThenFunc(app.banList))
+	router.Handler(http.MethodPost, "/admin/bans", admin.ThenFunc(app.banCreatePost))
+	router.Handler(http.MethodPost, "/admin/bans/lift", admin.ThenFunc(app.banLiftPost))
 
 	router.Handler(http.MethodGet, "/posts/:id", session.ThenFunc(app.postGet))
+	router.Handler(http.MethodGet, "/posts/:id/revisions", session.ThenFunc(app.postRevisions))
+	router.Handler(http.MethodGet, "/posts/:id/preview", session.ThenFunc(app.postPreviewImage))
+	router.Handler(http.MethodGet, "/posts/:id/events", session.ThenFunc(app.postEvents))
 	router.Handler(http.MethodGet, "/posts", session.ThenFunc(app.postList))
-	router.Handler(http.MethodPut, "/posts/:id", activated.ThenFunc(app.postUpdatePost))
+	router.Handler(http.MethodPut, "/posts/:id", writing.ThenFunc(app.postUpdatePost))
 	router.Handler(http.MethodDelete, "/posts/:id", activated.ThenFunc(app.postDelete))
 
 	router.Handler(http.MethodGet, "/new", activated.ThenFunc(app.postCreate))
-	router.Handler(http.MethodPost, "/new", activated.ThenFunc(app.postCreatePost))
+	router.Handler(http.MethodPost, "/new", upload.ThenFunc(app.postCreatePost))
+	router.Handler(http.MethodPost, "/preview", activated.ThenFunc(app.markdownPreview))
 
 	// TODO: if the user created the post/comment, display elements to let them update or delete
-	router.Handler(http.MethodPost, "/posts/like/:id", activated.ThenFunc(app.postLike))
-	router.Handler(http.MethodPost, "/posts/dislike/:id", activated.ThenFunc(app.postDislike))
-	router.Handler(http.MethodPost, "/posts/save/:id", activated.ThenFunc(app.postSave))
-	router.Handler(http.MethodPost, "/posts/unsave/:id", activated.ThenFunc(app.postUnsave))
+	router.Handler(http.MethodPost, "/posts/like/:id", voting.Then(app.postAction(app.posts.Like)))
+	router.Handler(http.MethodPost, "/posts/dislike/:id", voting.Then(app.postAction(app.posts.Dislike)))
+	router.Handler(http.MethodPost, "/posts/unvote/:id", voting.Then(app.postAction(app.posts.Unvote)))
+	router.Handler(http.MethodPost, "/posts/save/:id", voting.Then(app.postAction(app.posts.Save)))
+	router.Handler(http.MethodPost, "/posts/unsave/:id", voting.Then(app.postAction(app.posts.Unsave)))
+	router.Handler(http.MethodPost, "/posts/report/:id", writing.ThenFunc(app.postReportPost))
+	router.Handler(http.MethodPost, "/posts/vote/:id", voting.ThenFunc(app.postVotePost))
 
 	router.Handler(http.MethodGet, "/comments/:id", session.ThenFunc(app.commentGet))
-	router.Handler(http.MethodPost, "/comments", activated.ThenFunc(app.commentCreatePost))
-	router.Handler(http.MethodPut, "/comments/:id", activated.ThenFunc(app.commentUpdatePost))
+	router.Handler(http.MethodGet, "/comments/:id/replies", session.ThenFunc(app.commentReplies))
+	router.Handler(http.MethodGet, "/comments/:id/revisions", session.ThenFunc(app.commentRevisions))
+	router.Handler(http.MethodPost, "/comments", upload.ThenFunc(app.commentCreatePost))
+	router.Handler(http.MethodPut, "/comments/:id", writing.ThenFunc(app.commentUpdatePost))
 	router.Handler(http.MethodDelete, "/comments/:id", activated.ThenFunc(app.commentDelete))
-	router.Handler(http.MethodPost, "/comments/like/:id", activated.ThenFunc(app.commentLike))
-	router.Handler(http.MethodPost, "/comments/dislike/:id", activated.ThenFunc(app.commentDislike))
-	router.Handler(http.MethodPost, "/comments/save/:id", activated.ThenFunc(app.commentSave))
-	router.Handler(http.MethodPost, "/comments/unsave/:id", activated.ThenFunc(app.commentUnsave))
+	router.Handler(http.MethodPost, "/comments/like/:id", voting.Then(app.commentAction("like", app.comments.Like)))
+	router.Handler(http.MethodPost, "/comments/dislike/:id", voting.Then(app.commentAction("dislike", app.comments.Dislike)))
+	router.Handler(http.MethodPost, "/comments/unvote/:id", voting.Then(app.commentAction("unvote", app.comments.Unvote)))
+	router.Handler(http.MethodPost, "/comments/save/:id", voting.Then(app.commentAction("save", app.comments.Save)))
+	router.Handler(http.MethodPost, "/comments/unsave/:id", voting.Then(app.commentAction("unsave", app.comments.Unsave)))
+	router.Handler(http.MethodPost, "/comments/report/:id", writing.ThenFunc(app.commentReportPost))
+
+	router.Handler(http.MethodGet, "/attachments/:id", session.ThenFunc(app.attachmentGet))
+	router.Handler(http.MethodGet, "/attachments/:id/thumb", session.ThenFunc(app.attachmentThumbnail))
+
+	router.Handler(http.MethodGet, "/search", session.ThenFunc(app.searchGet))
+
+	router.Handler(http.MethodGet, "/notifications", authenticated.ThenFunc(app.notificationList))
+	router.Handler(http.MethodGet, "/notifications/:id", authenticated.ThenFunc(app.notificationGet))
+	router.Handler(http.MethodPost, "/notifications/read", authenticated.ThenFunc(app.notificationReadAllPost))
+
+	router.Handler(http.MethodGet, "/messages", authenticated.ThenFunc(app.messageList))
+	router.Handler(http.MethodGet, "/messages/:id", authenticated.ThenFunc(app.messageGet))
+	router.Handler(http.MethodPost, "/messages/:id", writing.ThenFunc(app.messageReplyPost))
 
 	// TODO: unsaving a post/comment
 	router.Handler(http.MethodGet, "/users/saved/posts", activated.ThenFunc(app.userPostSaved))
@@ -81,5 +176,53 @@ func (app *application) routes() http.Handler {
 	router.Handler(http.MethodGet, "/users/saved/comments", activated.ThenFunc(app.userCommentSaved))
 	router.Handler(http.MethodGet, "/users/liked/comments", activated.ThenFunc(app.userCommentLiked))
 
+	// JSON API, errors are returned as JSON instead of redirects to the login page
+	// clients can authenticate with either the session cookie or a bearer token
+	// requests with a valid bearer token skip the CSRF check
+	api := alice.New(app.sessionManager.LoadAndSave, app.authenticateToken, app.apiNoSurf)
+	apiAuthenticated := api.Append(app.requireAPIAuthentication)
+	apiActivated := api.Append(app.requireAPIActivatedUser)
+	apiWriting := apiActivated.Append(app.apiRateLimit(writeLimit))
+	apiVoting := apiActivated.Append(app.apiRateLimit(voteLimit))
+
+	// exchanging credentials for a token sets no cookies, so it does not need CSRF protection
+	router.Handler(http.MethodPost, "/api/v1/tokens/authentication", alice.New(app.apiRateLimit(loginLimit)).ThenFunc(app.apiAuthenticationTokenCreate))
+	router.Handler(http.MethodDelete, "/api/v1/tokens/authentication", apiAuthenticated.ThenFunc(app.apiAuthenticationTokenDelete))
+
+	router.Handler(http.MethodGet, "/api/v1/topics", api.ThenFunc(app.apiTopicList))
+	router.Handler(http.MethodGet, "/api/v1/topics/:id", api.ThenFunc(app.apiTopicGet))
+	router.Handler(http.MethodPost, "/api/v1/topics/:id/subscribe", apiVoting.ThenFunc(app.apiTopicSubscribe))
+	router.Handler(http.MethodDelete, "/api/v1/topics/:id/subscribe", apiVoting.ThenFunc(app.apiTopicUnsubscribe))
+
+	router.Handler(http.MethodGet, "/api/v1/posts", api.ThenFunc(app.apiPostList))
+	router.Handler(http.MethodPost, "/api/v1/posts", apiWriting.ThenFunc(app.apiPostCreate))
+	router.Handler(http.MethodGet, "/api/v1/posts/:id", api.ThenFunc(app.apiPostGet))
+	router.Handler(http.MethodPut, "/api/v1/posts/:id", apiWriting.ThenFunc(app.apiPostUpdate))
+	router.Handler(http.MethodDelete, "/api/v1/posts/:id", apiActivated.ThenFunc(app.apiPostDelete))
+	router.Handler(http.MethodGet, "/api/v1/posts/:id/comments", api.ThenFunc(app.apiPostComments))
+	router.Handler(http.MethodPost, "/api/v1/posts/:id/like", apiVoting.Then(app.apiPostAction(app.posts.Like)))
+	router.Handler(http.MethodPost, "/api/v1/posts/:id/dislike", apiVoting.Then(app.apiPostAction(app.posts.Dislike)))
+	router.Handler(http.MethodPost, "/api/v1/posts/:id/save", apiVoting.Then(app.apiPostAction(app.posts.Save)))
+	router.Handler(http.MethodDelete, "/api/v1/posts/:id/save", apiVoting.Then(app.apiPostAction(app.posts.Unsave)))
+
+	router.Handler(http.MethodPost, "/api/v1/comments", apiWriting.ThenFunc(app.apiCommentCreate))
+	router.Handler(http.MethodGet, "/api/v1/comments/:id", api.ThenFunc(app.apiCommentGet))
+	router.Handler(http.MethodGet, "/api/v1/comments/:id/replies", api.ThenFunc(app.apiCommentReplies))
+	router.Handler(http.MethodPut, "/api/v1/comments/:id", apiWriting.ThenFunc(app.apiCommentUpdate))
+	router.Handler(http.MethodDelete, "/api/v1/comments/:id", apiActivated.ThenFunc(app.apiCommentDelete))
+	router.Handler(http.MethodPost, "/api/v1/comments/:id/like", apiVoting.Then(app.apiCommentAction(app.comments.Like)))
+	router.Handler(http.MethodPost, "/api/v1/comments/:id/dislike", apiVoting.Then(app.apiCommentAction(app.comments.Dislike)))
+	router.Handler(http.MethodPost, "/api/v1/comments/:id/save", apiVoting.Then(app.apiCommentAction(app.comments.Save)))
+	router.Handler(http.MethodDelete, "/api/v1/comments/:id/save", apiVoting.Then(app.apiCommentAction(app.comments.Unsave)))
+
+	router.Handler(http.MethodGet, "/api/v1/search", api.ThenFunc(app.apiSearch))
+
+	router.Handler(http.MethodGet, "/api/v1/users/:id", api.ThenFunc(app.apiUserGet))
+	router.Handler(http.MethodGet, "/api/v1/me", apiAuthenticated.ThenFunc(app.apiUserMe))
+	router.Handler(http.MethodGet, "/api/v1/me/saved/posts", apiAuthenticated.ThenFunc(app.apiUserSavedPosts))
+	router.Handler(http.MethodGet, "/api/v1/me/liked/posts", apiAuthenticated.ThenFunc(app.apiUserLikedPosts))
+	router.Handler(http.MethodGet, "/api/v1/me/saved/comments", apiAuthenticated.ThenFunc(app.apiUserSavedComments))
+	router.Handler(http.MethodGet, "/api/v1/me/liked/comments", apiAuthenticated.ThenFunc(app.apiUserLikedComments))
+
 	return otelhttp.NewHandler(middle.Then(router), "/")
 }
@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/groth00/forum/internal/models"
@@ -15,20 +16,43 @@ import (
 )
 
 type templateData struct {
-	CurrentYear     int
-	User            *models.User
-	Users           []*models.User
-	Topic           *models.Topic
-	Topics          []*models.Topic
-	Post            *models.Post
-	Posts           []*models.Post
-	Comment         *models.Comment
-	Comments        []*models.Comment
-	CommentNodes    []*models.CommentNode
-	Form            any
-	Flash           string
-	IsAuthenticated bool
-	CSRFToken       string
+	CurrentYear      int
+	User             *models.User
+	Users            []*models.User
+	Topic            *models.Topic
+	Topics           []*models.Topic
+	Subscribed       []*models.Topic
+	Post             *models.Post
+	Posts            []*models.Post
+	Comment          *models.Comment
+	Comments         []*models.Comment
+	CommentNodes     []*models.CommentNode
+	SearchResults    []*models.SearchResult
+	Notifications    []*models.Notification
+	EmailPreferences *models.EmailPreferences
+	ModQueue         []*models.QueueItem
+	ModLog           []*models.LogEntry
+	Moderators       []*models.Moderator
+	Bans             []*models.Ban
+	Revisions        []*models.Revision
+	Conversations    []*models.Conversation
+	Conversation     *models.Conversation
+	Messages         []*models.Message
+	Diff             *revisionDiff
+	TwoFactor        *models.TwoFactor
+	TOTPSetup        *totpSetup
+	RecoveryCodes    []string
+	SiteSettings     *models.SiteSettings
+	Page             models.Page
+	Form             any
+	Flash            string
+	IsAuthenticated  bool
+	IsModerator      bool
+	Blocked          bool
+	TopicRole        string
+	CSRFToken        string
+	UnreadCount      int
+	MessageCount     int
 }
 
 func formatDate(in time.Time) string {
@@ -39,17 +63,43 @@ func setCommentMargin(path_length int) int {
 	return 30 * path_length
 }
 
+// highlight escapes a search headline and turns the match markers placed by
+// ts_headline into <mark> elements
+func highlight(headline string) template.HTML {
+	escaped := template.HTMLEscapeString(headline)
+	escaped = strings.ReplaceAll(escaped, models.HighlightStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, models.HighlightStop, "</mark>")
+	return template.HTML(escaped)
+}
+
 func varargs(args ...interface{}) []interface{} {
 	return args
 }
 
 func (app *application) newTemplateData(r *http.Request) *templateData {
-	return &templateData{
+	data := &templateData{
 		CurrentYear:     time.Now().Year(),
 		Flash:           app.sessionManager.PopString(r.Context(), "flash"),
 		IsAuthenticated: app.isAuthenticated(r),
 		CSRFToken:       nosurf.Token(r),
 	}
+
+	// the badge in the nav is not worth failing the whole page for
+	if user_id := app.authenticatedUserID(r); user_id > 0 {
+		count, err := app.notifications.UnreadCount(user_id)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		data.UnreadCount = count
+
+		count, err = app.messages.UnreadCount(user_id)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		data.MessageCount = count
+	}
+
+	return data
 }
 
 func (app *application) render(w http.ResponseWriter, status int, page string, data *templateData) {
@@ -57,6 +107,7 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 	if !ok {
 		err := fmt.Errorf("the template %s does not exist", page)
 		app.serverError(w, err)
+		return
 	}
 
 	buf := new(bytes.Buffer)
@@ -72,6 +123,28 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 	buf.WriteTo(w) // write from bytes.buffer to http.ResponseWriter
 }
 
+// renderFragment executes a single template of a page without the base
+// layout, used to answer htmx requests with partial HTML
+func (app *application) renderFragment(w http.ResponseWriter, status int, page, name string, data any) {
+	ts, ok := app.templateCache[page]
+	if !ok {
+		err := fmt.Errorf("the template %s does not exist", page)
+		app.serverError(w, err)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	err := ts.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
 func newTemplateCache() (map[string]*template.Template, error) {
 	cache := map[string]*template.Template{}
 
@@ -79,6 +152,7 @@ func newTemplateCache() (map[string]*template.Template, error) {
 		"formatDate":       formatDate,
 		"setCommentMargin": setCommentMargin,
 		"varargs":          varargs,
+		"highlight":        highlight,
 	}
 
 	pages, err := fs.Glob(ui.Files, "html/templates/*.tmpl")
@@ -93,6 +167,9 @@ func newTemplateCache() (map[string]*template.Template, error) {
 			"html/base.tmpl",
 			"html/nav.tmpl",
 			"html/aside.tmpl",
+			"html/pagination.tmpl",
+			"html/sort.tmpl",
+			"html/comment.tmpl",
 			page,
 		}
 		// parse templates from the embedded filesystem
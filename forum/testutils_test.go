@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-playground/form/v4"
+	"github.com/groth00/forum/internal/models"
+)
+
+// fakeResult is what the fake database answers to a statement
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+// fakeAnswer answers the statements of a test, the handlers under test are
+// the same whichever database is behind the models
+type fakeAnswer func(query string, args []driver.Value) (fakeResult, error)
+
+type fakeConnector struct{ answer fakeAnswer }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ answer fakeAnswer }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{answer: c.answer, query: query}, nil
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	answer fakeAnswer
+	query  string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result, err := s.answer(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result, err := s.answer(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{result: result}, nil
+}
+
+type fakeRows struct {
+	result fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
+
+// row is a fakeResult of a single row
+func row(values ...driver.Value) fakeResult {
+	columns := make([]string, len(values))
+	for i := range columns {
+		columns[i] = "column"
+	}
+	return fakeResult{columns: columns, rows: [][]driver.Value{values}}
+}
+
+// newTestApplication returns an application whose models query the fake
+// database and whose sessions are kept in memory
+func newTestApplication(t *testing.T, answer fakeAnswer) *application {
+	db := sql.OpenDB(fakeConnector{answer: answer})
+	t.Cleanup(func() { db.Close() })
+
+	return &application{
+		errorLog:       log.New(io.Discard, "", 0),
+		infoLog:        log.New(io.Discard, "", 0),
+		users:          &models.UserModel{DB: db},
+		posts:          &models.PostModel{DB: db},
+		tokens:         &models.TokenModel{DB: db},
+		polls:          &models.PollModel{DB: db},
+		notifications:  &models.NotificationModel{DB: db},
+		messages:       &models.MessageModel{DB: db},
+		twoFactor:      &models.TwoFactorModel{DB: db, Key: make([]byte, 32)},
+		settings:       &models.SettingModel{DB: db},
+		formDecoder:    form.NewDecoder(),
+		sessionManager: scs.New(),
+	}
+}
+
+// sessionCookie returns the cookie of a session holding the values
+func sessionCookie(t *testing.T, app *application, values map[string]any) *http.Cookie {
+	handler := app.sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, value := range values {
+			app.sessionManager.Put(r.Context(), key, value)
+		}
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == app.sessionManager.Cookie.Name {
+			return cookie
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil
+}
+
+// asUser returns the request as made by the user, as authenticate would
+func asUser(r *http.Request, user_id int) *http.Request {
+	ctx := context.WithValue(r.Context(), isAuthenticatedKey, true)
+	ctx = context.WithValue(ctx, authenticatedUserIDKey, user_id)
+	return r.WithContext(ctx)
+}
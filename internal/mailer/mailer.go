@@ -1,15 +1,17 @@
 package mailer
 
 import (
+	"bytes"
 	"embed"
-	"html/template"
+	ht "html/template"
+	tt "text/template"
 	"time"
 
 	"github.com/wneessen/go-mail"
 )
 
-//go:embed "html"
-var mailFS embed.FS
+//go:embed "templates"
+var templateFS embed.FS
 
 type Mailer struct {
 	Client *mail.Client
@@ -33,34 +35,68 @@ func New(host, username, password string) (*Mailer, error) {
 	return mailer, nil
 }
 
-func (m *Mailer) Send(sender, recipient, templateFile string, data interface{}) error {
-	msg := mail.NewMsg()
+// Send renders templateFile, which must define the "subject", "plainBody" and
+// "htmlBody" templates, and sends it as a multipart message with a plain text
+// and an HTML alternative
+func (m *Mailer) Send(sender, recipient, templateFile string, data any) error {
+	return m.SendWithUnsubscribe(sender, recipient, templateFile, "", data)
+}
 
-	if err := msg.From(sender); err != nil {
+// SendWithUnsubscribe is Send for bulk mail, unsubscribeURL is advertised in
+// the List-Unsubscribe headers so mail clients can offer one-click
+// unsubscribing (RFC 8058)
+func (m *Mailer) SendWithUnsubscribe(sender, recipient, templateFile, unsubscribeURL string, data any) error {
+	// subject and plain text body are not HTML, they must not be escaped
+	textTmpl, err := tt.New("").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
 		return err
 	}
 
-	if err := msg.To(recipient); err != nil {
+	subject := new(bytes.Buffer)
+	if err := textTmpl.ExecuteTemplate(subject, "subject", data); err != nil {
 		return err
 	}
 
-	tmpl, err := template.New(templateFile).ParseFS(mailFS, "html/"+templateFile)
+	plainBody := new(bytes.Buffer)
+	if err := textTmpl.ExecuteTemplate(plainBody, "plainBody", data); err != nil {
+		return err
+	}
+
+	htmlTmpl, err := ht.New("").ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
 		return err
 	}
 
-	msg.Subject("Welcome to the forum!")
-	if err := msg.SetBodyHTMLTemplate(tmpl, data); err != nil {
+	htmlBody := new(bytes.Buffer)
+	if err := htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data); err != nil {
 		return err
 	}
 
-	for i := 1; i < 3; i++ {
-		err := m.Client.DialAndSend(msg)
+	msg := mail.NewMsg()
+
+	if err := msg.From(sender); err != nil {
+		return err
+	}
+
+	if err := msg.To(recipient); err != nil {
+		return err
+	}
+
+	msg.Subject(subject.String())
+	msg.SetBodyString(mail.TypeTextPlain, plainBody.String())
+	msg.AddAlternativeString(mail.TypeTextHTML, htmlBody.String())
+
+	if unsubscribeURL != "" {
+		msg.SetGenHeader(mail.Header("List-Unsubscribe"), "<"+unsubscribeURL+">")
+		msg.SetGenHeader(mail.Header("List-Unsubscribe-Post"), "List-Unsubscribe=One-Click")
+	}
+
+	for i := 1; i <= 3; i++ {
+		err = m.Client.DialAndSend(msg)
 		if nil == err {
 			return nil
-		} else {
-			time.Sleep(500 * time.Millisecond)
 		}
+		time.Sleep(500 * time.Millisecond)
 	}
 
 	return err
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Attachment is a file uploaded with a post, or with one of its comments
+// when CommentID is set. Images have their dimensions and a thumbnail.
+type Attachment struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	PostID      int       `json:"post_id"`
+	CommentID   int       `json:"comment_id,omitempty"`
+	StorageKey  string    `json:"-"`
+	ThumbKey    string    `json:"-"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+type AttachmentModel struct {
+	DB *sql.DB
+}
+
+const attachment_columns = `
+    a.id, a.user_id, a.post_id, coalesce(a.comment_id, 0), a.storage_key, a.thumb_key,
+    a.filename, a.content_type, a.size, a.width, a.height, a.created
+  `
+
+func scanAttachment(row interface{ Scan(...any) error }, attachment *Attachment) error {
+	return row.Scan(
+		&attachment.ID,
+		&attachment.UserID,
+		&attachment.PostID,
+		&attachment.CommentID,
+		&attachment.StorageKey,
+		&attachment.ThumbKey,
+		&attachment.Filename,
+		&attachment.ContentType,
+		&attachment.Size,
+		&attachment.Width,
+		&attachment.Height,
+		&attachment.Created,
+	)
+}
+
+// insertAttachments adds the attachments of a new post, or of a new comment
+// when comment_id is not 0, in the transaction that creates it
+func insertAttachments(ctx context.Context, tx *sql.Tx, user_id, post_id, comment_id int, attachments []*Attachment) error {
+	query := `
+    INSERT INTO attachments(user_id, post_id, comment_id, storage_key, thumb_key, filename, content_type, size, width, height)
+    VALUES($1, $2, NULLIF($3::int, 0), $4, $5, $6, $7, $8, $9, $10)
+    RETURNING id, created
+  `
+
+	for _, a := range attachments {
+		a.UserID, a.PostID, a.CommentID = user_id, post_id, comment_id
+		err := tx.QueryRowContext(ctx, query,
+			a.UserID,
+			a.PostID,
+			a.CommentID,
+			a.StorageKey,
+			a.ThumbKey,
+			a.Filename,
+			a.ContentType,
+			a.Size,
+			a.Width,
+			a.Height,
+		).Scan(&a.ID, &a.Created)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *AttachmentModel) Get(attachment_id int) (*Attachment, error) {
+	query := "SELECT " + attachment_columns + " FROM attachments AS a WHERE a.id = $1"
+
+	attachment := &Attachment{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := scanAttachment(m.DB.QueryRowContext(ctx, query, attachment_id), attachment)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+	return attachment, nil
+}
+
+// GetForPost lists the attachments of the post itself, not of its comments
+func (m *AttachmentModel) GetForPost(post_id int) ([]*Attachment, error) {
+	query := "SELECT " + attachment_columns + " FROM attachments AS a WHERE a.post_id = $1 AND a.comment_id IS NULL ORDER BY a.id"
+
+	attachments := []*Attachment{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, post_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attachment := &Attachment{}
+		if err := scanAttachment(rows, attachment); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// GetForComments returns the attachments of the comments keyed by comment ID,
+// comments without attachments are left out
+func (m *AttachmentModel) GetForComments(comment_ids []int) (map[int][]*Attachment, error) {
+	query := "SELECT " + attachment_columns + " FROM attachments AS a WHERE a.comment_id = ANY($1) ORDER BY a.id"
+
+	attachments := map[int][]*Attachment{}
+	if len(comment_ids) == 0 {
+		return attachments, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(comment_ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attachment := &Attachment{}
+		if err := scanAttachment(rows, attachment); err != nil {
+			return nil, err
+		}
+		attachments[attachment.CommentID] = append(attachments[attachment.CommentID], attachment)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// PurgeDeleted removes the attachments of posts and comments deleted before
+// the given time and returns their storage keys, thumbnails included, so the
+// files can be deleted as well
+func (m *AttachmentModel) PurgeDeleted(before time.Time) ([]string, error) {
+	query := `
+    DELETE FROM attachments AS a
+    WHERE (a.comment_id IS NULL AND a.post_id IN (SELECT id FROM posts WHERE deleted_at < $1))
+      OR a.comment_id IN (SELECT id FROM comments WHERE deleted_at < $1)
+    RETURNING a.storage_key, a.thumb_key
+  `
+
+	keys := []string{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, thumb string
+		if err := rows.Scan(&key, &thumb); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		if thumb != "" {
+			keys = append(keys, thumb)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,234 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Ban keeps a user from posting and commenting in a topic, or from using the
+// site at all when TopicID is 0. A zero Expires means the ban is permanent.
+type Ban struct {
+	ID           int       `json:"id"`
+	UserID       int       `json:"user_id"`
+	Username     string    `json:"username"`
+	TopicID      int       `json:"topic_id,omitempty"`
+	TopicName    string    `json:"topic_name,omitempty"`
+	BannedBy     int       `json:"-"`
+	BannedByName string    `json:"-"`
+	Reason       string    `json:"reason"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+}
+
+func (b *Ban) Permanent() bool {
+	return b.Expires.IsZero()
+}
+
+type BanModel struct {
+	DB *sql.DB
+}
+
+// active_ban matches the bans that are in force, the table is aliased as b
+const active_ban = "b.lifted_at IS NULL AND (b.expires_at IS NULL OR b.expires_at > now())"
+
+// userBanned reports whether the user is banned from the site or the topic
+func userBanned(ctx context.Context, tx *sql.Tx, user_id, topic_id int) (bool, error) {
+	query := `
+    SELECT EXISTS(
+      SELECT 1 FROM bans AS b
+      WHERE b.user_id = $1 AND (b.topic_id IS NULL OR b.topic_id = $2) AND ` + active_ban + `
+    )
+  `
+
+	var banned bool
+	err := tx.QueryRowContext(ctx, query, user_id, topic_id).Scan(&banned)
+	return banned, err
+}
+
+// Insert bans the user, replacing the ban they already have in the same
+// scope. Topic bans are added to the moderation log of the topic.
+func (m *BanModel) Insert(ban *Ban) error {
+	insert := `
+    INSERT INTO bans(user_id, topic_id, banned_by, reason, expires_at)
+    VALUES($1, NULLIF($2::int, 0), $3, $4, $5)
+    ON CONFLICT (user_id, (coalesce(topic_id, 0))) WHERE lifted_at IS NULL
+    DO UPDATE SET banned_by = EXCLUDED.banned_by, reason = EXCLUDED.reason, created = now(), expires_at = EXCLUDED.expires_at
+    RETURNING id
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, insert, ban.UserID, ban.TopicID, ban.BannedBy, ban.Reason, nullTime(ban.Expires)).Scan(&ban.ID)
+	if err != nil {
+		return err
+	}
+
+	if ban.TopicID > 0 {
+		err = logBan(ctx, tx, ModBan, ban.TopicID, ban.BannedBy, ban.BannedByName, ban.UserID, ban.Reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Lift ends the ban of the user in the topic, or the site-wide ban when
+// topic_id is 0
+func (m *BanModel) Lift(user_id, topic_id, moderator_id int, moderator_name string) error {
+	lift := "UPDATE bans SET lifted_at = now() WHERE user_id = $1 AND coalesce(topic_id, 0) = $2 AND lifted_at IS NULL"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, lift, user_id, topic_id)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rowsAffected == 0 {
+		return ErrNoRecordFound
+	}
+
+	if topic_id > 0 {
+		err = logBan(ctx, tx, ModUnban, topic_id, moderator_id, moderator_name, user_id, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func logBan(ctx context.Context, tx *sql.Tx, action string, topic_id, moderator_id int, moderator_name string, user_id int, reason string) error {
+	query := `
+    INSERT INTO moderation_log(topic_id, moderator_id, moderator_name, action, target_user_id, target_username, reason)
+    SELECT $1, $2, $3, $4, u.id, u.name, $6
+    FROM users AS u
+    WHERE u.id = $5
+  `
+
+	_, err := tx.ExecContext(ctx, query, topic_id, moderator_id, moderator_name, action, user_id, reason)
+	return err
+}
+
+// Active returns the ban in force for the user in the topic, a site-wide ban
+// takes precedence; topic_id 0 only looks for site-wide bans
+func (m *BanModel) Active(user_id, topic_id int) (*Ban, error) {
+	query := `
+    SELECT b.id, b.user_id, u.name, coalesce(b.topic_id, 0), coalesce(t.topic_name, ''), b.reason, b.created, b.expires_at
+    FROM bans AS b
+    JOIN users AS u ON b.user_id = u.id
+    LEFT JOIN topics AS t ON b.topic_id = t.id
+    WHERE b.user_id = $1 AND (b.topic_id IS NULL OR b.topic_id = $2) AND ` + active_ban + `
+    ORDER BY b.topic_id NULLS FIRST
+    LIMIT 1
+  `
+
+	ban := &Ban{}
+	var expires sql.NullTime
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user_id, topic_id).Scan(
+		&ban.ID,
+		&ban.UserID,
+		&ban.Username,
+		&ban.TopicID,
+		&ban.TopicName,
+		&ban.Reason,
+		&ban.Created,
+		&expires,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	ban.Expires = expires.Time
+	return ban, nil
+}
+
+// GetForTopic lists the bans in force in the topic, or the site-wide bans
+// when topic_id is 0
+func (m *BanModel) GetForTopic(topic_id int) ([]*Ban, error) {
+	return m.list("coalesce(b.topic_id, 0) = $1", topic_id)
+}
+
+// GetForUser lists the bans in force for the user in every topic
+func (m *BanModel) GetForUser(user_id int) ([]*Ban, error) {
+	return m.list("b.user_id = $1", user_id)
+}
+
+func (m *BanModel) list(filter string, arg int) ([]*Ban, error) {
+	query := `
+    SELECT b.id, b.user_id, u.name, coalesce(b.topic_id, 0), coalesce(t.topic_name, ''),
+      coalesce(b.banned_by, 0), coalesce(by_user.name, ''), b.reason, b.created, b.expires_at
+    FROM bans AS b
+    JOIN users AS u ON b.user_id = u.id
+    LEFT JOIN users AS by_user ON b.banned_by = by_user.id
+    LEFT JOIN topics AS t ON b.topic_id = t.id
+    WHERE ` + filter + ` AND ` + active_ban + `
+    ORDER BY b.created DESC, b.id DESC
+  `
+
+	bans := []*Ban{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ban := &Ban{}
+		var expires sql.NullTime
+		if err := rows.Scan(
+			&ban.ID,
+			&ban.UserID,
+			&ban.Username,
+			&ban.TopicID,
+			&ban.TopicName,
+			&ban.BannedBy,
+			&ban.BannedByName,
+			&ban.Reason,
+			&ban.Created,
+			&expires,
+		); err != nil {
+			return nil, err
+		}
+		ban.Expires = expires.Time
+		bans = append(bans, ban)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bans, nil
+}
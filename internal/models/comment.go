@@ -4,59 +4,103 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"html/template"
 	"log"
 	"time"
 
-	"github.com/emirpasic/gods/stacks/arraystack"
 	"github.com/lib/pq"
 )
 
 type Comment struct {
-	ID          int
-	UserID      int
-	Username    string
-	PostID      int
-	Likes       int
-	Created     time.Time
-	LastUpdated time.Time
-	Content     string
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	Username    string    `json:"username"`
+	PostID      int       `json:"post_id"`
+	Likes       int       `json:"likes"`
+	Created     time.Time `json:"created"`
+	LastUpdated time.Time `json:"last_updated"`
+	Content     string    `json:"content"`
+	Removed     bool      `json:"removed"`
+	Deleted     bool      `json:"deleted"`
+	// zero if the comment was never edited
+	Edited   time.Time `json:"edited"`
+	Revision int       `json:"revision"`
+	// how the user reading the comment voted on it, loaded by the handlers
+	Interaction Interaction `json:"-"`
+	// Content rendered from markdown, filled in by the handlers
+	ContentHTML template.HTML `json:"content_html,omitempty"`
 }
 
 type CommentNode struct {
-	ID           int
-	PostID       int
-	UserID       int
-	Username     string
-	Likes        int
-	Created      time.Time
-	LastUpdated  time.Time
-	Content      string
-	PathLength   int
-	Ancestor     int
-	Descendant   int
-	Breadcrumbs  string
-	CommentNodes []*CommentNode
+	ID           int            `json:"id"`
+	PostID       int            `json:"post_id"`
+	ParentID     int            `json:"parent_id,omitempty"`
+	UserID       int            `json:"user_id"`
+	Username     string         `json:"username"`
+	Likes        int            `json:"likes"`
+	Controversy  float64        `json:"-"`
+	Created      time.Time      `json:"created"`
+	LastUpdated  time.Time      `json:"last_updated"`
+	Content      string         `json:"content"`
+	PathLength   int            `json:"depth"`
+	Removed      bool           `json:"removed"`
+	Deleted      bool           `json:"deleted"`
+	Edited       time.Time      `json:"edited"`
+	Revision     int            `json:"revision"`
+	ContentHTML  template.HTML  `json:"content_html,omitempty"`
+	Attachments  []*Attachment  `json:"attachments,omitempty"`
+	CommentNodes []*CommentNode `json:"replies,omitempty"`
+	// number of direct replies left out by the ThreadOptions cutoffs, they
+	// can be fetched with GetSubtree rooted at this comment
+	HiddenReplies int `json:"hidden_replies,omitempty"`
+	// number of direct replies, loaded or not
+	replies int
+	// how the user reading the comment voted on it, loaded by the handlers
+	Interaction Interaction `json:"-"`
+}
+
+// ThreadOptions limits how much of a comment tree is loaded at once; zero
+// values mean no limit. ShowHidden keeps the content and authors of removed
+// and deleted comments, for the moderators of the topic.
+type ThreadOptions struct {
+	MaxDepth   int
+	MaxReplies int
+	ShowHidden bool
 }
 
 type CommentModel struct {
 	DB *sql.DB
+	// new comments and like counts are published to the live readers
+	Events Publisher
 }
 
 func (m *CommentModel) Get(comment_id int) (*Comment, error) {
-	query := "SELECT user_id, post_id, likes, created, last_updated, content FROM comments WHERE id = $1"
+	query := `
+    SELECT id, user_id, username, post_id, likes, created, last_updated, content, removed_at IS NOT NULL, deleted_at IS NOT NULL, edited_at, revision
+    FROM comments
+    WHERE id = $1
+  `
 
 	comment := &Comment{}
+	var edited sql.NullTime
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, comment_id).Scan(
+		&comment.ID,
 		&comment.UserID,
+		&comment.Username,
 		&comment.PostID,
 		&comment.Likes,
 		&comment.Created,
 		&comment.LastUpdated,
 		&comment.Content,
+		&comment.Removed,
+		&comment.Deleted,
+		&edited,
+		&comment.Revision,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -65,71 +109,236 @@ func (m *CommentModel) Get(comment_id int) (*Comment, error) {
 		return nil, err
 	}
 
+	comment.Edited = edited.Time
+
 	return comment, nil
 }
 
-func (m *CommentModel) GetForPost(post_id int) ([]*CommentNode, error) {
-	tlc := `
-    SELECT c.id
-    FROM comments AS c
-    WHERE c.post_id = $1 AND NOT EXISTS (
-      SELECT 1
+// comment_tree selects the comments below the ancestors in $1 together with
+// their direct parent and number of direct replies; $2 is the depth of the
+// ancestors within their thread. The tree stops $4 levels below the
+// ancestors and, from level $6 down, at the first $5 replies of every
+// comment in the sibling order formatted in; a zero $4 or $5 does not limit.
+// Parents come before their replies, which are in that order. Removed and
+// deleted comments stay in the tree to keep their replies but lose their
+// content, and deleted ones their author, unless $3 is true.
+const comment_tree = `
+    WITH tree AS (
+      SELECT c.id, c.post_id, c.user_id, c.username, c.likes, c.controversy, c.created, c.last_updated, c.content,
+        c.removed_at, c.deleted_at, c.edited_at, c.revision, p.path_length, COALESCE(parent.ancestor, 0) AS parent_id,
+        row_number() OVER (PARTITION BY parent.ancestor ORDER BY %s) AS sibling
       FROM comments_paths AS p
-      WHERE p.descendant = c.id AND p.path_length > 0
+      JOIN comments AS c ON c.id = p.descendant
+      LEFT JOIN comments_paths AS parent ON parent.descendant = c.id AND parent.path_length = 1
+      WHERE p.ancestor = ANY($1) AND ($4 = 0 OR p.path_length <= $4)
     )
-  `
-	all_comments := `
     SELECT
-      c.id, c.post_id, c.user_id, c.username, c.likes, c.created, c.last_updated, c.content,
-      p.path_length, p.ancestor, p.descendant, string_agg(crumbs.ancestor::varchar, ',') AS breadcrumbs
-    FROM comments AS c
-    JOIN comments_paths AS p ON c.id = p.descendant
-    JOIN comments_paths AS crumbs ON crumbs.descendant = p.descendant
-    WHERE p.ancestor = ANY($1)
-    GROUP BY c.id, p.path_length, p.ancestor, p.descendant
-    ORDER BY breadcrumbs;
+      t.id, t.post_id, t.parent_id,
+      CASE WHEN t.deleted_at IS NULL OR $3 THEN t.user_id ELSE 0 END,
+      CASE WHEN t.deleted_at IS NULL OR $3 THEN t.username ELSE '[deleted]' END,
+      t.likes, t.controversy, t.created, t.last_updated,
+      CASE WHEN (t.removed_at IS NULL AND t.deleted_at IS NULL) OR $3 THEN t.content ELSE '' END,
+      t.path_length + $2, t.removed_at IS NOT NULL, t.deleted_at IS NOT NULL, t.edited_at, t.revision,
+      (SELECT count(*) FROM comments_paths AS r WHERE r.ancestor = t.id AND r.path_length = 1)
+    FROM tree AS t
+    WHERE $5 = 0 OR NOT EXISTS (
+      -- the comment or one of its ancestors is beyond the replies shown
+      SELECT 1
+      FROM comments_paths AS up
+      JOIN tree AS cut ON cut.id = up.ancestor
+      WHERE up.descendant = t.id AND cut.path_length >= $6 AND cut.sibling > $5
+    )
+    ORDER BY t.path_length, t.sibling
   `
 
-	tlc_ids := []int{}
+// siblingOrder is the SQL order of the replies of a comment for sort
+func siblingOrder(sort string) string {
+	switch sort {
+	case SortNew:
+		return "c.created DESC, c.id DESC"
+	case SortOld:
+		return "c.created, c.id"
+	case SortControversial:
+		return "c.controversy DESC, c.id DESC"
+	default:
+		return "c.likes DESC, c.id DESC"
+	}
+}
+
+// GetForPost returns one page of top-level comments of a post with their
+// replies; page.Sort orders the siblings at every depth of the tree and only
+// the top-level comments are paginated
+func (m *CommentModel) GetForPost(post_id int, page PageRequest, opts ThreadOptions) ([]*CommentNode, Page, error) {
+	cond, order, args, backwards, err := page.keyset("c", 2)
+	if err != nil {
+		return nil, Page{}, err
+	}
+
+	tlc := fmt.Sprintf(`
+    SELECT c.id, c.likes, c.created, c.controversy
+    FROM (
+      SELECT c.id, c.likes, c.created, c.controversy
+      FROM comments AS c
+      WHERE c.post_id = $1 AND NOT EXISTS (
+        SELECT 1
+        FROM comments_paths AS p
+        WHERE p.descendant = c.id AND p.path_length > 0
+      )
+    ) AS c
+    WHERE %s
+    ORDER BY %s
+    LIMIT %d
+  `, cond, order, page.Limit+1)
+
+	roots := []cursor{}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	tx, err := m.DB.BeginTx(ctx, nil)
-	defer tx.Rollback()
 	if err != nil {
-		return nil, err
+		return nil, Page{}, err
 	}
+	defer tx.Rollback()
 
-	rows, err := tx.QueryContext(ctx, tlc, post_id)
+	rows, err := tx.QueryContext(ctx, tlc, append([]any{post_id}, args...)...)
 	if err != nil {
-		return nil, err
+		return nil, Page{}, err
 	}
 
 	for rows.Next() {
-		var id int
-		if err := rows.Scan(&id); err != nil {
-			return nil, err
+		var root cursor
+		if err := rows.Scan(&root.ID, &root.Likes, &root.Created, &root.Score); err != nil {
+			return nil, Page{}, err
 		}
-		tlc_ids = append(tlc_ids, id)
+		roots = append(roots, root)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Page{}, err
 	}
 
+	roots, metadata := paginate(page, roots, backwards, func(c cursor) cursor { return c })
+
 	// check for no comments on the post
-	if len(tlc_ids) == 0 {
-		return nil, ErrNoCommentsForPost
+	if len(roots) == 0 {
+		return nil, metadata, ErrNoCommentsForPost
+	}
+
+	tlc_ids := make([]int, len(roots))
+	for i := range roots {
+		tlc_ids[i] = roots[i].ID
+	}
+
+	nodes, err := m.loadTree(ctx, tx, tlc_ids, 0, page.Sort, opts, 1)
+	if err != nil {
+		return nil, Page{}, err
 	}
 
-	rows, err = tx.QueryContext(ctx, all_comments, pq.Array(tlc_ids))
+	// keep the top-level comments in page order
+	topLevelComments := make([]*CommentNode, 0, len(tlc_ids))
+	for _, id := range tlc_ids {
+		if node, ok := nodes[id]; ok {
+			topLevelComments = append(topLevelComments, node)
+		}
+	}
+
+	return topLevelComments, metadata, tx.Commit()
+}
+
+// GetSubtree returns a comment with all of its replies sorted by sort. Every
+// direct reply is included, opts only applies further down the tree.
+func (m *CommentModel) GetSubtree(comment_id int, sort string, opts ThreadOptions) (*CommentNode, error) {
+	depth := "SELECT COALESCE(max(path_length), 0) FROM comments_paths WHERE descendant = $1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	topLevelComments, err := deserialize(rows)
+	var base_depth int
+	if err := tx.QueryRowContext(ctx, depth, comment_id).Scan(&base_depth); err != nil {
+		return nil, err
+	}
+
+	// every direct reply of the root is shown
+	nodes, err := m.loadTree(ctx, tx, []int{comment_id}, base_depth, sort, opts, 2)
 	if err != nil {
 		return nil, err
 	}
 
-	return topLevelComments, nil
+	root, ok := nodes[comment_id]
+	if !ok {
+		return nil, ErrNoRecordFound
+	}
+
+	return root, tx.Commit()
+}
+
+// loadTree reads the trees below ancestor_ids within the cutoffs of opts,
+// the number of replies of a comment is only limited from breadth_level
+// down. It links every comment to its parent, with the replies in the order
+// of sort, and returns all comments by ID.
+func (m *CommentModel) loadTree(ctx context.Context, tx *sql.Tx, ancestor_ids []int, base_depth int, sort string, opts ThreadOptions, breadth_level int) (map[int]*CommentNode, error) {
+	query := fmt.Sprintf(comment_tree, siblingOrder(sort))
+
+	rows, err := tx.QueryContext(ctx, query, pq.Array(ancestor_ids), base_depth, opts.ShowHidden, opts.MaxDepth, opts.MaxReplies, breadth_level)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := map[int]*CommentNode{}
+	ordered := []*CommentNode{}
+
+	for rows.Next() {
+		row := &CommentNode{}
+		var edited sql.NullTime
+		if err := rows.Scan(
+			&row.ID,
+			&row.PostID,
+			&row.ParentID,
+			&row.UserID,
+			&row.Username,
+			&row.Likes,
+			&row.Controversy,
+			&row.Created,
+			&row.LastUpdated,
+			&row.Content,
+			&row.PathLength,
+			&row.Removed,
+			&row.Deleted,
+			&edited,
+			&row.Revision,
+			&row.replies,
+		); err != nil {
+			return nil, err
+		}
+		row.Edited = edited.Time
+		nodes[row.ID] = row
+		ordered = append(ordered, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, node := range ordered {
+		if parent, ok := nodes[node.ParentID]; ok {
+			parent.CommentNodes = append(parent.CommentNodes, node)
+		}
+	}
+
+	// the replies the cutoffs left out are loaded on demand
+	for _, node := range ordered {
+		node.HiddenReplies = node.replies - len(node.CommentNodes)
+	}
+
+	return nodes, nil
 }
 
 func (m *CommentModel) GetForUser(user_id int) ([]*Comment, error) {
@@ -171,7 +380,10 @@ func (m *CommentModel) GetForUser(user_id int) ([]*Comment, error) {
 	return comments, nil
 }
 
-func (m *CommentModel) Insert(user_id, post_id, parent_id int, username, content string) (int, error) {
+// Insert adds a reply to the comment parent_id of the post, or a top-level
+// comment when it is 0; attachments are the files already put in the storage
+func (m *CommentModel) Insert(user_id, post_id, parent_id int, username, content string, attachments []*Attachment) (int, error) {
+	locked := "SELECT locked, topic_id FROM posts WHERE id = $1 AND deleted_at IS NULL FOR SHARE"
 	insert_comment := "INSERT INTO comments(user_id, username, post_id, content) VALUES($1, $2, $3, $4) RETURNING id"
 	insert_path := `
     INSERT INTO comments_paths(ancestor, descendant, path_length)
@@ -182,7 +394,7 @@ func (m *CommentModel) Insert(user_id, post_id, parent_id int, username, content
       SELECT $1::int, $1::int, 0
   `
 	like := "INSERT INTO comments_liked(comment_id, user_id, score) VALUES($1, $2, 1)"
-	increment := "UPDATE posts SET num_comments = num_comments + 1 WHERE id = $1"
+	increment := "UPDATE posts SET num_comments = num_comments + 1 WHERE id = $1 RETURNING num_comments"
 
 	var comment_id int
 
@@ -195,11 +407,38 @@ func (m *CommentModel) Insert(user_id, post_id, parent_id int, username, content
 		return -1, err
 	}
 
+	// the row lock keeps a moderator from locking the post until the comment is in
+	var is_locked bool
+	var topic_id int
+	if err := tx.QueryRowContext(ctx, locked, post_id).Scan(&is_locked, &topic_id); errors.Is(err, sql.ErrNoRows) {
+		return -1, ErrNoRecordFound
+	} else if err != nil {
+		return -1, err
+	} else if is_locked {
+		return -1, ErrPostLocked
+	}
+
+	if banned, err := userBanned(ctx, tx, user_id, topic_id); err != nil {
+		return -1, err
+	} else if banned {
+		return -1, ErrBanned
+	}
+
 	err = tx.QueryRowContext(ctx, insert_comment, user_id, username, post_id, content).Scan(&comment_id)
 	if err != nil {
 		return -1, err
 	}
 
+	err = addCommentRevision(ctx, tx, comment_id, 1, content)
+	if err != nil {
+		return -1, err
+	}
+
+	err = insertAttachments(ctx, tx, user_id, post_id, comment_id, attachments)
+	if err != nil {
+		return -1, err
+	}
+
 	_, err = tx.ExecContext(ctx, insert_path, comment_id, parent_id)
 	if err != nil {
 		var pqerror *pq.Error
@@ -215,7 +454,13 @@ func (m *CommentModel) Insert(user_id, post_id, parent_id int, username, content
 		return -1, err
 	}
 
-	_, err = tx.ExecContext(ctx, increment, post_id)
+	var num_comments int
+	err = tx.QueryRowContext(ctx, increment, post_id).Scan(&num_comments)
+	if err != nil {
+		return -1, err
+	}
+
+	err = notifyComment(ctx, tx, user_id, username, post_id, parent_id, comment_id, content)
 	if err != nil {
 		return -1, err
 	}
@@ -225,16 +470,21 @@ func (m *CommentModel) Insert(user_id, post_id, parent_id int, username, content
 		return -1, err
 	}
 
+	publish(m.Events, Event{
+		Kind:        EventComment,
+		TopicID:     topic_id,
+		PostID:      post_id,
+		CommentID:   comment_id,
+		NumComments: num_comments,
+	})
+
 	return comment_id, nil
 }
 
-func (m *CommentModel) Delete(comment_id int) error {
-	post := "SELECT post_id FROM comments WHERE id = $1"
-	remove_path := `
-    DELETE t1 FROM comments_paths AS t1
-    JOIN comments_paths AS t2 ON t1.descendant = t2.descendant
-    WHERE t2.ancestor = $1
-  `
+// Delete marks the comment as deleted by user_id. The comment stays in the
+// closure table so its replies keep their place in the thread.
+func (m *CommentModel) Delete(user_id, comment_id int) error {
+	remove := "UPDATE comments SET deleted_at = now(), deleted_by = $2 WHERE id = $1 AND deleted_at IS NULL RETURNING post_id"
 	decrement := "UPDATE posts SET num_comments = num_comments - 1 WHERE id = $1"
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -247,53 +497,133 @@ func (m *CommentModel) Delete(comment_id int) error {
 	}
 
 	var post_id int
-	if err := tx.QueryRowContext(ctx, post, comment_id).Scan(&post_id); errors.Is(err, sql.ErrNoRows) {
+	if err := tx.QueryRowContext(ctx, remove, comment_id, user_id).Scan(&post_id); errors.Is(err, sql.ErrNoRows) {
 		return ErrNoRecordFound
 	} else if err != nil {
 		return err
-	} else {
-		_, err := tx.ExecContext(ctx, remove_path, comment_id)
-		if err != nil {
-			return err
-		}
+	}
 
-		_, err = tx.ExecContext(ctx, decrement, post_id)
-		if err != nil {
-			return err
-		}
+	_, err = tx.ExecContext(ctx, decrement, post_id)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
+// PurgeDeleted erases the content and revisions of the comments deleted
+// before the given time, the tombstones are kept for the replies below them
+func (m *CommentModel) PurgeDeleted(before time.Time) (int64, error) {
+	revisions := `
+    DELETE FROM comment_revisions
+    WHERE comment_id IN (SELECT id FROM comments WHERE deleted_at < $1 AND NOT purged)
+  `
+	query := `
+    UPDATE comments SET content = '', purged = true
+    WHERE deleted_at < $1 AND NOT purged
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, revisions, before)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, tx.Commit()
+}
+
+// Update changes the content of the comment and keeps the new version in
+// its revisions
 func (m *CommentModel) Update(comment *Comment) error {
-	query := "UPDATE comments SET content = $1 WHERE id = $2"
+	query := `
+    UPDATE comments SET content = $1, last_updated = now(), edited_at = now(), revision = revision + 1
+    WHERE id = $2 AND deleted_at IS NULL
+    RETURNING last_updated, edited_at, revision
+  `
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, comment.Content, comment.ID)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	if rowsAffected, err := result.RowsAffected(); rowsAffected == 0 {
-		return ErrNoRecordFound
-	} else if err != nil {
+	err = tx.QueryRowContext(ctx, query, comment.Content, comment.ID).Scan(&comment.LastUpdated, &comment.Edited, &comment.Revision)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNoRecordFound
+		default:
+			return err
+		}
+	}
+
+	err = addCommentRevision(ctx, tx, comment.ID, comment.Revision, comment.Content)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
+}
+
+// commentLikes reads the score of the comment after a like or dislike
+func commentLikes(ctx context.Context, tx *sql.Tx, comment_id int) (Event, error) {
+	query := `
+    SELECT c.likes, c.post_id, p.topic_id
+    FROM comments AS c JOIN posts AS p ON c.post_id = p.id
+    WHERE c.id = $1
+  `
+
+	event := Event{Kind: EventLikes, CommentID: comment_id}
+	err := tx.QueryRowContext(ctx, query, comment_id).Scan(&event.Likes, &event.PostID, &event.TopicID)
+	return event, err
+}
+
+// countVote adds ups and downs to the votes of a comment and recomputes its
+// likes and controversy, see migration 000008
+func countVote(ctx context.Context, tx *sql.Tx, comment_id, ups, downs int) error {
+	query := `
+    UPDATE comments AS c SET
+      ups = v.ups,
+      downs = v.downs,
+      likes = c.likes + $2 - $3,
+      controversy = CASE WHEN v.ups = 0 OR v.downs = 0 THEN 0
+        ELSE power(v.ups + v.downs, LEAST(v.ups, v.downs)::float / GREATEST(v.ups, v.downs))
+      END
+    FROM (SELECT id, ups + $2 AS ups, downs + $3 AS downs FROM comments WHERE id = $1) AS v
+    WHERE c.id = v.id
+  `
+
+	_, err := tx.ExecContext(ctx, query, comment_id, ups, downs)
+	return err
 }
 
 func (m *CommentModel) Like(user_id, comment_id int) error {
 	exists := "SELECT score FROM comments_liked WHERE user_id = $1 AND comment_id = $2"
 	like := "INSERT INTO comments_liked(user_id, comment_id, score) VALUES($1, $2, 1)"
-	increment_on_insert := "UPDATE comments SET likes = likes + 1 WHERE id = $1"
 
 	// from dislike to like
 	update := "UPDATE comments_liked SET score = 1 WHERE user_id = $1 AND comment_id = $2"
-	increment_on_update := "UPDATE comments SET likes = likes + 2 WHERE id = $1"
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -312,7 +642,7 @@ func (m *CommentModel) Like(user_id, comment_id int) error {
 				return err
 			}
 
-			if _, err := tx.ExecContext(ctx, increment_on_insert, comment_id); err != nil {
+			if err := countVote(ctx, tx, comment_id, 1, 0); err != nil {
 				return err
 			}
 		} else {
@@ -326,22 +656,31 @@ func (m *CommentModel) Like(user_id, comment_id int) error {
 			return err
 		}
 
-		if _, err := tx.ExecContext(ctx, increment_on_update, comment_id); err != nil {
+		if err := countVote(ctx, tx, comment_id, 1, -1); err != nil {
 			return err
 		}
 	}
 
-	return tx.Commit()
+	event, err := commentLikes(ctx, tx, comment_id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	publish(m.Events, event)
+	return nil
 }
 
 func (m *CommentModel) Dislike(user_id, comment_id int) error {
 	exists := "SELECT score FROM comments_liked WHERE user_id = $1 AND comment_id = $2"
 	dislike := "INSERT INTO comments_liked(user_id, comment_id, score) VALUES($1, $2, -1)"
-	decrement_on_insert := "UPDATE comments SET likes = likes - 1 WHERE id = $1"
 
 	// from like to dislike
 	update := "UPDATE comments_liked SET score = -1 WHERE user_id = $1 AND comment_id = $2"
-	decrement_on_dislike := "UPDATE comments SET likes = likes - 2 WHERE id = $1"
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -361,7 +700,7 @@ func (m *CommentModel) Dislike(user_id, comment_id int) error {
 				return err
 			}
 
-			if _, err := tx.ExecContext(ctx, decrement_on_insert, comment_id); err != nil {
+			if err := countVote(ctx, tx, comment_id, 0, 1); err != nil {
 				return err
 			}
 		} else {
@@ -375,13 +714,110 @@ func (m *CommentModel) Dislike(user_id, comment_id int) error {
 			return err
 		}
 
-		if _, err := tx.ExecContext(ctx, decrement_on_dislike, comment_id); err != nil {
+		if err := countVote(ctx, tx, comment_id, -1, 1); err != nil {
 			return err
 		}
 	}
 
 	// if the user has currently disliked the comment, no action needed
-	return tx.Commit()
+	event, err := commentLikes(ctx, tx, comment_id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	publish(m.Events, event)
+	return nil
+}
+
+// Unvote takes back the like or dislike of the user
+func (m *CommentModel) Unvote(user_id, comment_id int) error {
+	remove := "DELETE FROM comments_liked WHERE user_id = $1 AND comment_id = $2 RETURNING score"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var score int
+	err = tx.QueryRowContext(ctx, remove, user_id, comment_id).Scan(&score)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// the user never voted, nothing to take back
+			return nil
+		default:
+			return err
+		}
+	}
+
+	if score == 1 {
+		err = countVote(ctx, tx, comment_id, -1, 0)
+	} else {
+		err = countVote(ctx, tx, comment_id, 0, -1)
+	}
+	if err != nil {
+		return err
+	}
+
+	event, err := commentLikes(ctx, tx, comment_id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	publish(m.Events, event)
+	return nil
+}
+
+// Interactions returns how the user voted on the comments and whether they
+// saved them, comments they did neither to are left out
+func (m *CommentModel) Interactions(user_id int, comment_ids []int) (map[int]Interaction, error) {
+	query := `
+    SELECT c.id, coalesce(l.score, 0), s.comment_id IS NOT NULL
+    FROM unnest($2::int[]) AS c(id)
+    LEFT JOIN comments_liked AS l ON l.comment_id = c.id AND l.user_id = $1
+    LEFT JOIN comments_saved AS s ON s.comment_id = c.id AND s.user_id = $1
+    WHERE l.comment_id IS NOT NULL OR s.comment_id IS NOT NULL
+  `
+
+	interactions := map[int]Interaction{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, user_id, pq.Array(comment_ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var comment_id int
+		var interaction Interaction
+		if err := rows.Scan(&comment_id, &interaction.Score, &interaction.Saved); err != nil {
+			return nil, err
+		}
+		interactions[comment_id] = interaction
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return interactions, nil
 }
 
 func (m *CommentModel) Save(user_id, comment_id int) error {
@@ -437,71 +873,3 @@ func (m *CommentModel) Unsave(user_id, comment_id int) error {
 
 	return tx.Commit()
 }
-
-func deserialize(rows *sql.Rows) ([]*CommentNode, error) {
-	topLevelComments := []*CommentNode{}
-	stack := arraystack.New()
-	var currentPathLength int
-
-	for rows.Next() {
-		row := &CommentNode{}
-		if err := rows.Scan(
-			&row.ID,
-			&row.PostID,
-			&row.UserID,
-			&row.Username,
-			&row.Likes,
-			&row.Created,
-			&row.LastUpdated,
-			&row.Content,
-			&row.PathLength,
-			&row.Ancestor,
-			&row.Descendant,
-			&row.Breadcrumbs,
-		); err != nil {
-			log.Fatal(err)
-		}
-
-		// pathLength of 0 means it is a root comment
-		if row.PathLength == 0 {
-			currentPathLength = 0
-			topLevelComments = append(topLevelComments, row)
-
-			// the SQL query returns a root then all of its children, then another root and its children, etc.
-			// clear the stack upon reaching a new root
-			stack.Clear()
-			stack.Push(row)
-
-			// new sibling after sibling
-		} else if row.PathLength == currentPathLength {
-			// pop the current node, which is the sibling
-			temp, _ := stack.Pop()
-			parent := temp.(*CommentNode)
-			parent.CommentNodes = append(parent.CommentNodes, row)
-			stack.Push(row)
-			// children
-		} else if row.PathLength > currentPathLength {
-			currentPathLength += 1
-			temp, _ := stack.Peek()
-			current := temp.(*CommentNode)
-			current.CommentNodes = append(current.CommentNodes, row)
-			stack.Push(row)
-			// new parent after child
-		} else if row.PathLength < currentPathLength {
-			currentPathLength -= 1
-			// pop the sibling's child and the sibling
-			_, _ = stack.Pop()
-			_, _ = stack.Pop()
-			temp, _ := stack.Peek()
-			ancestor := temp.(*CommentNode)
-			ancestor.CommentNodes = append(ancestor.CommentNodes, row)
-			stack.Push(row)
-		}
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return topLevelComments, nil
-}
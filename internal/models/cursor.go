@@ -0,0 +1,231 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// sort orders supported by keyset pagination, every order is broken by id so
+// that a cursor always identifies exactly one row
+const (
+	SortNew = "new" // created DESC, id DESC
+	SortOld = "old" // created ASC, id ASC
+	SortTop = "top" // likes DESC, id DESC
+
+	// posts only, the scores are refreshed periodically by RefreshScores
+	SortHot    = "hot"    // hot DESC, id DESC
+	SortRising = "rising" // rising DESC, id DESC
+
+	// comments only, the controversy is kept by the votes, see countVote
+	SortControversial = "controversial" // controversy DESC, id DESC
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// time windows restricting a listing to recently created rows, mostly useful
+// together with SortTop
+const (
+	WindowHour  = "hour"
+	WindowDay   = "day"
+	WindowWeek  = "week"
+	WindowMonth = "month"
+	WindowYear  = "year"
+	WindowAll   = "all"
+)
+
+var windowIntervals = map[string]string{
+	WindowHour:  "1 hour",
+	WindowDay:   "1 day",
+	WindowWeek:  "7 days",
+	WindowMonth: "1 month",
+	WindowYear:  "1 year",
+}
+
+var Windows = []string{WindowHour, WindowDay, WindowWeek, WindowMonth, WindowYear, WindowAll}
+
+// PageRequest asks for the page following After or preceding Before; both are
+// opaque cursors previously returned in a Page
+type PageRequest struct {
+	Sort   string
+	Window string
+	After  string
+	Before string
+	Limit  int
+}
+
+type Page struct {
+	Sort   string `json:"sort"`
+	Window string `json:"window,omitempty"`
+	Limit  int    `json:"limit"`
+	Next   string `json:"next,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+}
+
+type cursor struct {
+	Sort    string    `json:"s"`
+	Created time.Time `json:"c"`
+	Likes   int       `json:"l"`
+	Score   float64   `json:"v,omitempty"`
+	ID      int       `json:"i"`
+}
+
+func encodeCursor(c cursor) string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(token, sort string) (cursor, error) {
+	var c cursor
+
+	js, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	if err := json.Unmarshal(js, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	// a cursor is only meaningful for the order it was created with
+	if c.Sort != sort {
+		return c, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+func (p *PageRequest) normalize() {
+	if p.Sort == "" {
+		p.Sort = SortNew
+	}
+	if p.Limit < 1 {
+		p.Limit = DefaultPageSize
+	}
+	p.Limit = min(p.Limit, MaxPageSize)
+}
+
+// keyset returns the condition and ORDER BY clause selecting the requested
+// page from the table aliased as alias; n is the number of the first free
+// placeholder. When backwards is true the rows come back in reverse order
+// and paginate will flip them.
+func (p *PageRequest) keyset(alias string, n int) (cond, order string, args []any, backwards bool, err error) {
+	p.normalize()
+
+	var column string
+	var desc bool
+	switch p.Sort {
+	case SortNew:
+		column, desc = "created", true
+	case SortOld:
+		column, desc = "created", false
+	case SortTop:
+		column, desc = "likes", true
+	case SortControversial:
+		column, desc = "controversy", true
+	case SortHot:
+		column, desc = "hot", true
+	case SortRising:
+		column, desc = "rising", true
+	default:
+		return "", "", nil, false, ErrInvalidSort
+	}
+
+	token := p.After
+	if p.Before != "" {
+		token = p.Before
+		backwards = true
+	}
+
+	// walking backwards reverses the direction of the scan
+	if backwards {
+		desc = !desc
+	}
+
+	comparator, direction := ">", "ASC"
+	if desc {
+		comparator, direction = "<", "DESC"
+	}
+
+	order = fmt.Sprintf("%[1]s.%[2]s %[3]s, %[1]s.id %[3]s", alias, column, direction)
+
+	if token == "" {
+		return "TRUE", order, nil, backwards, nil
+	}
+
+	c, err := decodeCursor(token, p.Sort)
+	if err != nil {
+		return "", "", nil, false, err
+	}
+
+	cond = fmt.Sprintf("(%[1]s.%[2]s, %[1]s.id) %[3]s ($%[4]d, $%[5]d)", alias, column, comparator, n, n+1)
+	switch column {
+	case "likes":
+		args = []any{c.Likes, c.ID}
+	case "controversy", "hot", "rising":
+		args = []any{c.Score, c.ID}
+	default:
+		args = []any{c.Created, c.ID}
+	}
+
+	return cond, order, args, backwards, nil
+}
+
+// window returns the condition restricting the table aliased as alias to
+// rows created within the requested window
+func (p *PageRequest) window(alias string) (string, error) {
+	if p.Window == "" || p.Window == WindowAll {
+		return "TRUE", nil
+	}
+
+	interval, ok := windowIntervals[p.Window]
+	if !ok {
+		return "", ErrInvalidWindow
+	}
+
+	return fmt.Sprintf("%s.created >= now() - interval '%s'", alias, interval), nil
+}
+
+// paginate trims the extra row fetched to detect a further page, restores the
+// display order and builds the cursors pointing to the neighbouring pages
+func paginate[T any](p PageRequest, rows []T, backwards bool, key func(T) cursor) ([]T, Page) {
+	page := Page{Sort: p.Sort, Window: p.Window, Limit: p.Limit}
+
+	more := len(rows) > p.Limit
+	if more {
+		rows = rows[:p.Limit]
+	}
+
+	if backwards {
+		slices.Reverse(rows)
+	}
+
+	if len(rows) == 0 {
+		return rows, page
+	}
+
+	first, last := key(rows[0]), key(rows[len(rows)-1])
+	first.Sort, last.Sort = p.Sort, p.Sort
+
+	hasNext, hasPrev := more, p.After != ""
+	if backwards {
+		hasNext, hasPrev = true, more
+	}
+
+	if hasNext {
+		page.Next = encodeCursor(last)
+	}
+	if hasPrev {
+		page.Prev = encodeCursor(first)
+	}
+
+	return rows, page
+}
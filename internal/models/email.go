@@ -0,0 +1,263 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// how often a user receives a digest of the topics they are subscribed to
+const (
+	DigestOff    = "off"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+var DigestFrequencies = []string{DigestOff, DigestDaily, DigestWeekly}
+
+type EmailPreferences struct {
+	UserID   int    `json:"-"`
+	Replies  bool   `json:"replies"`
+	Mentions bool   `json:"mentions"`
+	Digest   string `json:"digest"`
+}
+
+// NotificationEmail is a notification claimed by ClaimEmails along with what
+// is needed to write the email; Send is false when the recipient opted out
+type NotificationEmail struct {
+	Notification
+	Username string
+	Email    string
+	Excerpt  string
+	Send     bool
+}
+
+// DigestRecipient is a user whose digest is due, Since is when they received
+// their previous digest
+type DigestRecipient struct {
+	UserID int
+	Name   string
+	Email  string
+	Digest string
+	Since  time.Time
+}
+
+func (m *UserModel) GetEmailPreferences(user_id int) (*EmailPreferences, error) {
+	query := "SELECT id, email_replies, email_mentions, email_digest FROM users WHERE id = $1"
+
+	prefs := &EmailPreferences{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user_id).Scan(
+		&prefs.UserID,
+		&prefs.Replies,
+		&prefs.Mentions,
+		&prefs.Digest,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return prefs, nil
+}
+
+func (m *UserModel) UpdateEmailPreferences(prefs *EmailPreferences) error {
+	// the digest window starts when digests are switched on, not at sign up
+	query := `
+    UPDATE users SET
+      email_replies = $1,
+      email_mentions = $2,
+      last_digest_at = CASE WHEN email_digest = 'off' AND $3 <> 'off' THEN now() ELSE last_digest_at END,
+      email_digest = $3
+    WHERE id = $4
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, prefs.Replies, prefs.Mentions, prefs.Digest, prefs.UserID)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, err := result.RowsAffected(); rowsAffected == 0 {
+		return ErrNoRecordFound
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ClaimDigests returns up to limit users whose daily or weekly digest is due
+// and moves their digest window forward, so each digest is claimed once even
+// with several workers running
+func (m *UserModel) ClaimDigests(limit int) ([]*DigestRecipient, error) {
+	query := `
+    WITH due AS (
+      SELECT id, last_digest_at FROM users
+      WHERE activated AND (
+        (email_digest = 'daily' AND last_digest_at <= now() - interval '1 day') OR
+        (email_digest = 'weekly' AND last_digest_at <= now() - interval '7 days')
+      )
+      ORDER BY id
+      LIMIT $1
+      FOR UPDATE SKIP LOCKED
+    )
+    UPDATE users AS u SET last_digest_at = now()
+    FROM due
+    WHERE u.id = due.id
+    RETURNING u.id, u.name, u.email, u.email_digest, due.last_digest_at
+  `
+
+	recipients := []*DigestRecipient{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		recipient := &DigestRecipient{}
+		if err := rows.Scan(
+			&recipient.UserID,
+			&recipient.Name,
+			&recipient.Email,
+			&recipient.Digest,
+			&recipient.Since,
+		); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+// ClaimEmails marks up to limit notifications as emailed and returns them.
+// Notifications are claimed before the email is sent, so a failed delivery
+// is not retried; a missed email is better than a duplicate one.
+func (m *NotificationModel) ClaimEmails(limit int) ([]*NotificationEmail, error) {
+	query := `
+    WITH claimed AS (
+      SELECT id FROM notifications
+      WHERE emailed_at IS NULL
+      ORDER BY id
+      LIMIT $1
+      FOR UPDATE SKIP LOCKED
+    )
+    UPDATE notifications AS n SET emailed_at = now()
+    FROM claimed, users AS u, posts AS p
+    WHERE n.id = claimed.id AND n.user_id = u.id AND n.post_id = p.id
+    RETURNING n.id, n.user_id, n.actor_id, n.actor_name, n.kind, n.post_id, p.title, coalesce(n.comment_id, 0), n.created,
+      u.name, u.email,
+      coalesce((SELECT c.content FROM comments AS c WHERE c.id = n.comment_id), p.content),
+      u.activated AND CASE n.kind
+        WHEN 'comment_reply' THEN u.email_replies
+        WHEN 'post_reply' THEN u.email_replies
+        WHEN 'mention' THEN u.email_mentions
+        ELSE false
+      END
+  `
+
+	emails := []*NotificationEmail{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		email := &NotificationEmail{}
+		if err := rows.Scan(
+			&email.ID,
+			&email.UserID,
+			&email.ActorID,
+			&email.ActorName,
+			&email.Kind,
+			&email.PostID,
+			&email.PostTitle,
+			&email.CommentID,
+			&email.Created,
+			&email.Username,
+			&email.Email,
+			&email.Excerpt,
+			&email.Send,
+		); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+// Digest returns the most liked posts created since the given time in the
+// topics the user is subscribed to
+func (m *PostModel) Digest(user_id int, since time.Time, limit int) ([]*Post, error) {
+	query := `
+    SELECT p.id, p.topic_id, p.user_id, p.username, p.likes, p.created, p.title, p.num_comments
+    FROM posts AS p JOIN topic_subscription AS s ON p.topic_id = s.topic_id
+    WHERE s.user_id = $1 AND p.created > $2 AND p.user_id <> $1 AND p.removed_at IS NULL AND p.deleted_at IS NULL
+    ORDER BY p.likes DESC, p.id DESC
+    LIMIT $3
+  `
+
+	posts := []*Post{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, user_id, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		post := &Post{}
+		if err := rows.Scan(
+			&post.ID,
+			&post.TopicID,
+			&post.UserID,
+			&post.Username,
+			&post.Likes,
+			&post.Created,
+			&post.Title,
+			&post.NumComments,
+		); err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return posts, nil
+}
@@ -21,4 +21,16 @@ var (
 	ErrInsertCommentPath      = errors.New("failed to insert comment path")
 	ErrInsertCommentLike      = errors.New("failed to insert comment like")
 	ErrUpdatePostCommentCount = errors.New("failed to increment number of comments on post")
+	ErrInvalidCursor          = errors.New("invalid pagination cursor")
+	ErrInvalidSort            = errors.New("invalid sort order")
+	ErrInvalidWindow          = errors.New("invalid time window")
+	ErrInvalidModAction       = errors.New("invalid moderation action")
+	ErrPostLocked             = errors.New("post is locked")
+	ErrBanned                 = errors.New("user is banned")
+	ErrDuplicateLink          = errors.New("link was already submitted to the topic")
+	ErrPollClosed             = errors.New("poll is closed")
+	ErrAlreadyVoted           = errors.New("cannot vote in a poll twice")
+	ErrInvalidPollVote        = errors.New("invalid choice of poll options")
+	ErrBlocked                = errors.New("user is blocked")
+	ErrAccountLocked          = errors.New("account is locked after too many failed logins")
 )
@@ -0,0 +1,34 @@
+package models
+
+// kinds of the events pushed to the readers of posts and topics
+const (
+	EventComment = "comment"
+	EventLikes   = "likes"
+)
+
+// Event is a change to a post or its comments. Comment events carry the new
+// comment in CommentID and the comment count of the post in NumComments;
+// likes events carry the new score of the comment in CommentID, or of the
+// post when CommentID is 0.
+type Event struct {
+	Kind        string `json:"kind"`
+	TopicID     int    `json:"topic_id"`
+	PostID      int    `json:"post_id"`
+	CommentID   int    `json:"comment_id,omitempty"`
+	Likes       int    `json:"likes,omitempty"`
+	NumComments int    `json:"num_comments,omitempty"`
+	// the new comment, loaded once for all the readers of the post
+	Comment *CommentNode `json:"-"`
+}
+
+// Publisher is told about the events once their transaction is committed,
+// it must not block
+type Publisher interface {
+	Publish(event Event)
+}
+
+func publish(p Publisher, event Event) {
+	if p != nil {
+		p.Publish(event)
+	}
+}
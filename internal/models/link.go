@@ -0,0 +1,144 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LinkPreview is the OpenGraph metadata of the URL of a link post, ImageKey
+// is the storage key of a thumbnail of its image if it had one
+type LinkPreview struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	SiteName    string    `json:"site_name,omitempty"`
+	ImageKey    string    `json:"-"`
+	Fetched     time.Time `json:"fetched"`
+}
+
+// duplicateLink reports whether err is the unique index on the links of the
+// visible posts of a topic rejecting a post
+func duplicateLink(err error) bool {
+	var pqerror *pq.Error
+	return errors.As(err, &pqerror) && pqerror.Code == "23505" && pqerror.Constraint == "posts_topic_link_key_idx"
+}
+
+// linkKey normalizes a URL so the same page submitted with a different case
+// in the host, a default port, a fragment, tracking parameters or a trailing
+// slash is recognised as a duplicate
+func linkKey(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return link
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = u.Hostname()
+	}
+	u.Host = strings.TrimPrefix(u.Host, "www.")
+	// both schemes serve the same page nearly everywhere
+	u.Scheme = "https"
+	u.User = nil
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+
+	query := u.Query()
+	for name := range query {
+		if strings.HasPrefix(name, "utm_") || name == "fbclid" || name == "gclid" {
+			query.Del(name)
+		}
+	}
+	// Encode sorts the parameters by name
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// FindLink returns the ID of a visible post of the topic linking to the same
+// URL, ErrNoRecordFound if there is none
+func (m *PostModel) FindLink(topic_id int, link string) (int, error) {
+	query := `
+    SELECT p.id FROM posts AS p
+    WHERE p.topic_id = $1 AND p.link_key = $2 AND p.removed_at IS NULL AND p.deleted_at IS NULL
+  `
+
+	var post_id int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, topic_id, linkKey(link)).Scan(&post_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrNoRecordFound
+		default:
+			return 0, err
+		}
+	}
+	return post_id, nil
+}
+
+// SetLinkPreview stores the metadata fetched for the link of the post,
+// replacing what was fetched before
+func (m *PostModel) SetLinkPreview(post_id int, preview *LinkPreview) error {
+	query := `
+    INSERT INTO link_previews(post_id, title, description, site_name, image_key)
+    VALUES($1, $2, $3, $4, $5)
+    ON CONFLICT (post_id) DO UPDATE
+    SET title = EXCLUDED.title, description = EXCLUDED.description, site_name = EXCLUDED.site_name,
+      image_key = EXCLUDED.image_key, fetched = now()
+    RETURNING fetched
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, post_id, preview.Title, preview.Description, preview.SiteName, preview.ImageKey).Scan(&preview.Fetched)
+}
+
+// PurgeLinkPreviews removes the previews of the posts deleted before the
+// given time and returns the storage keys of their images
+func (m *PostModel) PurgeLinkPreviews(before time.Time) ([]string, error) {
+	query := `
+    DELETE FROM link_previews AS lp
+    WHERE lp.post_id IN (SELECT id FROM posts WHERE deleted_at < $1)
+    RETURNING lp.image_key
+  `
+
+	keys := []string{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
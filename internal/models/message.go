@@ -0,0 +1,395 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Conversation is a direct message thread as seen by one of its two members,
+// Unread counts the messages of the other member they have not read yet
+type Conversation struct {
+	ID          int       `json:"id"`
+	OtherID     int       `json:"other_id"`
+	OtherName   string    `json:"other_name"`
+	LastMessage time.Time `json:"last_message"`
+	Preview     string    `json:"preview"`
+	Unread      int       `json:"unread"`
+}
+
+type Message struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	SenderID       int       `json:"sender_id"`
+	SenderName     string    `json:"sender_name"`
+	Content        string    `json:"content"`
+	Created        time.Time `json:"created"`
+}
+
+// messages shown in a conversation, the most recent ones
+const conversationMessages = 200
+
+type MessageModel struct {
+	DB *sql.DB
+}
+
+// userBlocked reports whether either user blocked the other
+func userBlocked(ctx context.Context, tx *sql.Tx, user_id, other_id int) (bool, error) {
+	query := `
+    SELECT EXISTS(
+      SELECT 1 FROM user_blocks
+      WHERE (user_id = $1 AND blocked_id = $2) OR (user_id = $2 AND blocked_id = $1)
+    )
+  `
+
+	var blocked bool
+	err := tx.QueryRowContext(ctx, query, user_id, other_id).Scan(&blocked)
+	return blocked, err
+}
+
+// Send adds a message to the conversation between the two users, starting
+// the conversation if they never talked before, and returns its ID. Messages
+// between users who blocked one another fail with ErrBlocked.
+func (m *MessageModel) Send(sender_id, recipient_id int, content string) (int, error) {
+	find := "SELECT conversation_id FROM conversation_members WHERE user_id = $1 AND other_id = $2"
+	start := "INSERT INTO conversations(started_by) VALUES($1) RETURNING id"
+	members := `
+    INSERT INTO conversation_members(conversation_id, user_id, other_id)
+    VALUES($1, $2, $3), ($1, $3, $2)
+  `
+
+	if sender_id == recipient_id {
+		return 0, ErrNoRecordFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var conversation_id int
+	err = tx.QueryRowContext(ctx, find, sender_id, recipient_id).Scan(&conversation_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx, start, sender_id).Scan(&conversation_id)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.ExecContext(ctx, members, conversation_id, sender_id, recipient_id)
+		if err != nil {
+			// both users started a conversation at the same time
+			if strings.HasPrefix(err.Error(), "pq: duplicate key value violates unique constraint") {
+				return 0, ErrConcurrencyControl
+			}
+			if strings.HasPrefix(err.Error(), "pq: insert or update on table") {
+				return 0, ErrNoRecordFound
+			}
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	err = addMessage(ctx, tx, conversation_id, sender_id, recipient_id, content)
+	if err != nil {
+		return 0, err
+	}
+
+	return conversation_id, tx.Commit()
+}
+
+// Find returns the ID of the conversation between the two users,
+// ErrNoRecordFound if they never talked
+func (m *MessageModel) Find(user_id, other_id int) (int, error) {
+	query := "SELECT conversation_id FROM conversation_members WHERE user_id = $1 AND other_id = $2"
+
+	var conversation_id int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user_id, other_id).Scan(&conversation_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrNoRecordFound
+		default:
+			return 0, err
+		}
+	}
+	return conversation_id, nil
+}
+
+// Reply adds a message to a conversation of the sender
+func (m *MessageModel) Reply(sender_id, conversation_id int, content string) error {
+	other := "SELECT other_id FROM conversation_members WHERE conversation_id = $1 AND user_id = $2"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var other_id int
+	err = tx.QueryRowContext(ctx, other, conversation_id, sender_id).Scan(&other_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNoRecordFound
+		default:
+			return err
+		}
+	}
+
+	err = addMessage(ctx, tx, conversation_id, sender_id, other_id, content)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func addMessage(ctx context.Context, tx *sql.Tx, conversation_id, sender_id, recipient_id int, content string) error {
+	insert := "INSERT INTO messages(conversation_id, sender_id, content) VALUES($1, $2, $3) RETURNING id"
+	touch := "UPDATE conversations SET last_message_at = now() WHERE id = $1"
+	// the sender has read everything up to their own message
+	read := "UPDATE conversation_members SET last_read_message_id = $3 WHERE conversation_id = $1 AND user_id = $2"
+
+	if blocked, err := userBlocked(ctx, tx, sender_id, recipient_id); err != nil {
+		return err
+	} else if blocked {
+		return ErrBlocked
+	}
+
+	var message_id int
+	err := tx.QueryRowContext(ctx, insert, conversation_id, sender_id, content).Scan(&message_id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, touch, conversation_id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, read, conversation_id, sender_id, message_id)
+	return err
+}
+
+// Conversations lists the conversations of the user, the most recently
+// active first
+func (m *MessageModel) Conversations(user_id int) ([]*Conversation, error) {
+	query := `
+    SELECT c.id, cm.other_id, u.name, c.last_message_at,
+      coalesce((SELECT left(m.content, 100) FROM messages AS m WHERE m.conversation_id = c.id ORDER BY m.created DESC, m.id DESC LIMIT 1), ''),
+      (SELECT count(*) FROM messages AS m WHERE m.conversation_id = c.id AND m.sender_id <> $1 AND m.id > cm.last_read_message_id)
+    FROM conversation_members AS cm
+    JOIN conversations AS c ON cm.conversation_id = c.id
+    JOIN users AS u ON cm.other_id = u.id
+    WHERE cm.user_id = $1
+    ORDER BY c.last_message_at DESC, c.id DESC
+    LIMIT 100
+  `
+
+	conversations := []*Conversation{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := &Conversation{}
+		if err := rows.Scan(&c.ID, &c.OtherID, &c.OtherName, &c.LastMessage, &c.Preview, &c.Unread); err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return conversations, nil
+}
+
+// Get returns the conversation as seen by the user, ErrNoRecordFound if they
+// are not one of its members
+func (m *MessageModel) Get(conversation_id, user_id int) (*Conversation, error) {
+	query := `
+    SELECT c.id, cm.other_id, u.name, c.last_message_at
+    FROM conversation_members AS cm
+    JOIN conversations AS c ON cm.conversation_id = c.id
+    JOIN users AS u ON cm.other_id = u.id
+    WHERE cm.conversation_id = $1 AND cm.user_id = $2
+  `
+
+	c := &Conversation{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, conversation_id, user_id).Scan(&c.ID, &c.OtherID, &c.OtherName, &c.LastMessage)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Messages returns the latest messages of the conversation, oldest first
+func (m *MessageModel) Messages(conversation_id int) ([]*Message, error) {
+	query := `
+    SELECT r.id, r.conversation_id, r.sender_id, r.name, r.content, r.created
+    FROM (
+      SELECT m.id, m.conversation_id, m.sender_id, u.name, m.content, m.created
+      FROM messages AS m JOIN users AS u ON m.sender_id = u.id
+      WHERE m.conversation_id = $1
+      ORDER BY m.created DESC, m.id DESC
+      LIMIT $2
+    ) AS r
+    ORDER BY r.created, r.id
+  `
+
+	messages := []*Message{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, conversation_id, conversationMessages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		message := &Message{}
+		if err := rows.Scan(
+			&message.ID,
+			&message.ConversationID,
+			&message.SenderID,
+			&message.SenderName,
+			&message.Content,
+			&message.Created,
+		); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MarkRead records that the user has read the conversation up to the
+// message, messages sent after the page was loaded stay unread
+func (m *MessageModel) MarkRead(conversation_id, user_id, message_id int) error {
+	query := `
+    UPDATE conversation_members SET last_read_message_id = greatest(last_read_message_id, $3)
+    WHERE conversation_id = $1 AND user_id = $2
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, conversation_id, user_id, message_id)
+	return err
+}
+
+// UnreadCount is the number of messages sent to the user they have not read
+func (m *MessageModel) UnreadCount(user_id int) (int, error) {
+	query := `
+    SELECT count(*)
+    FROM conversation_members AS cm
+    JOIN messages AS m ON m.conversation_id = cm.conversation_id
+    WHERE cm.user_id = $1 AND m.sender_id <> $1 AND m.id > cm.last_read_message_id
+  `
+
+	var count int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user_id).Scan(&count)
+	return count, err
+}
+
+// SentSince counts the messages the user sent and the conversations they
+// started since the given time
+func (m *MessageModel) SentSince(user_id int, since time.Time) (int, int, error) {
+	query := `
+    SELECT
+      (SELECT count(*) FROM messages WHERE sender_id = $1 AND created > $2),
+      (SELECT count(*) FROM conversations WHERE started_by = $1 AND created > $2)
+  `
+
+	var messages, conversations int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user_id, since).Scan(&messages, &conversations)
+	return messages, conversations, err
+}
+
+func (m *MessageModel) Block(user_id, blocked_id int) error {
+	query := "INSERT INTO user_blocks(user_id, blocked_id) VALUES($1, $2) ON CONFLICT(user_id, blocked_id) DO NOTHING"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, user_id, blocked_id)
+	return err
+}
+
+func (m *MessageModel) Unblock(user_id, blocked_id int) error {
+	query := "DELETE FROM user_blocks WHERE user_id = $1 AND blocked_id = $2"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, user_id, blocked_id)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rowsAffected == 0 {
+		return ErrNoRecordFound
+	}
+	return nil
+}
+
+// HasBlocked reports whether the user blocked the other user
+func (m *MessageModel) HasBlocked(user_id, other_id int) (bool, error) {
+	query := "SELECT EXISTS(SELECT 1 FROM user_blocks WHERE user_id = $1 AND blocked_id = $2)"
+
+	var blocked bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user_id, other_id).Scan(&blocked)
+	return blocked, err
+}
@@ -0,0 +1,355 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// actions moderators can take on reported content, every action is recorded
+// in the moderation log
+const (
+	ModRemove  = "remove"
+	ModApprove = "approve"
+	ModLock    = "lock"
+	ModUnlock  = "unlock"
+)
+
+var ModActions = []string{ModRemove, ModApprove, ModLock, ModUnlock}
+
+// bans of a topic are recorded in its moderation log as well
+const (
+	ModBan   = "ban"
+	ModUnban = "unban"
+)
+
+var LogActions = []string{ModRemove, ModApprove, ModLock, ModUnlock, ModBan, ModUnban}
+
+// QueueItem is a post or comment with open reports, CommentID is 0 for posts
+type QueueItem struct {
+	ID         int       `json:"id"`
+	PostID     int       `json:"post_id"`
+	CommentID  int       `json:"comment_id,omitempty"`
+	Title      string    `json:"title"`
+	Content    string    `json:"content"`
+	UserID     int       `json:"user_id"`
+	Username   string    `json:"username"`
+	NumReports int       `json:"num_reports"`
+	Reasons    []string  `json:"reasons"`
+	Created    time.Time `json:"created"`
+	Removed    bool      `json:"removed"`
+	Locked     bool      `json:"locked"`
+}
+
+// ModAction is what a moderator does to a post, or to a comment when
+// CommentID is set
+type ModAction struct {
+	TopicID       int
+	ModeratorID   int
+	ModeratorName string
+	Action        string
+	PostID        int
+	CommentID     int
+	Reason        string
+}
+
+type LogEntry struct {
+	ID             int       `json:"id"`
+	TopicID        int       `json:"topic_id"`
+	ModeratorID    int       `json:"moderator_id"`
+	ModeratorName  string    `json:"moderator_name"`
+	Action         string    `json:"action"`
+	PostID         int       `json:"post_id,omitempty"`
+	CommentID      int       `json:"comment_id,omitempty"`
+	TargetUserID   int       `json:"target_user_id,omitempty"`
+	TargetUsername string    `json:"target_username,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	Created        time.Time `json:"created"`
+}
+
+// LogFilter narrows the moderation log down, empty fields match everything
+type LogFilter struct {
+	Action    string
+	Moderator string
+	Username  string
+}
+
+type ModerationModel struct {
+	DB *sql.DB
+}
+
+// ReportPost files a report against a post; reporting the same post again
+// while the first report is open does nothing
+func (m *ModerationModel) ReportPost(user_id, post_id int, reason string) error {
+	query := `
+    INSERT INTO reports(topic_id, post_id, user_id, reason)
+    SELECT p.topic_id, p.id, $2, $3
+    FROM posts AS p
+    WHERE p.id = $1
+    ON CONFLICT DO NOTHING
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, post_id, user_id, reason)
+	return err
+}
+
+// ReportComment files a report against a comment, see ReportPost
+func (m *ModerationModel) ReportComment(user_id, comment_id int, reason string) error {
+	query := `
+    INSERT INTO reports(topic_id, post_id, comment_id, user_id, reason)
+    SELECT p.topic_id, p.id, c.id, $2, $3
+    FROM comments AS c JOIN posts AS p ON c.post_id = p.id
+    WHERE c.id = $1
+    ON CONFLICT DO NOTHING
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, comment_id, user_id, reason)
+	return err
+}
+
+// Queue lists the posts and comments of a topic with open reports, the
+// reports against the same content are grouped together
+func (m *ModerationModel) Queue(topic_id int, page PageRequest) ([]*QueueItem, Page, error) {
+	cond, order, args, backwards, err := page.keyset("q", 2)
+	if err != nil {
+		return nil, Page{}, err
+	}
+
+	query := fmt.Sprintf(`
+    SELECT q.id, q.post_id, q.comment_id, q.title, q.content, q.user_id, q.username,
+      q.num_reports, q.reasons, q.created, q.removed, q.locked
+    FROM (
+      SELECT max(r.id) AS id, r.post_id, coalesce(r.comment_id, 0) AS comment_id, p.title,
+        coalesce(c.content, p.content) AS content,
+        coalesce(c.user_id, p.user_id) AS user_id,
+        coalesce(c.username, p.username) AS username,
+        count(*) AS num_reports,
+        array_agg(DISTINCT r.reason) AS reasons,
+        max(r.created) AS created,
+        coalesce(c.removed_at, p.removed_at) IS NOT NULL AS removed,
+        p.locked
+      FROM reports AS r
+      JOIN posts AS p ON r.post_id = p.id
+      LEFT JOIN comments AS c ON r.comment_id = c.id
+      WHERE r.topic_id = $1 AND r.resolved_at IS NULL
+      GROUP BY r.post_id, r.comment_id, p.id, c.id
+    ) AS q
+    WHERE %s
+    ORDER BY %s
+    LIMIT %d
+  `, cond, order, page.Limit+1)
+
+	items := []*QueueItem{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, append([]any{topic_id}, args...)...)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := &QueueItem{}
+		if err := rows.Scan(
+			&item.ID,
+			&item.PostID,
+			&item.CommentID,
+			&item.Title,
+			&item.Content,
+			&item.UserID,
+			&item.Username,
+			&item.NumReports,
+			pq.Array(&item.Reasons),
+			&item.Created,
+			&item.Removed,
+			&item.Locked,
+		); err != nil {
+			return nil, Page{}, err
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Page{}, err
+	}
+
+	items, metadata := paginate(page, items, backwards, func(item *QueueItem) cursor {
+		return cursor{Created: item.Created, ID: item.ID}
+	})
+	return items, metadata, nil
+}
+
+// Act applies a moderation action to a post or comment of the topic, closes
+// the reports it settles and appends it to the moderation log. Removing or
+// approving settles the reports, approving also restores removed content.
+// Only posts can be locked, locked posts do not accept new comments.
+func (m *ModerationModel) Act(action *ModAction) error {
+	post_target := "SELECT p.id, p.user_id, p.username FROM posts AS p WHERE p.id = $1 AND p.topic_id = $2"
+	comment_target := `
+    SELECT c.post_id, c.user_id, c.username
+    FROM comments AS c JOIN posts AS p ON c.post_id = p.id
+    WHERE c.id = $1 AND p.topic_id = $2
+  `
+	remove_post := "UPDATE posts SET removed_at = now(), removed_by = $2 WHERE id = $1 AND removed_at IS NULL"
+	remove_comment := "UPDATE comments SET removed_at = now(), removed_by = $2 WHERE id = $1 AND removed_at IS NULL"
+	restore_post := "UPDATE posts SET removed_at = NULL, removed_by = NULL WHERE id = $1"
+	restore_comment := "UPDATE comments SET removed_at = NULL, removed_by = NULL WHERE id = $1"
+	lock := "UPDATE posts SET locked = $2 WHERE id = $1"
+	resolve := `
+    UPDATE reports SET resolved_at = now(), resolved_by = $3
+    WHERE post_id = $1 AND coalesce(comment_id, 0) = $2 AND resolved_at IS NULL
+  `
+	log := `
+    INSERT INTO moderation_log(topic_id, moderator_id, moderator_name, action, post_id, comment_id, target_user_id, target_username, reason)
+    VALUES($1, $2, $3, $4, $5, NULLIF($6::int, 0), $7, $8, $9)
+  `
+
+	if action.CommentID > 0 && (action.Action == ModLock || action.Action == ModUnlock) {
+		return ErrInvalidModAction
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var target_user_id int
+	var target_username string
+
+	if action.CommentID > 0 {
+		err = tx.QueryRowContext(ctx, comment_target, action.CommentID, action.TopicID).Scan(&action.PostID, &target_user_id, &target_username)
+	} else {
+		err = tx.QueryRowContext(ctx, post_target, action.PostID, action.TopicID).Scan(&action.PostID, &target_user_id, &target_username)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNoRecordFound
+		default:
+			return err
+		}
+	}
+
+	switch {
+	case action.Action == ModRemove && action.CommentID > 0:
+		_, err = tx.ExecContext(ctx, remove_comment, action.CommentID, action.ModeratorID)
+	case action.Action == ModRemove:
+		_, err = tx.ExecContext(ctx, remove_post, action.PostID, action.ModeratorID)
+	case action.Action == ModApprove && action.CommentID > 0:
+		_, err = tx.ExecContext(ctx, restore_comment, action.CommentID)
+	case action.Action == ModApprove:
+		// another post of the topic may have the link since this one was removed
+		_, err = tx.ExecContext(ctx, restore_post, action.PostID)
+		if duplicateLink(err) {
+			return ErrDuplicateLink
+		}
+	case action.Action == ModLock, action.Action == ModUnlock:
+		_, err = tx.ExecContext(ctx, lock, action.PostID, action.Action == ModLock)
+	default:
+		return ErrInvalidModAction
+	}
+	if err != nil {
+		return err
+	}
+
+	if action.Action == ModRemove || action.Action == ModApprove {
+		_, err = tx.ExecContext(ctx, resolve, action.PostID, action.CommentID, action.ModeratorID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, log,
+		action.TopicID,
+		action.ModeratorID,
+		action.ModeratorName,
+		action.Action,
+		action.PostID,
+		action.CommentID,
+		target_user_id,
+		target_username,
+		action.Reason,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Log returns one page of the moderation log of a topic
+func (m *ModerationModel) Log(topic_id int, filter LogFilter, page PageRequest) ([]*LogEntry, Page, error) {
+	cond, order, args, backwards, err := page.keyset("l", 5)
+	if err != nil {
+		return nil, Page{}, err
+	}
+
+	query := fmt.Sprintf(`
+    SELECT l.id, l.topic_id, l.moderator_id, l.moderator_name, l.action, coalesce(l.post_id, 0), coalesce(l.comment_id, 0),
+      coalesce(l.target_user_id, 0), l.target_username, l.reason, l.created
+    FROM moderation_log AS l
+    WHERE l.topic_id = $1
+      AND ($2 = '' OR l.action = $2)
+      AND ($3 = '' OR l.moderator_name = $3)
+      AND ($4 = '' OR l.target_username = $4)
+      AND %s
+    ORDER BY %s
+    LIMIT %d
+  `, cond, order, page.Limit+1)
+
+	entries := []*LogEntry{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, append([]any{topic_id, filter.Action, filter.Moderator, filter.Username}, args...)...)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := &LogEntry{}
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.TopicID,
+			&entry.ModeratorID,
+			&entry.ModeratorName,
+			&entry.Action,
+			&entry.PostID,
+			&entry.CommentID,
+			&entry.TargetUserID,
+			&entry.TargetUsername,
+			&entry.Reason,
+			&entry.Created,
+		); err != nil {
+			return nil, Page{}, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Page{}, err
+	}
+
+	entries, metadata := paginate(page, entries, backwards, func(entry *LogEntry) cursor {
+		return cursor{Created: entry.Created, ID: entry.ID}
+	})
+	return entries, metadata, nil
+}
@@ -0,0 +1,244 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// kinds of notification, a user receives at most one notification per event
+// and the first matching kind in this list wins
+const (
+	NotifyCommentReply = "comment_reply" // someone replied to your comment
+	NotifyPostReply    = "post_reply"    // someone commented on your post
+	NotifyMention      = "mention"       // someone wrote @yourname
+	NotifyTopicPost    = "topic_post"    // new post in a topic you are subscribed to
+)
+
+// maximum number of distinct @mentions notified per post or comment
+const maxMentions = 10
+
+var (
+	mentionRegex      = regexp.MustCompile(`(?:^|[^\w@])@([\w.-]+)`)
+	mentionTrailRegex = regexp.MustCompile(`[.-]+$`)
+)
+
+type Notification struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"-"`
+	ActorID   int       `json:"actor_id"`
+	ActorName string    `json:"actor_name"`
+	Kind      string    `json:"kind"`
+	PostID    int       `json:"post_id"`
+	PostTitle string    `json:"post_title"`
+	CommentID int       `json:"comment_id,omitempty"`
+	Created   time.Time `json:"created"`
+	Read      bool      `json:"read"`
+}
+
+type NotificationModel struct {
+	DB *sql.DB
+}
+
+// mentions returns the distinct usernames mentioned in content
+func mentions(content string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+
+	for _, match := range mentionRegex.FindAllStringSubmatch(content, -1) {
+		// trailing punctuation as in "thanks @bob."
+		name := mentionTrailRegex.ReplaceAllString(match[1], "")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == maxMentions {
+			break
+		}
+	}
+
+	return names
+}
+
+// notifyComment is called by CommentModel.Insert within its transaction, it
+// notifies the author of the parent comment, the author of the post for top
+// level comments and every mentioned user
+func notifyComment(ctx context.Context, tx *sql.Tx, user_id int, username string, post_id, parent_id, comment_id int, content string) error {
+	query := `
+    INSERT INTO notifications(user_id, actor_id, actor_name, kind, post_id, comment_id)
+    SELECT DISTINCT ON (r.user_id) r.user_id, $1::int, $2::text, r.kind, $3::int, $4::int
+    FROM (
+      SELECT c.user_id, 'comment_reply' AS kind, 1 AS priority FROM comments AS c WHERE c.id = $5
+      UNION ALL
+      SELECT p.user_id, 'post_reply', 2 FROM posts AS p WHERE p.id = $3 AND $5 = 0
+      UNION ALL
+      SELECT u.id, 'mention', 3 FROM users AS u WHERE u.name = ANY($6)
+    ) AS r
+    WHERE r.user_id <> $1
+    ORDER BY r.user_id, r.priority
+  `
+
+	_, err := tx.ExecContext(ctx, query, user_id, username, post_id, comment_id, parent_id, pq.Array(mentions(content)))
+	return err
+}
+
+// notifyPost is called by PostModel.Insert within its transaction, it
+// notifies every mentioned user and the subscribers of the topic
+func notifyPost(ctx context.Context, tx *sql.Tx, user_id int, username string, topic_id, post_id int, content string) error {
+	query := `
+    INSERT INTO notifications(user_id, actor_id, actor_name, kind, post_id)
+    SELECT DISTINCT ON (r.user_id) r.user_id, $1::int, $2::text, r.kind, $3::int
+    FROM (
+      SELECT u.id AS user_id, 'mention' AS kind, 1 AS priority FROM users AS u WHERE u.name = ANY($5)
+      UNION ALL
+      SELECT s.user_id, 'topic_post', 2 FROM topic_subscription AS s WHERE s.topic_id = $4
+    ) AS r
+    WHERE r.user_id <> $1
+    ORDER BY r.user_id, r.priority
+  `
+
+	_, err := tx.ExecContext(ctx, query, user_id, username, post_id, topic_id, pq.Array(mentions(content)))
+	return err
+}
+
+func (m *NotificationModel) List(user_id int, page PageRequest) ([]*Notification, Page, error) {
+	cond, order, args, backwards, err := page.keyset("n", 2)
+	if err != nil {
+		return nil, Page{}, err
+	}
+
+	query := fmt.Sprintf(`
+    SELECT n.id, n.user_id, n.actor_id, n.actor_name, n.kind, n.post_id, p.title, coalesce(n.comment_id, 0), n.created, n.read_at IS NOT NULL
+    FROM notifications AS n JOIN posts AS p ON n.post_id = p.id
+    WHERE n.user_id = $1 AND %s
+    ORDER BY %s
+    LIMIT %d
+  `, cond, order, page.Limit+1)
+
+	notifications := []*Notification{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, append([]any{user_id}, args...)...)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		n := &Notification{}
+		if err := rows.Scan(
+			&n.ID,
+			&n.UserID,
+			&n.ActorID,
+			&n.ActorName,
+			&n.Kind,
+			&n.PostID,
+			&n.PostTitle,
+			&n.CommentID,
+			&n.Created,
+			&n.Read,
+		); err != nil {
+			return nil, Page{}, err
+		}
+		notifications = append(notifications, n)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Page{}, err
+	}
+
+	notifications, metadata := paginate(page, notifications, backwards, func(n *Notification) cursor {
+		return cursor{Created: n.Created, ID: n.ID}
+	})
+	return notifications, metadata, nil
+}
+
+func (m *NotificationModel) Get(user_id, notification_id int) (*Notification, error) {
+	query := `
+    SELECT n.id, n.user_id, n.actor_id, n.actor_name, n.kind, n.post_id, p.title, coalesce(n.comment_id, 0), n.created, n.read_at IS NOT NULL
+    FROM notifications AS n JOIN posts AS p ON n.post_id = p.id
+    WHERE n.id = $1 AND n.user_id = $2
+  `
+
+	n := &Notification{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, notification_id, user_id).Scan(
+		&n.ID,
+		&n.UserID,
+		&n.ActorID,
+		&n.ActorName,
+		&n.Kind,
+		&n.PostID,
+		&n.PostTitle,
+		&n.CommentID,
+		&n.Created,
+		&n.Read,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+func (m *NotificationModel) UnreadCount(user_id int) (int, error) {
+	query := "SELECT count(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL"
+
+	var count int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user_id).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (m *NotificationModel) MarkRead(user_id, notification_id int) error {
+	query := "UPDATE notifications SET read_at = coalesce(read_at, now()) WHERE id = $1 AND user_id = $2"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, notification_id, user_id)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, err := result.RowsAffected(); rowsAffected == 0 {
+		return ErrNoRecordFound
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *NotificationModel) MarkAllRead(user_id int) error {
+	query := "UPDATE notifications SET read_at = now() WHERE user_id = $1 AND read_at IS NULL"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, user_id)
+	return err
+}
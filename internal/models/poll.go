@@ -0,0 +1,227 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Poll belongs to a poll post. Voted and the Chosen options are those of the
+// user the poll was loaded for; a zero Closes means the poll stays open.
+type Poll struct {
+	PostID   int           `json:"post_id"`
+	Multiple bool          `json:"multiple"`
+	Closes   time.Time     `json:"closes"`
+	Options  []*PollOption `json:"options"`
+	Votes    int           `json:"votes"`
+	Voted    bool          `json:"voted"`
+}
+
+type PollOption struct {
+	ID     int    `json:"id"`
+	Label  string `json:"label"`
+	Votes  int    `json:"votes"`
+	Chosen bool   `json:"chosen"`
+}
+
+func (p *Poll) Closed() bool {
+	return !p.Closes.IsZero() && !p.Closes.After(time.Now())
+}
+
+// ShowResults reports whether the vote counts can be shown, users only see
+// them once they voted or the poll closed
+func (p *Poll) ShowResults() bool {
+	return p.Voted || p.Closed()
+}
+
+// HideResults zeroes the vote counts of a poll whose results cannot be shown
+func (p *Poll) HideResults() {
+	if p.ShowResults() {
+		return
+	}
+	p.Votes = 0
+	for _, option := range p.Options {
+		option.Votes = 0
+	}
+}
+
+// Percent is the share of the votes of the poll that went to the option
+func (o *PollOption) Percent(total int) int {
+	if total == 0 {
+		return 0
+	}
+	return o.Votes * 100 / total
+}
+
+type PollModel struct {
+	DB *sql.DB
+}
+
+// insertPoll is called by PostModel.Insert within its transaction
+func insertPoll(ctx context.Context, tx *sql.Tx, post_id int, poll *Poll) error {
+	insert_poll := "INSERT INTO polls(post_id, multiple, closes_at) VALUES($1, $2, $3)"
+	insert_option := "INSERT INTO poll_options(post_id, position, label) VALUES($1, $2, $3) RETURNING id"
+
+	_, err := tx.ExecContext(ctx, insert_poll, post_id, poll.Multiple, nullTime(poll.Closes))
+	if err != nil {
+		return err
+	}
+
+	for i, option := range poll.Options {
+		err = tx.QueryRowContext(ctx, insert_option, post_id, i+1, option.Label).Scan(&option.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	poll.PostID = post_id
+	return nil
+}
+
+// Get returns the poll of the post with its vote counts, Voted and Chosen are
+// set for user_id; 0 stands for an anonymous user
+func (m *PollModel) Get(post_id, user_id int) (*Poll, error) {
+	poll_query := "SELECT p.post_id, p.multiple, p.closes_at FROM polls AS p WHERE p.post_id = $1"
+	options_query := `
+    SELECT o.id, o.label, count(v.id), coalesce(bool_or(v.user_id = $2), false)
+    FROM poll_options AS o
+    LEFT JOIN poll_votes AS v ON v.option_id = o.id
+    WHERE o.post_id = $1
+    GROUP BY o.id
+    ORDER BY o.position
+  `
+
+	poll := &Poll{Options: []*PollOption{}}
+	var closes sql.NullTime
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, poll_query, post_id).Scan(&poll.PostID, &poll.Multiple, &closes)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+	poll.Closes = closes.Time
+
+	rows, err := m.DB.QueryContext(ctx, options_query, post_id, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		option := &PollOption{}
+		if err := rows.Scan(&option.ID, &option.Label, &option.Votes, &option.Chosen); err != nil {
+			return nil, err
+		}
+		poll.Votes += option.Votes
+		poll.Voted = poll.Voted || option.Chosen
+		poll.Options = append(poll.Options, option)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return poll, nil
+}
+
+// Vote records the choice of the user. Votes are final: voting again fails
+// with ErrAlreadyVoted. The row of the user in poll_voters is inserted before
+// any vote, so concurrent votes of a user wait for each other and all but
+// the first fail, whichever options they chose. Choosing no option, an option
+// of another poll or several options of a single choice poll fails with
+// ErrInvalidPollVote.
+func (m *PollModel) Vote(user_id, post_id int, option_ids []int) error {
+	poll_query := `
+    SELECT p.multiple, p.closes_at IS NOT NULL AND p.closes_at <= now(), po.topic_id, po.locked
+    FROM polls AS p JOIN posts AS po ON p.post_id = po.id
+    WHERE p.post_id = $1 AND po.removed_at IS NULL AND po.deleted_at IS NULL
+    FOR SHARE OF p
+  `
+	voter := "INSERT INTO poll_voters(post_id, user_id) VALUES($1, $2) ON CONFLICT DO NOTHING"
+	insert := `
+    INSERT INTO poll_votes(post_id, option_id, user_id, multiple)
+    SELECT o.post_id, o.id, $3, $4
+    FROM poll_options AS o
+    WHERE o.post_id = $1 AND o.id = ANY($2)
+  `
+
+	if len(option_ids) == 0 {
+		return ErrInvalidPollVote
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var multiple, closed, locked bool
+	var topic_id int
+	err = tx.QueryRowContext(ctx, poll_query, post_id).Scan(&multiple, &closed, &topic_id, &locked)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNoRecordFound
+		default:
+			return err
+		}
+	}
+
+	if closed || locked {
+		return ErrPollClosed
+	}
+
+	if !multiple && len(option_ids) > 1 {
+		return ErrInvalidPollVote
+	}
+
+	if banned, err := userBanned(ctx, tx, user_id, topic_id); err != nil {
+		return err
+	} else if banned {
+		return ErrBanned
+	}
+
+	// blocks while another vote of the user is in progress
+	result, err := tx.ExecContext(ctx, voter, post_id, user_id)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rowsAffected == 0 {
+		return ErrAlreadyVoted
+	}
+
+	result, err = tx.ExecContext(ctx, insert, post_id, pq.Array(option_ids), user_id, multiple)
+	if err != nil {
+		switch {
+		case strings.HasPrefix(err.Error(), "pq: duplicate key value violates unique constraint"):
+			return ErrAlreadyVoted
+		default:
+			return err
+		}
+	}
+
+	// every option has to belong to the poll
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if int(rowsAffected) != len(option_ids) {
+		return ErrInvalidPollVote
+	}
+
+	return tx.Commit()
+}
@@ -4,46 +4,107 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"html/template"
 	"time"
 )
 
 type Post struct {
-	ID          int
-	TopicID     int
-	UserID      int
-	Username    string
-	Likes       int
-	Created     time.Time
-	LastUpdated time.Time
-	Title       string
-	Content     string
-	NumComments int
+	ID          int       `json:"id"`
+	TopicID     int       `json:"topic_id"`
+	UserID      int       `json:"user_id"`
+	Username    string    `json:"username"`
+	Likes       int       `json:"likes"`
+	Hot         float64   `json:"hot"`
+	Rising      float64   `json:"rising"`
+	Created     time.Time `json:"created"`
+	LastUpdated time.Time `json:"last_updated"`
+	Title       string    `json:"title"`
+	Content     string    `json:"content,omitempty"`
+	NumComments int       `json:"num_comments"`
+	Locked      bool      `json:"locked"`
+	Removed     bool      `json:"removed"`
+	Deleted     bool      `json:"deleted"`
+	// zero if the post was never edited
+	Edited   time.Time `json:"edited"`
+	Revision int       `json:"revision"`
+	// Content rendered from markdown, filled in by the handlers
+	ContentHTML template.HTML `json:"content_html,omitempty"`
+	Attachments []*Attachment `json:"attachments,omitempty"`
+	// URL of link posts, Preview is nil until its metadata has been fetched
+	Link    string       `json:"link,omitempty"`
+	Preview *LinkPreview `json:"preview,omitempty"`
+	// poll of poll posts, loaded by the handlers
+	Poll *Poll `json:"poll,omitempty"`
+	// set by the handlers when the title and content are not shown
+	Hidden bool `json:"-"`
+	// how the user reading the post voted on it, loaded by the handlers
+	Interaction Interaction `json:"-"`
+}
+
+// Interaction is the vote of a user on a post or comment, 1 for a like and
+// -1 for a dislike, and whether they saved it
+type Interaction struct {
+	Score int
+	Saved bool
+}
+
+func (i Interaction) Liked() bool {
+	return i.Score > 0
+}
+
+func (i Interaction) Disliked() bool {
+	return i.Score < 0
 }
 
 type PostModel struct {
 	DB *sql.DB
+	// like counts are published to the live readers
+	Events Publisher
 }
 
 func (m *PostModel) Get(post_id int) (*Post, error) {
 	query := `
-    SELECT p.id, u.name, p.likes, p.created, p.last_updated, p.title, p.content 
-    FROM posts AS p JOIN users AS u ON p.user_id = u.id
+    SELECT p.id, p.topic_id, p.user_id, u.name, p.likes, p.hot, p.rising, p.created, p.last_updated, p.title, p.content, p.num_comments,
+      p.locked, p.removed_at IS NOT NULL, p.deleted_at IS NOT NULL, p.edited_at, p.revision,
+      coalesce(p.link, ''), coalesce(lp.title, ''), coalesce(lp.description, ''), coalesce(lp.site_name, ''), coalesce(lp.image_key, ''), lp.fetched
+    FROM posts AS p
+    JOIN users AS u ON p.user_id = u.id
+    LEFT JOIN link_previews AS lp ON lp.post_id = p.id
     WHERE p.id = $1
   `
 
 	post := &Post{}
+	preview := &LinkPreview{}
+	var edited, fetched sql.NullTime
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, post_id).Scan(
 		&post.ID,
+		&post.TopicID,
+		&post.UserID,
 		&post.Username,
 		&post.Likes,
+		&post.Hot,
+		&post.Rising,
 		&post.Created,
 		&post.LastUpdated,
 		&post.Title,
 		&post.Content,
+		&post.NumComments,
+		&post.Locked,
+		&post.Removed,
+		&post.Deleted,
+		&edited,
+		&post.Revision,
+		&post.Link,
+		&preview.Title,
+		&preview.Description,
+		&preview.SiteName,
+		&preview.ImageKey,
+		&fetched,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -52,88 +113,181 @@ func (m *PostModel) Get(post_id int) (*Post, error) {
 			return nil, err
 		}
 	}
+	post.Edited = edited.Time
+	if fetched.Valid {
+		preview.Fetched = fetched.Time
+		post.Preview = preview
+	}
 	return post, nil
 }
 
-func (m *PostModel) GetByTopic(topic_id int) ([]*Post, error) {
-	query := `
-    SELECT p.id, p.user_id, p.username, p.likes, p.created, p.last_updated, p.title, p.num_comments
-    FROM posts AS p
-    WHERE p.topic_id = $1
-  `
+func (m *PostModel) GetByTopic(topic_id int, page PageRequest) ([]*Post, Page, error) {
+	return m.list("p.topic_id = $1", []any{topic_id}, page)
+}
 
-	var posts []*Post
+func (m *PostModel) List(page PageRequest) ([]*Post, Page, error) {
+	return m.list("TRUE", nil, page)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// Feed lists the posts of every topic the user is subscribed to
+func (m *PostModel) Feed(user_id int, page PageRequest) ([]*Post, Page, error) {
+	filter := "p.topic_id IN (SELECT s.topic_id FROM topic_subscription AS s WHERE s.user_id = $1)"
+	return m.list(filter, []any{user_id}, page)
+}
 
-	rows, err := m.DB.QueryContext(ctx, query, topic_id)
+// list runs the keyset paginated query shared by the post listings; filter
+// is a condition on posts aliased as p using the placeholders from $1 for args.
+// Posts removed by moderators or deleted by their authors are left out of
+// every listing.
+func (m *PostModel) list(filter string, args []any, page PageRequest) ([]*Post, Page, error) {
+	cond, order, cursorArgs, backwards, err := page.keyset("p", len(args)+1)
 	if err != nil {
-		return nil, err
+		return nil, Page{}, err
 	}
 
-	for rows.Next() {
-		post := &Post{}
-		if err := rows.Scan(
-			&post.ID,
-			&post.UserID,
-			&post.Username,
-			&post.Likes,
-			&post.Created,
-			&post.LastUpdated,
-			&post.Title,
-			&post.NumComments,
-		); err != nil {
-			return nil, err
-		}
-		posts = append(posts, post)
+	window, err := page.window("p")
+	if err != nil {
+		return nil, Page{}, err
 	}
-	return posts, nil
-}
 
-func (m *PostModel) List(limit int) ([]*Post, error) {
-	query := `
-    SELECT p.user_id, p.likes, p.created, p.last_updated, p.title, p.content, u.name
-    FROM (
-      SELECT user_id, likes, created, last_updated, title, content, name
-      FROM posts 
-      LIMIT $1
-    ) AS p JOIN users AS u ON p.user_id = u.id
-  `
-	limit = max(10, limit)
+	query := fmt.Sprintf(`
+    SELECT p.id, p.topic_id, p.user_id, p.username, p.likes, p.hot, p.rising, p.created, p.last_updated, p.title, p.content, p.num_comments,
+      p.locked, p.edited_at, p.revision,
+      coalesce(p.link, ''), coalesce(lp.title, ''), coalesce(lp.description, ''), coalesce(lp.site_name, ''), coalesce(lp.image_key, ''), lp.fetched
+    FROM posts AS p
+    LEFT JOIN link_previews AS lp ON lp.post_id = p.id
+    WHERE %s AND %s AND %s AND p.removed_at IS NULL AND p.deleted_at IS NULL
+    ORDER BY %s
+    LIMIT %d
+  `, filter, window, cond, order, page.Limit+1)
 
 	posts := []*Post{}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, limit)
+	rows, err := m.DB.QueryContext(ctx, query, append(args, cursorArgs...)...)
 	if err != nil {
-		return nil, err
+		return nil, Page{}, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		row := &Post{}
+		preview := &LinkPreview{}
+		var edited, fetched sql.NullTime
 		if err := rows.Scan(
+			&row.ID,
+			&row.TopicID,
 			&row.UserID,
+			&row.Username,
 			&row.Likes,
+			&row.Hot,
+			&row.Rising,
 			&row.Created,
 			&row.LastUpdated,
 			&row.Title,
 			&row.Content,
-			&row.Username); err != nil {
-			return nil, err
+			&row.NumComments,
+			&row.Locked,
+			&edited,
+			&row.Revision,
+			&row.Link,
+			&preview.Title,
+			&preview.Description,
+			&preview.SiteName,
+			&preview.ImageKey,
+			&fetched); err != nil {
+			return nil, Page{}, err
+		}
+		row.Edited = edited.Time
+		if fetched.Valid {
+			preview.Fetched = fetched.Time
+			row.Preview = preview
 		}
 		posts = append(posts, row)
 	}
 
-	return posts, nil
+	if err := rows.Err(); err != nil {
+		return nil, Page{}, err
+	}
+
+	posts, metadata := paginate(page, posts, backwards, postCursor(page.Sort))
+	return posts, metadata, nil
 }
 
-func (m *PostModel) Insert(user_id, topic_id int, username, title, content string) (int, error) {
-	query := "INSERT INTO posts(user_id, topic_id, username, title, content) VALUES($1, $2, $3, $4, $5) RETURNING id"
+func postCursor(sort string) func(p *Post) cursor {
+	return func(p *Post) cursor {
+		c := cursor{Created: p.Created, Likes: p.Likes, ID: p.ID}
+		switch sort {
+		case SortHot:
+			c.Score = p.Hot
+		case SortRising:
+			c.Score = p.Rising
+		}
+		return c
+	}
+}
+
+// hot_score is the net number of likes of a post decayed by its age; the like
+// of the author gives new posts a score above the posts nobody liked lately
+const hot_score = "likes / power(extract(epoch FROM now() - created) / 3600 + 2, 1.8)"
+
+// RefreshScores recomputes the hot and rising scores used to rank posts, see
+// hot_score. Rising is the number of likes received in the last few hours
+// relative to the age of the post. Posts older than a week drop out of both
+// rankings.
+func (m *PostModel) RefreshScores() error {
+	refresh := `
+    UPDATE posts AS p SET
+      hot = ` + hot_score + `,
+      rising = CASE WHEN p.created > now() - interval '1 day' THEN
+        coalesce((
+          SELECT sum(l.score) FROM posts_liked AS l
+          WHERE l.post_id = p.id AND l.user_id <> p.user_id AND l.created > now() - interval '6 hours'
+        ), 0) / power(extract(epoch FROM now() - p.created) / 3600 + 2, 1.2)
+      ELSE 0 END
+    WHERE p.created > now() - interval '7 days'
+  `
+	expire := `
+    UPDATE posts SET hot = 0, rising = 0
+    WHERE created <= now() - interval '7 days' AND (hot <> 0 OR rising <> 0)
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, refresh); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, expire); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Insert adds a post to the topic, link is the URL of link posts and empty for
+// other posts, poll is nil except for poll posts, attachments are the files
+// already put in the storage; a link already submitted to the topic fails
+// with ErrDuplicateLink
+func (m *PostModel) Insert(user_id, topic_id int, username, title, content, link string, poll *Poll, attachments []*Attachment) (int, error) {
+	query := `
+    INSERT INTO posts(user_id, topic_id, username, title, content, link, link_key)
+    VALUES($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''))
+    RETURNING id
+  `
 	increment := "UPDATE topics SET num_posts = num_posts + 1 WHERE id = $1"
 	like := "INSERT INTO posts_liked(post_id, user_id, score) VALUES($1, $2, 1)"
+	// ranks the post under hot right away instead of after the next RefreshScores
+	score := "UPDATE posts SET hot = " + hot_score + " WHERE id = $1"
 
 	var id int
 
@@ -146,7 +300,40 @@ func (m *PostModel) Insert(user_id, topic_id int, username, title, content strin
 		return -1, err
 	}
 
-	err = tx.QueryRowContext(ctx, query, user_id, topic_id, username, title, content).Scan(&id)
+	if banned, err := userBanned(ctx, tx, user_id, topic_id); err != nil {
+		return -1, err
+	} else if banned {
+		return -1, ErrBanned
+	}
+
+	var link_key string
+	if link != "" {
+		link_key = linkKey(link)
+	}
+
+	err = tx.QueryRowContext(ctx, query, user_id, topic_id, username, title, content, link, link_key).Scan(&id)
+	if err != nil {
+		switch {
+		case duplicateLink(err):
+			return -1, ErrDuplicateLink
+		default:
+			return -1, err
+		}
+	}
+
+	err = addPostRevision(ctx, tx, id, 1, title, content)
+	if err != nil {
+		return -1, err
+	}
+
+	if poll != nil {
+		err = insertPoll(ctx, tx, id, poll)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	err = insertAttachments(ctx, tx, user_id, id, 0, attachments)
 	if err != nil {
 		return -1, err
 	}
@@ -162,6 +349,16 @@ func (m *PostModel) Insert(user_id, topic_id int, username, title, content strin
 		return -1, err
 	}
 
+	_, err = tx.ExecContext(ctx, score, id)
+	if err != nil {
+		return -1, err
+	}
+
+	err = notifyPost(ctx, tx, user_id, username, topic_id, id, content)
+	if err != nil {
+		return -1, err
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return -1, err
@@ -170,10 +367,11 @@ func (m *PostModel) Insert(user_id, topic_id int, username, title, content strin
 	return id, nil
 }
 
+// Delete marks the post as deleted by user_id, the post and its comments stay
+// in the database until PurgeDeleted erases them
 func (m *PostModel) Delete(user_id, post_id, topic_id int) error {
-	unliked := "DELETE FROM posts_liked WHERE user_id = $1 AND post_id = $2"
-	decrement := "UPDATE topics SET num_posts = num_posts - 1 WHERE topic_id = $1"
-	remove := "DELETE FROM posts WHERE post_id = $1"
+	remove := "UPDATE posts SET deleted_at = now(), deleted_by = $2 WHERE id = $1 AND deleted_at IS NULL"
+	decrement := "UPDATE topics SET num_posts = num_posts - 1 WHERE id = $1"
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -184,15 +382,15 @@ func (m *PostModel) Delete(user_id, post_id, topic_id int) error {
 		return err
 	}
 
-	result, err := tx.ExecContext(ctx, unliked, user_id, post_id)
+	result, err := tx.ExecContext(ctx, remove, post_id, user_id)
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected, err := result.RowsAffected(); rowsAffected == 0 {
-		return ErrNoRecordFound
-	} else if err != nil {
+	if rowsAffected, err := result.RowsAffected(); err != nil {
 		return err
+	} else if rowsAffected == 0 {
+		return ErrNoRecordFound
 	}
 
 	_, err = tx.ExecContext(ctx, decrement, topic_id)
@@ -200,32 +398,83 @@ func (m *PostModel) Delete(user_id, post_id, topic_id int) error {
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, remove, post_id)
+	return tx.Commit()
+}
+
+// PurgeDeleted erases the title and content of the posts deleted before the
+// given time along with their revisions, the rows are kept so their comments,
+// votes and reports stay valid
+func (m *PostModel) PurgeDeleted(before time.Time) (int64, error) {
+	revisions := `
+    DELETE FROM post_revisions
+    WHERE post_id IN (SELECT id FROM posts WHERE deleted_at < $1 AND NOT purged)
+  `
+	query := `
+    UPDATE posts SET title = '[deleted]', content = '', link = NULL, link_key = NULL, purged = true
+    WHERE deleted_at < $1 AND NOT purged
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	return tx.Commit()
+	_, err = tx.ExecContext(ctx, revisions, before)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, tx.Commit()
 }
 
+// Update changes the title and content of the post and keeps the new
+// version in its revisions
 func (m *PostModel) Update(post *Post) error {
-	query := "UPDATE posts SET title = $1, content = $2 WHERE post_id = $3 RETURNING id"
+	query := `
+    UPDATE posts SET title = $1, content = $2, last_updated = now(), edited_at = now(), revision = revision + 1
+    WHERE id = $3 AND deleted_at IS NULL
+    RETURNING last_updated, edited_at, revision
+  `
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, post.Title, post.Content, post.ID)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	if rowsAffected, err := result.RowsAffected(); rowsAffected == 0 {
-		return ErrNoRecordFound
-	} else if err != nil {
+	err = tx.QueryRowContext(ctx, query, post.Title, post.Content, post.ID).Scan(&post.LastUpdated, &post.Edited, &post.Revision)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNoRecordFound
+		default:
+			return err
+		}
+	}
+
+	err = addPostRevision(ctx, tx, post.ID, post.Revision, post.Title, post.Content)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func (m *PostModel) Like(user_id, post_id int) error {
@@ -237,6 +486,8 @@ func (m *PostModel) Like(user_id, post_id int) error {
 	update := "UPDATE posts_liked SET score = 1 WHERE user_id = $1 AND post_id = $2"
 	increment_on_like := "UPDATE posts SET likes = likes + 2 WHERE id = $1"
 
+	likes := "SELECT likes, topic_id FROM posts WHERE id = $1"
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -272,7 +523,19 @@ func (m *PostModel) Like(user_id, post_id int) error {
 		}
 	}
 
-	return tx.Commit()
+	event := Event{Kind: EventLikes, PostID: post_id}
+	err = tx.QueryRowContext(ctx, likes, post_id).Scan(&event.Likes, &event.TopicID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	publish(m.Events, event)
+	return nil
 }
 
 func (m *PostModel) Dislike(user_id, post_id int) error {
@@ -283,6 +546,8 @@ func (m *PostModel) Dislike(user_id, post_id int) error {
 	update := "UPDATE posts_liked SET score = -1 WHERE user_id = $1 AND post_id = $2"
 	decrement_on_dislike := "UPDATE posts SET likes = likes - 2 WHERE id = $1"
 
+	likes := "SELECT likes, topic_id FROM posts WHERE id = $1"
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -316,7 +581,76 @@ func (m *PostModel) Dislike(user_id, post_id int) error {
 		}
 	}
 
-	return tx.Commit()
+	event := Event{Kind: EventLikes, PostID: post_id}
+	err = tx.QueryRowContext(ctx, likes, post_id).Scan(&event.Likes, &event.TopicID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	publish(m.Events, event)
+	return nil
+}
+
+// Unvote takes back the like or dislike of the user
+func (m *PostModel) Unvote(user_id, post_id int) error {
+	remove := "DELETE FROM posts_liked WHERE user_id = $1 AND post_id = $2 RETURNING score"
+	update := "UPDATE posts SET likes = likes - $2 WHERE id = $1 RETURNING likes, topic_id"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var score int
+	err = tx.QueryRowContext(ctx, remove, user_id, post_id).Scan(&score)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// the user never voted, nothing to take back
+			return nil
+		default:
+			return err
+		}
+	}
+
+	event := Event{Kind: EventLikes, PostID: post_id}
+	err = tx.QueryRowContext(ctx, update, post_id, score).Scan(&event.Likes, &event.TopicID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	publish(m.Events, event)
+	return nil
+}
+
+// Interaction returns how the user voted on the post and whether they saved it
+func (m *PostModel) Interaction(user_id, post_id int) (Interaction, error) {
+	query := `
+    SELECT coalesce((SELECT score FROM posts_liked WHERE user_id = $1 AND post_id = $2), 0),
+      EXISTS(SELECT 1 FROM posts_saved WHERE user_id = $1 AND post_id = $2)
+  `
+
+	var interaction Interaction
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user_id, post_id).Scan(&interaction.Score, &interaction.Saved)
+	return interaction, err
 }
 
 func (m *PostModel) Save(user_id, post_id int) error {
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Revision is one version of a post or comment, Number 1 is the original.
+// Title is empty for comments.
+type Revision struct {
+	ID      int       `json:"id"`
+	Number  int       `json:"revision"`
+	Title   string    `json:"title,omitempty"`
+	Content string    `json:"content"`
+	Created time.Time `json:"created"`
+}
+
+// addPostRevision records the title and content of a post as the given
+// revision, the number comes from posts.revision
+func addPostRevision(ctx context.Context, tx *sql.Tx, post_id, revision int, title, content string) error {
+	query := "INSERT INTO post_revisions(post_id, revision, title, content) VALUES($1, $2, $3, $4)"
+
+	_, err := tx.ExecContext(ctx, query, post_id, revision, title, content)
+	return err
+}
+
+// addCommentRevision is the comment counterpart of addPostRevision
+func addCommentRevision(ctx context.Context, tx *sql.Tx, comment_id, revision int, content string) error {
+	query := "INSERT INTO comment_revisions(comment_id, revision, content) VALUES($1, $2, $3)"
+
+	_, err := tx.ExecContext(ctx, query, comment_id, revision, content)
+	return err
+}
+
+// Revisions returns every version of the post, oldest first
+func (m *PostModel) Revisions(post_id int) ([]*Revision, error) {
+	query := `
+    SELECT id, revision, title, content, created
+    FROM post_revisions
+    WHERE post_id = $1
+    ORDER BY revision
+  `
+
+	return listRevisions(m.DB, query, post_id)
+}
+
+// Revisions returns every version of the comment, oldest first
+func (m *CommentModel) Revisions(comment_id int) ([]*Revision, error) {
+	query := `
+    SELECT id, revision, '', content, created
+    FROM comment_revisions
+    WHERE comment_id = $1
+    ORDER BY revision
+  `
+
+	return listRevisions(m.DB, query, comment_id)
+}
+
+func listRevisions(db *sql.DB, query string, id int) ([]*Revision, error) {
+	revisions := []*Revision{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		revision := &Revision{}
+		if err := rows.Scan(
+			&revision.ID,
+			&revision.Number,
+			&revision.Title,
+			&revision.Content,
+			&revision.Created,
+		); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// what a search looks through
+const (
+	SearchAll      = "all"
+	SearchPosts    = "posts"
+	SearchComments = "comments"
+)
+
+// SortRelevance orders search results by ts_rank, ties go to the newest
+const SortRelevance = "relevance"
+
+// ts_headline wraps every match in these markers; they are private use
+// characters so they cannot clash with anything the templates escape, see
+// the highlight template function
+const (
+	HighlightStart = "\uE000"
+	HighlightStop  = "\uE001"
+)
+
+var headlineOptions = fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=35, MinWords=15, MaxFragments=2", HighlightStart, HighlightStop)
+
+type SearchResult struct {
+	Kind     string    `json:"kind"` // "post" or "comment"
+	ID       int       `json:"id"`
+	PostID   int       `json:"post_id"`
+	TopicID  int       `json:"topic_id"`
+	Title    string    `json:"title"` // title of the post, for comments too
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	Rank     float64   `json:"rank"`
+	Headline string    `json:"headline"`
+}
+
+// SearchFilters narrows a full-text search; zero values disable a filter
+type SearchFilters struct {
+	Query   string
+	Kind    string
+	TopicID int
+	Author  string
+	From    time.Time
+	To      time.Time // exclusive
+	Sort    string
+	Offset  int
+	Limit   int
+}
+
+type SearchModel struct {
+	DB *sql.DB
+}
+
+// Search matches the query against the title and content of posts and the
+// content of comments using the search columns kept up to date by the
+// triggers from the migrations. The query understands the web search syntax
+// of websearch_to_tsquery: "quoted phrases", OR and -excluded words.
+// The second return value reports whether there are more results after this page.
+func (m *SearchModel) Search(f SearchFilters) ([]*SearchResult, bool, error) {
+	if f.Kind == "" {
+		f.Kind = SearchAll
+	}
+	if f.Sort == "" {
+		f.Sort = SortRelevance
+	}
+	if f.Limit < 1 {
+		f.Limit = DefaultPageSize
+	}
+	f.Limit = min(f.Limit, MaxPageSize)
+
+	var order string
+	switch f.Sort {
+	case SortRelevance:
+		order = "rank DESC, created DESC, id DESC"
+	case SortNew:
+		order = "created DESC, id DESC"
+	default:
+		return nil, false, ErrInvalidSort
+	}
+
+	// headlines are expensive, so they are only built for the page of
+	// matches that is returned
+	query := fmt.Sprintf(`
+    WITH q AS (SELECT websearch_to_tsquery('english', $1) AS query),
+    matches AS (
+      SELECT 'post' AS kind, p.id, p.id AS post_id, p.topic_id, p.title, p.user_id, p.username, p.created,
+        ts_rank(p.search, q.query) AS rank, p.title || E'\n' || p.content AS body
+      FROM posts AS p, q
+      WHERE $2 IN ('all', 'posts') AND p.search @@ q.query AND p.removed_at IS NULL AND p.deleted_at IS NULL
+        AND ($3 = 0 OR p.topic_id = $3)
+        AND ($4 = '' OR p.username = $4)
+        AND ($5::timestamptz IS NULL OR p.created >= $5)
+        AND ($6::timestamptz IS NULL OR p.created < $6)
+      UNION ALL
+      SELECT 'comment', c.id, c.post_id, p.topic_id, p.title, c.user_id, c.username, c.created,
+        ts_rank(c.search, q.query), c.content
+      FROM comments AS c JOIN posts AS p ON c.post_id = p.id, q
+      WHERE $2 IN ('all', 'comments') AND c.search @@ q.query AND c.removed_at IS NULL AND c.deleted_at IS NULL
+        AND p.removed_at IS NULL AND p.deleted_at IS NULL
+        AND ($3 = 0 OR p.topic_id = $3)
+        AND ($4 = '' OR c.username = $4)
+        AND ($5::timestamptz IS NULL OR c.created >= $5)
+        AND ($6::timestamptz IS NULL OR c.created < $6)
+      ORDER BY %[1]s
+      LIMIT $7 OFFSET $8
+    )
+    SELECT kind, id, post_id, topic_id, title, user_id, username, created, rank,
+      ts_headline('english', body, q.query, $9)
+    FROM matches, q
+    ORDER BY %[1]s
+  `, order)
+
+	args := []any{f.Query, f.Kind, f.TopicID, f.Author, nullTime(f.From), nullTime(f.To), f.Limit + 1, f.Offset, headlineOptions}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	results := []*SearchResult{}
+	for rows.Next() {
+		result := &SearchResult{}
+		err := rows.Scan(
+			&result.Kind,
+			&result.ID,
+			&result.PostID,
+			&result.TopicID,
+			&result.Title,
+			&result.UserID,
+			&result.Username,
+			&result.Created,
+			&result.Rank,
+			&result.Headline,
+		)
+		if err != nil {
+			return nil, false, err
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	more := len(results) > f.Limit
+	if more {
+		results = results[:f.Limit]
+	}
+
+	return results, more, nil
+}
+
+// nullTime maps the zero time to NULL so that unset date filters match everything
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SiteSettings are the settings of the whole site, changed by the admins
+type SiteSettings struct {
+	// moderators cannot moderate until they enable two-factor authentication
+	RequireModerator2FA bool
+}
+
+type SettingModel struct {
+	DB *sql.DB
+}
+
+func (m *SettingModel) Get() (*SiteSettings, error) {
+	query := "SELECT require_moderator_2fa FROM site_settings WHERE id = 1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	settings := &SiteSettings{}
+	err := m.DB.QueryRowContext(ctx, query).Scan(&settings.RequireModerator2FA)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func (m *SettingModel) Update(settings *SiteSettings) error {
+	query := `
+    INSERT INTO site_settings(id, require_moderator_2fa) VALUES(1, $1)
+    ON CONFLICT (id) DO UPDATE SET require_moderator_2fa = EXCLUDED.require_moderator_2fa
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, settings.RequireModerator2FA)
+	return err
+}
@@ -12,14 +12,15 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
 )
 
 type Token struct {
-	Plaintext  string
-	Hash       []byte
-	UserID     int
-	Expiration time.Time
-	Scope      string
+	Plaintext  string    `json:"token"`
+	Hash       []byte    `json:"-"`
+	UserID     int       `json:"-"`
+	Expiration time.Time `json:"expiry"`
+	Scope      string    `json:"-"`
 }
 
 type TokenModel struct {
@@ -89,3 +90,25 @@ func (m *TokenModel) DeleteAllForUser(user_id int, scope string) error {
 		return err
 	}
 }
+
+// LastIssued returns when the newest token of the scope was created for the
+// user, or ErrNoRecordFound if they have none
+func (m *TokenModel) LastIssued(user_id int, scope string) (time.Time, error) {
+	query := "SELECT max(created) FROM tokens WHERE user_id = $1 AND scope = $2"
+
+	var created sql.NullTime
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user_id, scope).Scan(&created)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !created.Valid {
+		return time.Time{}, ErrNoRecordFound
+	}
+
+	return created.Time, nil
+}
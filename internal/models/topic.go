@@ -4,16 +4,45 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type Topic struct {
-	ID             int
-	Name           string
-	CreatedAt      time.Time
-	NumSubscribers int
-	NumPosts       int
-	Moderators     []string
+	ID             int       `json:"id"`
+	Name           string    `json:"name"`
+	CreatedAt      time.Time `json:"created"`
+	NumSubscribers int       `json:"num_subscribers"`
+	NumPosts       int       `json:"num_posts"`
+	Moderators     []string  `json:"moderators,omitempty"`
+	// whether the user reading the topic subscribed to it, set by the handlers
+	Subscribed bool `json:"-"`
+}
+
+// roles of users in a topic, from the most to the least privileged; owners
+// manage the moderators of the topic, moderators manage its content and
+// members are everyone else
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+var roleRanks = map[string]int{RoleOwner: 2, RoleModerator: 1, RoleMember: 0}
+
+// RoleAllows reports whether a user with role has the permissions of required
+func RoleAllows(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+type Moderator struct {
+	TopicID  int       `json:"topic_id"`
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	Created  time.Time `json:"created"`
 }
 
 type TopicModel struct {
@@ -21,15 +50,10 @@ type TopicModel struct {
 }
 
 func (t *TopicModel) Get(topic_id int) (*Topic, error) {
-	//  TODO: fix: if there are no moderators, this query returns an empty set
-
-	//  SELECT t.id, t.topic_name, t.created, t.num_subscribers, t.num_posts, array_agg(m.username) AS moderators
-	//  FROM topics AS t JOIN topic_moderators AS m ON t.id = topic_moderators.topic_id
-	//  WHERE t.id = $1
-	//  GROUP BY t.id
-
+	// a subquery instead of a join keeps topics without moderators
 	metadata := `
-    SELECT t.id, t.topic_name, t.created, t.num_subscribers, t.num_posts
+    SELECT t.id, t.topic_name, t.created, t.num_subscribers, t.num_posts,
+      coalesce((SELECT array_agg(m.username ORDER BY m.created, m.id) FROM topic_moderators AS m WHERE m.topic_id = t.id), '{}')
     FROM topics AS t
     WHERE t.id = $1
   `
@@ -45,6 +69,7 @@ func (t *TopicModel) Get(topic_id int) (*Topic, error) {
 		&topic.CreatedAt,
 		&topic.NumSubscribers,
 		&topic.NumPosts,
+		pq.Array(&topic.Moderators),
 	)
 	if err != nil {
 		switch {
@@ -58,25 +83,30 @@ func (t *TopicModel) Get(topic_id int) (*Topic, error) {
 	return topic, nil
 }
 
-func (t *TopicModel) List(limit int) ([]*Topic, error) {
-	metadata := `
+func (t *TopicModel) List(page PageRequest) ([]*Topic, Page, error) {
+	cond, order, args, backwards, err := page.keyset("t", 1)
+	if err != nil {
+		return nil, Page{}, err
+	}
+
+	metadata := fmt.Sprintf(`
     SELECT t.id, t.topic_name, t.created, t.num_subscribers, t.num_posts
     FROM topics AS t
-    ORDER BY t.id
-    LIMIT $1
-  `
+    WHERE %s
+    ORDER BY %s
+    LIMIT %d
+  `, cond, order, page.Limit+1)
 
-	limit = max(10, limit)
-
-	var topics []*Topic
+	topics := []*Topic{}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	rows, err := t.DB.QueryContext(ctx, metadata, limit)
+	rows, err := t.DB.QueryContext(ctx, metadata, args...)
 	if err != nil {
-		return nil, err
+		return nil, Page{}, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		topic := &Topic{}
@@ -87,11 +117,19 @@ func (t *TopicModel) List(limit int) ([]*Topic, error) {
 			&topic.NumSubscribers,
 			&topic.NumPosts,
 		); err != nil {
-			return nil, err
+			return nil, Page{}, err
 		}
 		topics = append(topics, topic)
 	}
-	return topics, nil
+
+	if err := rows.Err(); err != nil {
+		return nil, Page{}, err
+	}
+
+	topics, pageMetadata := paginate(page, topics, backwards, func(topic *Topic) cursor {
+		return cursor{Created: topic.CreatedAt, ID: topic.ID}
+	})
+	return topics, pageMetadata, nil
 }
 
 func (t *TopicModel) Insert(name string) (int, error) {
@@ -149,13 +187,16 @@ func (t *TopicModel) Update(topic *Topic) error {
 	return nil
 }
 
-func (t *TopicModel) AddModerator(topic_id, user_id int, username string) error {
-	query := "INSERT INTO topic_moderators(topic_id, user_id, username) VALUES($1, $2, $3)"
+func (t *TopicModel) AddModerator(topic_id, user_id int, username, role string) error {
+	query := `
+    INSERT INTO topic_moderators(topic_id, user_id, username, role) VALUES($1, $2, $3, $4)
+    ON CONFLICT(topic_id, user_id) DO UPDATE SET role = EXCLUDED.role
+  `
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := t.DB.ExecContext(ctx, query, topic_id, user_id, username)
+	_, err := t.DB.ExecContext(ctx, query, topic_id, user_id, username, role)
 	if err != nil {
 		return err
 	}
@@ -182,7 +223,7 @@ func (t *TopicModel) RemoveModerator(topic_id, user_id int) error {
 }
 
 func (t *TopicModel) Subscribe(topic_id, user_id int) error {
-	insert := "INSERT INTO topic_subscription(topic_id, user_id) VALUES($1, $2)"
+	insert := "INSERT INTO topic_subscription(topic_id, user_id) VALUES($1, $2) ON CONFLICT(topic_id, user_id) DO NOTHING"
 	increment := "UPDATE topics SET num_subscribers = num_subscribers + 1 WHERE id = $1"
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -194,10 +235,18 @@ func (t *TopicModel) Subscribe(topic_id, user_id int) error {
 		return err
 	}
 
-	if _, err = tx.ExecContext(ctx, insert, topic_id, user_id); err != nil {
+	result, err := tx.ExecContext(ctx, insert, topic_id, user_id)
+	if err != nil {
 		return err
 	}
 
+	// already subscribed, the count must not change
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rowsAffected == 0 {
+		return tx.Commit()
+	}
+
 	if _, err = tx.ExecContext(ctx, increment, topic_id); err != nil {
 		return err
 	}
@@ -218,8 +267,15 @@ func (t *TopicModel) Unsubscribe(topic_id, user_id int) error {
 		return err
 	}
 
-	if _, err = tx.ExecContext(ctx, remove, topic_id, user_id); err != nil {
+	result, err := tx.ExecContext(ctx, remove, topic_id, user_id)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
 		return err
+	} else if rowsAffected == 0 {
+		return ErrNoRecordFound
 	}
 
 	if _, err = tx.ExecContext(ctx, decrement, topic_id); err != nil {
@@ -228,3 +284,166 @@ func (t *TopicModel) Unsubscribe(topic_id, user_id int) error {
 
 	return tx.Commit()
 }
+
+func (t *TopicModel) Subscribed(topic_id, user_id int) (bool, error) {
+	query := "SELECT EXISTS(SELECT 1 FROM topic_subscription WHERE topic_id = $1 AND user_id = $2)"
+
+	var subscribed bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := t.DB.QueryRowContext(ctx, query, topic_id, user_id).Scan(&subscribed)
+	return subscribed, err
+}
+
+func (t *TopicModel) GetSubscribed(user_id int) ([]*Topic, error) {
+	query := `
+    SELECT t.id, t.topic_name, t.created, t.num_subscribers, t.num_posts
+    FROM topics AS t JOIN topic_subscription AS s ON t.id = s.topic_id
+    WHERE s.user_id = $1
+    ORDER BY t.topic_name
+  `
+
+	topics := []*Topic{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := t.DB.QueryContext(ctx, query, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		topic := &Topic{}
+		if err := rows.Scan(
+			&topic.ID,
+			&topic.Name,
+			&topic.CreatedAt,
+			&topic.NumSubscribers,
+			&topic.NumPosts,
+		); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return topics, nil
+}
+
+// Role returns the role of the user in the topic; admins own every topic and
+// users without a role are members
+func (t *TopicModel) Role(topic_id, user_id int) (string, error) {
+	query := `
+    SELECT CASE WHEN u.admin THEN 'owner' ELSE coalesce(m.role, 'member') END
+    FROM users AS u LEFT JOIN topic_moderators AS m ON m.user_id = u.id AND m.topic_id = $1
+    WHERE u.id = $2
+  `
+
+	var role string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := t.DB.QueryRowContext(ctx, query, topic_id, user_id).Scan(&role)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return RoleMember, nil
+		default:
+			return "", err
+		}
+	}
+
+	return role, nil
+}
+
+func (t *TopicModel) GetModerators(topic_id int) ([]*Moderator, error) {
+	query := `
+    SELECT topic_id, user_id, username, role, created
+    FROM topic_moderators
+    WHERE topic_id = $1
+    ORDER BY role = 'owner' DESC, created, id
+  `
+
+	moderators := []*Moderator{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := t.DB.QueryContext(ctx, query, topic_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		moderator := &Moderator{}
+		if err := rows.Scan(
+			&moderator.TopicID,
+			&moderator.UserID,
+			&moderator.Username,
+			&moderator.Role,
+			&moderator.Created,
+		); err != nil {
+			return nil, err
+		}
+		moderators = append(moderators, moderator)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return moderators, nil
+}
+
+// ForPost returns the ID of the topic the post belongs to
+func (t *TopicModel) ForPost(post_id int) (int, error) {
+	query := "SELECT topic_id FROM posts WHERE id = $1"
+
+	var topic_id int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := t.DB.QueryRowContext(ctx, query, post_id).Scan(&topic_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrNoRecordFound
+		default:
+			return 0, err
+		}
+	}
+
+	return topic_id, nil
+}
+
+// ForComment returns the ID of the topic the comment belongs to
+func (t *TopicModel) ForComment(comment_id int) (int, error) {
+	query := "SELECT p.topic_id FROM comments AS c JOIN posts AS p ON c.post_id = p.id WHERE c.id = $1"
+
+	var topic_id int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := t.DB.QueryRowContext(ctx, query, comment_id).Scan(&topic_id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrNoRecordFound
+		default:
+			return 0, err
+		}
+	}
+
+	return topic_id, nil
+}
@@ -0,0 +1,28 @@
+package models
+
+import "testing"
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role     string
+		required string
+		want     bool
+	}{
+		{RoleOwner, RoleOwner, true},
+		{RoleOwner, RoleModerator, true},
+		{RoleOwner, RoleMember, true},
+		{RoleModerator, RoleOwner, false},
+		{RoleModerator, RoleModerator, true},
+		{RoleModerator, RoleMember, true},
+		{RoleMember, RoleModerator, false},
+		{RoleMember, RoleMember, true},
+		{"", RoleModerator, false},
+		{"", RoleMember, true},
+	}
+
+	for _, tt := range tests {
+		if got := RoleAllows(tt.role, tt.required); got != tt.want {
+			t.Errorf("RoleAllows(%q, %q) = %t; want %t", tt.role, tt.required, got, tt.want)
+		}
+	}
+}
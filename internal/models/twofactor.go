@@ -0,0 +1,280 @@
+package models
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recovery codes given to a user when 2FA is enabled or the codes are replaced
+const RecoveryCodeCount = 10
+
+// TwoFactor is the two-factor authentication of a user, Secret is empty when
+// it is off
+type TwoFactor struct {
+	Secret string
+	// time step of the last accepted code
+	Step          int64
+	RecoveryCodes int
+}
+
+func (t *TwoFactor) Enabled() bool {
+	return t.Secret != ""
+}
+
+// TwoFactorModel encrypts the secrets with Key, a 32 byte AES-256 key, so a
+// copy of the database is not enough to generate the codes of the users
+type TwoFactorModel struct {
+	DB  *sql.DB
+	Key []byte
+}
+
+// sealSecret encrypts the secret of the user, the ciphertext is bound to the
+// user so it cannot be copied to another account
+func (m *TwoFactorModel) sealSecret(user_id int, secret string) ([]byte, error) {
+	aead, err := m.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, []byte(secret), []byte(strconv.Itoa(user_id))), nil
+}
+
+// openSecret decrypts a secret sealed by sealSecret
+func (m *TwoFactorModel) openSecret(user_id int, sealed []byte) (string, error) {
+	aead, err := m.aead()
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("models: sealed TOTP secret is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	secret, err := aead.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(user_id)))
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+func (m *TwoFactorModel) aead() (cipher.AEAD, error) {
+	if len(m.Key) != 32 {
+		return nil, errors.New("models: the TOTP key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(m.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewRecoveryCodes returns RecoveryCodeCount random codes for the user to
+// write down and their hashes to store
+func NewRecoveryCodes() ([]string, [][]byte, error) {
+	codes := []string{}
+	hashes := [][]byte{}
+
+	for i := 0; i < RecoveryCodeCount; i++ {
+		randomBytes := make([]byte, 10)
+		if _, err := rand.Read(randomBytes); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)) // len is 16
+		codes = append(codes, code[:8]+"-"+code[8:])
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes a code the way it was typed, without the case,
+// spaces and dashes that do not matter
+func HashRecoveryCode(code string) []byte {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// Get returns the two-factor authentication of the user with the number of
+// unused recovery codes
+func (m *TwoFactorModel) Get(user_id int) (*TwoFactor, error) {
+	query := `
+    SELECT u.totp_secret, u.totp_step,
+      (SELECT count(*) FROM recovery_codes AS c WHERE c.user_id = u.id AND c.used_at IS NULL)
+    FROM users AS u WHERE u.id = $1
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	two_factor := &TwoFactor{}
+	var sealed []byte
+	err := m.DB.QueryRowContext(ctx, query, user_id).Scan(&sealed, &two_factor.Step, &two_factor.RecoveryCodes)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecordFound
+		}
+		return nil, err
+	}
+
+	if sealed != nil {
+		two_factor.Secret, err = m.openSecret(user_id, sealed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return two_factor, nil
+}
+
+// Enable turns on two-factor authentication with the secret the user proved
+// to have with the code of step, replacing any recovery codes
+func (m *TwoFactorModel) Enable(user_id int, secret string, step int64, hashes [][]byte) error {
+	update := "UPDATE users SET totp_secret = $2, totp_step = $3 WHERE id = $1"
+
+	sealed, err := m.sealSecret(user_id, secret)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, update, user_id, sealed, step)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNoRecordFound
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, user_id, hashes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Disable turns off two-factor authentication and deletes the recovery codes
+func (m *TwoFactorModel) Disable(user_id int) error {
+	update := "UPDATE users SET totp_secret = NULL, totp_step = 0 WHERE id = $1"
+	codes := "DELETE FROM recovery_codes WHERE user_id = $1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, update, user_id); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, codes, user_id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes makes the hashes the only recovery codes of the user
+func (m *TwoFactorModel) ReplaceRecoveryCodes(user_id int, hashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = replaceRecoveryCodes(ctx, tx, user_id, hashes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, user_id int, hashes [][]byte) error {
+	remove := "DELETE FROM recovery_codes WHERE user_id = $1"
+	insert := "INSERT INTO recovery_codes(user_id, hash) VALUES($1, $2)"
+
+	_, err := tx.ExecContext(ctx, remove, user_id)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		_, err = tx.ExecContext(ctx, insert, user_id, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseStep accepts a code of the time step, unless a code of the same or a
+// later step was already accepted
+func (m *TwoFactorModel) UseStep(user_id int, step int64) (bool, error) {
+	query := "UPDATE users SET totp_step = $2 WHERE id = $1 AND totp_secret IS NOT NULL AND totp_step < $2"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, user_id, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// UseRecoveryCode accepts the recovery code with the hash if the user has it
+// and has not used it yet
+func (m *TwoFactorModel) UseRecoveryCode(user_id int, hash []byte) (bool, error) {
+	query := "UPDATE recovery_codes SET used_at = now() WHERE user_id = $1 AND hash = $2 AND used_at IS NULL"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, user_id, hash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
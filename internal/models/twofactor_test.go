@@ -0,0 +1,52 @@
+package models
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealSecret(t *testing.T) {
+	m := &TwoFactorModel{Key: bytes.Repeat([]byte{1}, 32)}
+	secret := "JBSWY3DPEHPK3PXP"
+
+	sealed, err := m.sealSecret(7, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte(secret)) {
+		t.Fatal("the sealed secret contains the secret")
+	}
+
+	got, err := m.openSecret(7, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != secret {
+		t.Errorf("got %q; want %q", got, secret)
+	}
+
+	again, err := m.sealSecret(7, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, sealed) {
+		t.Error("sealing twice gave the same ciphertext")
+	}
+
+	if _, err := m.openSecret(8, sealed); err == nil {
+		t.Error("opened the secret of user 7 as user 8")
+	}
+
+	other := &TwoFactorModel{Key: bytes.Repeat([]byte{2}, 32)}
+	if _, err := other.openSecret(7, sealed); err == nil {
+		t.Error("opened the secret with another key")
+	}
+
+	if _, err := m.openSecret(7, sealed[:5]); err == nil {
+		t.Error("opened a truncated secret")
+	}
+
+	if _, err := (&TwoFactorModel{}).sealSecret(7, secret); err == nil {
+		t.Error("sealed without a key")
+	}
+}
@@ -11,14 +11,14 @@ import (
 )
 
 type User struct {
-	ID        int
-	Name      string
-	Email     string
-	Password  Password
-	Created   time.Time
-	Activated bool
-	Admin     bool
-	Version   int
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"-"`
+	Password  Password  `json:"-"`
+	Created   time.Time `json:"created"`
+	Activated bool      `json:"activated"`
+	Admin     bool      `json:"admin"`
+	Version   int       `json:"-"`
 }
 
 type UserModel struct {
@@ -26,7 +26,7 @@ type UserModel struct {
 }
 
 func (m *UserModel) Get(user_id int) (*User, error) {
-	query := "SELECT id, name, email, password_hash, created_at, activated, version FROM users WHERE id = $1"
+	query := "SELECT id, name, email, password_hash, created_at, activated, admin, version FROM users WHERE id = $1"
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -39,6 +39,7 @@ func (m *UserModel) Get(user_id int) (*User, error) {
 		&user.Password.Hash,
 		&user.Created,
 		&user.Activated,
+		&user.Admin,
 		&user.Version,
 	); errors.Is(err, sql.ErrNoRows) {
 		return nil, ErrNoRecordFound
@@ -263,7 +264,7 @@ func (m *UserModel) Delete(user_id int) error {
 }
 
 func (m *UserModel) List() ([]*User, error) {
-	query := "SELECT id, name, email, created FROM users ORDER BY id LIMIT 10"
+	query := "SELECT id, name, email, created_at FROM users ORDER BY id LIMIT 10"
 
 	users := []*User{}
 
@@ -314,16 +315,19 @@ func (m *UserModel) Update(user *User) error {
 	}
 }
 
+// Authenticate returns the ID of the user with the email and password, a
+// locked account is refused without checking the password
 func (m *UserModel) Authenticate(email, password string) (int, error) {
-	query := "SELECT id, password_hash FROM users WHERE email = $1"
+	query := "SELECT id, password_hash, COALESCE(locked_until > now(), false) FROM users WHERE email = $1"
 
 	var id int
 	var hashed_password []byte
+	var locked bool
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(&id, &hashed_password)
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&id, &hashed_password, &locked)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return -1, ErrInvalidCredentials
@@ -331,6 +335,10 @@ func (m *UserModel) Authenticate(email, password string) (int, error) {
 		return -1, err
 	}
 
+	if locked {
+		return -1, ErrAccountLocked
+	}
+
 	err = bcrypt.CompareHashAndPassword(hashed_password, []byte(password))
 	if err != nil {
 		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
@@ -342,6 +350,85 @@ func (m *UserModel) Authenticate(email, password string) (int, error) {
 	return id, nil
 }
 
+const (
+	// failed logins in a row before the account is locked
+	LoginAttempts = 5
+	// the first lockout, doubled by every failed login after it
+	lockoutBase = time.Minute
+	lockoutMax  = time.Hour
+)
+
+// Lockout is the state of the failed logins of an account
+type Lockout struct {
+	UserID int
+	Name   string
+	Email  string
+	Failed int
+	// zero when the account is not locked
+	Until time.Time
+}
+
+// LoginFailed counts a failed login for the account with the email and locks
+// it once LoginAttempts are reached; failed logins while it is locked are
+// refused before they get here, so they do not make the lockout longer
+func (m *UserModel) LoginFailed(email string) (*Lockout, error) {
+	query := `
+    UPDATE users SET
+      failed_logins = failed_logins + 1,
+      locked_until = CASE WHEN failed_logins + 1 >= $2
+        THEN now() + make_interval(secs => LEAST($3 * power(2, LEAST(failed_logins + 1 - $2, 16)), $4))
+        ELSE locked_until END
+    WHERE email = $1
+    RETURNING id, name, email, failed_logins, locked_until
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return m.scanLockout(m.DB.QueryRowContext(ctx, query, email, LoginAttempts, lockoutBase.Seconds(), lockoutMax.Seconds()))
+}
+
+// LockoutOf returns the failed logins of the account with the email, the
+// lockout is zero once it has ended
+func (m *UserModel) LockoutOf(email string) (*Lockout, error) {
+	query := `
+    SELECT id, name, email, failed_logins, CASE WHEN locked_until > now() THEN locked_until END
+    FROM users WHERE email = $1
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return m.scanLockout(m.DB.QueryRowContext(ctx, query, email))
+}
+
+func (m *UserModel) scanLockout(row *sql.Row) (*Lockout, error) {
+	lockout := &Lockout{}
+	var until sql.NullTime
+
+	err := row.Scan(&lockout.UserID, &lockout.Name, &lockout.Email, &lockout.Failed, &until)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecordFound
+		}
+		return nil, err
+	}
+
+	lockout.Until = until.Time
+	return lockout, nil
+}
+
+// LoginSucceeded forgets the failed logins of the user
+func (m *UserModel) LoginSucceeded(user_id int) error {
+	query := "UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = $1 AND failed_logins > 0"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, user_id)
+	return err
+}
+
 func (m *UserModel) Exists(id int) (bool, error) {
 	query := "SELECT EXISTS(SELECT true FROM users WHERE id = $1)"
 
@@ -354,8 +441,48 @@ func (m *UserModel) Exists(id int) (bool, error) {
 	return exists, err
 }
 
+// SessionGeneration returns the generation sessions of the user must have
+// been logged in with to stay logged in
+func (m *UserModel) SessionGeneration(id int) (int, error) {
+	query := "SELECT session_generation FROM users WHERE id = $1"
+
+	var generation int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&generation)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecordFound
+		}
+		return 0, err
+	}
+	return generation, nil
+}
+
+// EndSessions logs the user out of every session by moving on to the next
+// generation, which it returns
+func (m *UserModel) EndSessions(id int) (int, error) {
+	query := "UPDATE users SET session_generation = session_generation + 1 WHERE id = $1 RETURNING session_generation"
+
+	var generation int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&generation)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecordFound
+		}
+		return 0, err
+	}
+	return generation, nil
+}
+
 func (m *UserModel) GetByEmail(email string) (*User, error) {
-	query := "SELECT id, name, email, password_hash, created_at, activated, version FROM users WHERE email = $1"
+	query := "SELECT id, name, email, password_hash, created_at, activated, admin, version FROM users WHERE email = $1"
 
 	user := &User{}
 
@@ -369,6 +496,7 @@ func (m *UserModel) GetByEmail(email string) (*User, error) {
 		&user.Password.Hash,
 		&user.Created,
 		&user.Activated,
+		&user.Admin,
 		&user.Version,
 	)
 	if err != nil {
@@ -385,7 +513,7 @@ func (m *UserModel) GetByToken(token, scope string) (*User, error) {
 	hash := sha256.Sum256([]byte(token))
 
 	query := `
-    SELECT u.id, u.name, u.email, u.password_hash, u.created_at, u.activated, u.version
+    SELECT u.id, u.name, u.email, u.password_hash, u.created_at, u.activated, u.admin, u.version
     FROM users AS u JOIN tokens AS t on u.id = t.user_id
     WHERE t.hash = $1 AND t.scope = $2 AND t.expiration > $3
   `
@@ -402,6 +530,7 @@ func (m *UserModel) GetByToken(token, scope string) (*User, error) {
 		&user.Password.Hash,
 		&user.Created,
 		&user.Activated,
+		&user.Admin,
 		&user.Version,
 	)
 	if err != nil {
@@ -414,22 +543,37 @@ func (m *UserModel) GetByToken(token, scope string) (*User, error) {
 	return user, nil
 }
 
+// UpdatePassword stores the hash set with user.Password.Set and deletes every
+// token of the user, so a leaked activation, reset or API token cannot be
+// used after the password changed
 func (m *UserModel) UpdatePassword(user *User) error {
-	query := "UPDATE users SET password_hash = $1 WHERE id = $2"
+	update := `
+    UPDATE users SET password_hash = $1, version = version + 1
+    WHERE id = $2 AND version = $3
+    RETURNING version
+  `
+	tokens := "DELETE FROM tokens WHERE user_id = $1"
 
-	new_hash, err := bcrypt.GenerateFromPassword([]byte(*user.Password.Plaintext), bcrypt.DefaultCost)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	result, err := m.DB.Exec(query, new_hash, user.ID)
+	err = tx.QueryRowContext(ctx, update, user.Password.Hash, user.ID, user.Version).Scan(&user.Version)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrConcurrencyControl
+		}
 		return err
 	}
 
-	if rowsAffected, err := result.RowsAffected(); rowsAffected == 0 {
-		return ErrNoRecordFound
-	} else {
+	if _, err := tx.ExecContext(ctx, tokens, user.ID); err != nil {
 		return err
 	}
+
+	return tx.Commit()
 }
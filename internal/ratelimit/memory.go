@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// Memory keeps the buckets in the process, every instance of the application
+// has its own
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, rate Rate) (bool, time.Duration, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tokens := float64(rate.Burst)
+	if b, ok := m.buckets[key]; ok {
+		tokens = refill(b.tokens, now.Sub(b.updated), rate)
+	}
+
+	tokens, allowed, wait := take(tokens, rate)
+	m.buckets[key] = &bucket{tokens: tokens, updated: now, full: fullAt(tokens, rate, now)}
+	return allowed, wait, nil
+}
+
+func (m *Memory) Cleanup(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, b := range m.buckets {
+		if b.full.Before(before) {
+			delete(m.buckets, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Postgres keeps the buckets in the rate_limits table so that every instance
+// of the application shares them
+type Postgres struct {
+	DB *sql.DB
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{DB: db}
+}
+
+func (p *Postgres) Allow(ctx context.Context, key string, rate Rate) (bool, time.Duration, error) {
+	create := `INSERT INTO rate_limits (key, tokens, updated_at, full_at)
+		VALUES ($1, $2, now(), now())
+		ON CONFLICT (key) DO NOTHING`
+	// the clock of the database is the same for every instance
+	query := "SELECT tokens, updated_at, now() FROM rate_limits WHERE key = $1 FOR UPDATE"
+	update := "UPDATE rate_limits SET tokens = $2, updated_at = $3, full_at = $4 WHERE key = $1"
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, create, key, rate.Burst)
+	if err != nil {
+		return false, 0, err
+	}
+
+	var tokens float64
+	var updated, now time.Time
+	err = tx.QueryRowContext(ctx, query, key).Scan(&tokens, &updated, &now)
+	if err != nil {
+		return false, 0, err
+	}
+
+	tokens = refill(tokens, now.Sub(updated), rate)
+	tokens, allowed, wait := take(tokens, rate)
+
+	_, err = tx.ExecContext(ctx, update, key, tokens, now, fullAt(tokens, rate, now))
+	if err != nil {
+		return false, 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return allowed, wait, nil
+}
+
+func (p *Postgres) Cleanup(ctx context.Context, before time.Time) error {
+	query := "DELETE FROM rate_limits WHERE full_at < $1"
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := p.DB.ExecContext(ctx, query, before)
+	return err
+}
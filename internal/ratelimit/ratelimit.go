@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Rate is a token bucket: Burst requests can be made at once and the bucket
+// gets one token back every Every
+type Rate struct {
+	Burst int
+	Every time.Duration
+}
+
+// Limiter keeps a token bucket for every key, keys are chosen by the
+// application
+type Limiter interface {
+	// Allow takes a token from the bucket of key, it returns false and how
+	// long until the next token when the bucket is empty
+	Allow(ctx context.Context, key string, rate Rate) (bool, time.Duration, error)
+	// Cleanup forgets the buckets that have been full since before, a full
+	// bucket is the same as no bucket
+	Cleanup(ctx context.Context, before time.Time) error
+}
+
+// refill returns the tokens of a bucket that had tokens elapsed ago
+func refill(tokens float64, elapsed time.Duration, rate Rate) float64 {
+	tokens += elapsed.Seconds() / rate.Every.Seconds()
+	return min(tokens, float64(rate.Burst))
+}
+
+// fullAt returns when a bucket with tokens will be full again if nothing
+// takes from it
+func fullAt(tokens float64, rate Rate, now time.Time) time.Time {
+	missing := float64(rate.Burst) - tokens
+	return now.Add(time.Duration(missing * float64(rate.Every)))
+}
+
+// take takes a token if there is one, otherwise it returns how long until
+// the next one
+func take(tokens float64, rate Rate) (float64, bool, time.Duration) {
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	return tokens, false, time.Duration((1 - tokens) * float64(rate.Every))
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRefill(t *testing.T) {
+	rate := Rate{Burst: 5, Every: 10 * time.Second}
+
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"no time", 2, 0, 2},
+		{"one token", 2, 10 * time.Second, 3},
+		{"part of a token", 0, 5 * time.Second, 0.5},
+		{"up to the burst", 4, time.Minute, 5},
+		{"full", 5, time.Hour, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refill(tt.tokens, tt.elapsed, rate); got != tt.want {
+				t.Errorf("got %v tokens; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTake(t *testing.T) {
+	rate := Rate{Burst: 5, Every: 10 * time.Second}
+
+	tests := []struct {
+		name        string
+		tokens      float64
+		wantTokens  float64
+		wantAllowed bool
+		wantWait    time.Duration
+	}{
+		{"full", 5, 4, true, 0},
+		{"last token", 1, 0, true, 0},
+		{"empty", 0, 0, false, 10 * time.Second},
+		{"part of a token", 0.25, 0.25, false, 7500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, allowed, wait := take(tt.tokens, rate)
+			if tokens != tt.wantTokens || allowed != tt.wantAllowed || wait != tt.wantWait {
+				t.Errorf("got %v, %t, %v; want %v, %t, %v", tokens, allowed, wait, tt.wantTokens, tt.wantAllowed, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestFullAt(t *testing.T) {
+	rate := Rate{Burst: 5, Every: 10 * time.Second}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	if got := fullAt(5, rate, now); !got.Equal(now) {
+		t.Errorf("full bucket: got %v; want %v", got, now)
+	}
+	if got, want := fullAt(2.5, rate, now), now.Add(25*time.Second); !got.Equal(want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	rate := Rate{Burst: 3, Every: time.Hour}
+
+	for i := 0; i < rate.Burst; i++ {
+		allowed, _, err := m.Allow(ctx, "a", rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !allowed {
+			t.Fatalf("request %d was not allowed", i+1)
+		}
+	}
+
+	allowed, wait, err := m.Allow(ctx, "a", rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed {
+		t.Error("allowed a request over the burst")
+	}
+	if wait <= 59*time.Minute || wait > time.Hour {
+		t.Errorf("got wait %v; want about an hour", wait)
+	}
+
+	// buckets are per key
+	if allowed, _, _ := m.Allow(ctx, "b", rate); !allowed {
+		t.Error("the bucket of another key was empty")
+	}
+}
+
+func TestMemoryCleanup(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	m.Allow(ctx, "short", Rate{Burst: 1, Every: time.Millisecond})
+	m.Allow(ctx, "long", Rate{Burst: 1, Every: time.Hour})
+
+	if err := m.Cleanup(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := m.buckets["short"]; ok {
+		t.Error("kept a bucket that is full")
+	}
+	if _, ok := m.buckets["long"]; !ok {
+		t.Error("forgot a bucket that is not full")
+	}
+}
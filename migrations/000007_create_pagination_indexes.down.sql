@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS comments_post_likes_id_idx;
+DROP INDEX IF EXISTS comments_post_created_id_idx;
+DROP INDEX IF EXISTS posts_topic_likes_id_idx;
+DROP INDEX IF EXISTS posts_topic_created_id_idx;
+DROP INDEX IF EXISTS posts_likes_id_idx;
+DROP INDEX IF EXISTS posts_created_id_idx;
+DROP INDEX IF EXISTS topics_created_id_idx;
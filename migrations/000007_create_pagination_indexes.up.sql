@@ -0,0 +1,9 @@
+CREATE INDEX IF NOT EXISTS topics_created_id_idx ON topics(created, id);
+
+CREATE INDEX IF NOT EXISTS posts_created_id_idx ON posts(created, id);
+CREATE INDEX IF NOT EXISTS posts_likes_id_idx ON posts(likes, id);
+CREATE INDEX IF NOT EXISTS posts_topic_created_id_idx ON posts(topic_id, created, id);
+CREATE INDEX IF NOT EXISTS posts_topic_likes_id_idx ON posts(topic_id, likes, id);
+
+CREATE INDEX IF NOT EXISTS comments_post_created_id_idx ON comments(post_id, created, id);
+CREATE INDEX IF NOT EXISTS comments_post_likes_id_idx ON comments(post_id, likes, id);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS comments_paths_ancestor_idx;
+DROP INDEX IF EXISTS comments_paths_descendant_idx;
+DROP INDEX IF EXISTS comments_liked_comment_id_idx;
+ALTER TABLE comments
+  DROP COLUMN IF EXISTS controversy,
+  DROP COLUMN IF EXISTS downs,
+  DROP COLUMN IF EXISTS ups;
@@ -0,0 +1,30 @@
+-- votes of every comment, kept by the vote transactions of CommentModel; a
+-- new comment starts with the like of its author.
+-- controversy is high when a comment has many votes split evenly between
+-- likes and dislikes: (ups + downs) ^ (min(ups, downs) / max(ups, downs))
+ALTER TABLE comments
+  ADD COLUMN IF NOT EXISTS ups int NOT NULL DEFAULT 1,
+  ADD COLUMN IF NOT EXISTS downs int NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS controversy double precision NOT NULL DEFAULT 0;
+
+UPDATE comments AS c SET
+  ups = v.ups,
+  downs = v.downs,
+  controversy = CASE WHEN v.ups = 0 OR v.downs = 0 THEN 0
+    ELSE power(v.ups + v.downs, LEAST(v.ups, v.downs)::float / GREATEST(v.ups, v.downs))
+  END
+FROM (
+  SELECT
+    c.id,
+    count(l.id) FILTER (WHERE l.score = 1) AS ups,
+    count(l.id) FILTER (WHERE l.score = -1) AS downs
+  FROM comments AS c
+  LEFT JOIN comments_liked AS l ON l.comment_id = c.id
+  GROUP BY c.id
+) AS v
+WHERE v.id = c.id;
+
+CREATE INDEX IF NOT EXISTS comments_liked_comment_id_idx ON comments_liked(comment_id);
+CREATE INDEX IF NOT EXISTS comments_paths_descendant_idx ON comments_paths(descendant, path_length);
+-- comment trees are read down to a depth and replies are counted per comment
+CREATE INDEX IF NOT EXISTS comments_paths_ancestor_idx ON comments_paths(ancestor, path_length);
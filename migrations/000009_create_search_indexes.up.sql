@@ -0,0 +1,36 @@
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS search tsvector;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS search tsvector;
+
+-- titles rank above post bodies
+CREATE OR REPLACE FUNCTION posts_search_trigger() RETURNS trigger AS $$
+BEGIN
+  NEW.search :=
+    setweight(to_tsvector('english', coalesce(NEW.title, '')), 'A') ||
+    setweight(to_tsvector('english', coalesce(NEW.content, '')), 'B');
+  RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION comments_search_trigger() RETURNS trigger AS $$
+BEGIN
+  NEW.search := setweight(to_tsvector('english', coalesce(NEW.content, '')), 'B');
+  RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS posts_search_update ON posts;
+CREATE TRIGGER posts_search_update
+  BEFORE INSERT OR UPDATE OF title, content ON posts
+  FOR EACH ROW EXECUTE FUNCTION posts_search_trigger();
+
+DROP TRIGGER IF EXISTS comments_search_update ON comments;
+CREATE TRIGGER comments_search_update
+  BEFORE INSERT OR UPDATE OF content ON comments
+  FOR EACH ROW EXECUTE FUNCTION comments_search_trigger();
+
+-- fill the columns for existing rows, the triggers take care of new ones
+UPDATE posts SET title = title;
+UPDATE comments SET content = content;
+
+CREATE INDEX IF NOT EXISTS posts_search_idx ON posts USING GIN(search);
+CREATE INDEX IF NOT EXISTS comments_search_idx ON comments USING GIN(search);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS topic_subscription_user_idx;
+DROP INDEX IF EXISTS posts_liked_post_created_idx;
+DROP INDEX IF EXISTS posts_topic_rising_idx;
+DROP INDEX IF EXISTS posts_topic_hot_idx;
+DROP INDEX IF EXISTS posts_rising_idx;
+DROP INDEX IF EXISTS posts_hot_idx;
+ALTER TABLE posts DROP COLUMN IF EXISTS rising;
+ALTER TABLE posts DROP COLUMN IF EXISTS hot;
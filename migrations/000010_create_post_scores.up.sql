@@ -0,0 +1,12 @@
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS hot double precision NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS rising double precision NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS posts_hot_idx ON posts(hot, id);
+CREATE INDEX IF NOT EXISTS posts_rising_idx ON posts(rising, id);
+CREATE INDEX IF NOT EXISTS posts_topic_hot_idx ON posts(topic_id, hot, id);
+CREATE INDEX IF NOT EXISTS posts_topic_rising_idx ON posts(topic_id, rising, id);
+
+-- recent likes of a post, used to compute the rising score
+CREATE INDEX IF NOT EXISTS posts_liked_post_created_idx ON posts_liked(post_id, created);
+
+CREATE INDEX IF NOT EXISTS topic_subscription_user_idx ON topic_subscription(user_id);
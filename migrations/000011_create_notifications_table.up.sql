@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS notifications (
+  id serial PRIMARY KEY,
+  user_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  actor_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  actor_name text NOT NULL,
+  kind text NOT NULL,
+  post_id int REFERENCES posts(id) ON DELETE CASCADE NOT NULL,
+  comment_id int REFERENCES comments(id) ON DELETE CASCADE,
+  created timestamp(0) with time zone NOT NULL DEFAULT now(),
+  read_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_created_id_idx ON notifications(user_id, created, id);
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications(user_id) WHERE read_at IS NULL;
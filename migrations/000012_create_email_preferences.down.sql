@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS notifications_unemailed_idx;
+ALTER TABLE notifications DROP COLUMN IF EXISTS emailed_at;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_digest_check;
+ALTER TABLE users DROP COLUMN IF EXISTS last_digest_at;
+ALTER TABLE users DROP COLUMN IF EXISTS email_digest;
+ALTER TABLE users DROP COLUMN IF EXISTS email_mentions;
+ALTER TABLE users DROP COLUMN IF EXISTS email_replies;
@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_replies bool NOT NULL DEFAULT true;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_mentions bool NOT NULL DEFAULT true;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_digest text NOT NULL DEFAULT 'off';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_digest_at timestamp(0) with time zone NOT NULL DEFAULT now();
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_digest_check;
+ALTER TABLE users ADD CONSTRAINT users_email_digest_check CHECK (email_digest IN ('off', 'daily', 'weekly'));
+
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS emailed_at timestamp(0) with time zone;
+-- notifications from before emails existed are not sent, the first emails
+-- and digests would otherwise contain every one of them
+UPDATE notifications SET emailed_at = now() WHERE emailed_at IS NULL;
+CREATE INDEX IF NOT EXISTS notifications_unemailed_idx ON notifications(id) WHERE emailed_at IS NULL;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS tokens_user_scope_idx;
+ALTER TABLE tokens DROP COLUMN IF EXISTS created;
@@ -0,0 +1,3 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created timestamp(0) with time zone NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS tokens_user_scope_idx ON tokens(user_id, scope);
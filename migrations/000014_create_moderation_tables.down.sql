@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS moderation_log;
+DROP FUNCTION IF EXISTS moderation_log_append_only;
+DROP TABLE IF EXISTS reports;
+ALTER TABLE comments DROP COLUMN IF EXISTS removed_by;
+ALTER TABLE comments DROP COLUMN IF EXISTS removed_at;
+ALTER TABLE posts DROP COLUMN IF EXISTS removed_by;
+ALTER TABLE posts DROP COLUMN IF EXISTS removed_at;
+ALTER TABLE posts DROP COLUMN IF EXISTS locked;
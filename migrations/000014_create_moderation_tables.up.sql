@@ -0,0 +1,56 @@
+ALTER TABLE posts
+  ADD COLUMN IF NOT EXISTS locked boolean NOT NULL DEFAULT false,
+  ADD COLUMN IF NOT EXISTS removed_at timestamp(0) with time zone,
+  ADD COLUMN IF NOT EXISTS removed_by int REFERENCES users(id) ON DELETE SET NULL;
+
+ALTER TABLE comments
+  ADD COLUMN IF NOT EXISTS removed_at timestamp(0) with time zone,
+  ADD COLUMN IF NOT EXISTS removed_by int REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS reports (
+  id serial PRIMARY KEY,
+  topic_id int REFERENCES topics(id) ON DELETE CASCADE NOT NULL,
+  post_id int REFERENCES posts(id) ON DELETE CASCADE NOT NULL,
+  comment_id int REFERENCES comments(id) ON DELETE CASCADE,
+  user_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  reason text NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT now(),
+  resolved_at timestamp(0) with time zone,
+  resolved_by int REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- a user can only have one open report for the same post or comment
+CREATE UNIQUE INDEX IF NOT EXISTS reports_open_user_target_idx ON reports(user_id, post_id, coalesce(comment_id, 0)) WHERE resolved_at IS NULL;
+CREATE INDEX IF NOT EXISTS reports_open_topic_idx ON reports(topic_id, created) WHERE resolved_at IS NULL;
+
+-- the log outlives the posts, comments and users it mentions, so it only
+-- keeps their IDs and names instead of foreign keys
+CREATE TABLE IF NOT EXISTS moderation_log (
+  id serial PRIMARY KEY,
+  topic_id int REFERENCES topics(id) NOT NULL,
+  moderator_id int NOT NULL,
+  moderator_name text NOT NULL,
+  action text NOT NULL,
+  post_id int,
+  comment_id int,
+  target_user_id int,
+  target_username text NOT NULL DEFAULT '',
+  reason text NOT NULL DEFAULT '',
+  created timestamp(0) with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS moderation_log_topic_created_id_idx ON moderation_log(topic_id, created, id);
+
+CREATE OR REPLACE FUNCTION moderation_log_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'moderation_log is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS moderation_log_no_update ON moderation_log;
+CREATE TRIGGER moderation_log_no_update BEFORE UPDATE OR DELETE ON moderation_log
+  FOR EACH ROW EXECUTE FUNCTION moderation_log_append_only();
+
+DROP TRIGGER IF EXISTS moderation_log_no_truncate ON moderation_log;
+CREATE TRIGGER moderation_log_no_truncate BEFORE TRUNCATE ON moderation_log
+  FOR EACH STATEMENT EXECUTE FUNCTION moderation_log_append_only();
@@ -0,0 +1,2 @@
+ALTER TABLE topic_moderators DROP CONSTRAINT IF EXISTS topic_moderators_role_check;
+ALTER TABLE topic_moderators DROP COLUMN IF EXISTS role;
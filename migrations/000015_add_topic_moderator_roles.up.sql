@@ -0,0 +1,6 @@
+ALTER TABLE topic_moderators ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'moderator';
+ALTER TABLE topic_moderators DROP CONSTRAINT IF EXISTS topic_moderators_role_check;
+ALTER TABLE topic_moderators ADD CONSTRAINT topic_moderators_role_check CHECK (role IN ('owner', 'moderator'));
+
+-- the seeded moderators of the default topics own them
+UPDATE topic_moderators SET role = 'owner' WHERE user_id = 1;
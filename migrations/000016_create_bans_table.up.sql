@@ -0,0 +1,14 @@
+-- bans without a topic are site-wide, bans without an expiry are permanent
+CREATE TABLE IF NOT EXISTS bans (
+  id serial PRIMARY KEY,
+  user_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  topic_id int REFERENCES topics(id) ON DELETE CASCADE,
+  banned_by int REFERENCES users(id) ON DELETE SET NULL,
+  reason text NOT NULL DEFAULT '',
+  created timestamp(0) with time zone NOT NULL DEFAULT now(),
+  expires_at timestamp(0) with time zone,
+  lifted_at timestamp(0) with time zone
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS bans_user_topic_idx ON bans(user_id, (coalesce(topic_id, 0))) WHERE lifted_at IS NULL;
+CREATE INDEX IF NOT EXISTS bans_topic_idx ON bans(topic_id) WHERE lifted_at IS NULL;
@@ -0,0 +1,15 @@
+-- deleted posts and comments stay in place as tombstones so the comment
+-- trees below them keep their shape; the purge job erases their text once
+-- the retention period is over
+ALTER TABLE posts
+  ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone,
+  ADD COLUMN IF NOT EXISTS deleted_by int REFERENCES users(id) ON DELETE SET NULL,
+  ADD COLUMN IF NOT EXISTS purged boolean NOT NULL DEFAULT false;
+
+ALTER TABLE comments
+  ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone,
+  ADD COLUMN IF NOT EXISTS deleted_by int REFERENCES users(id) ON DELETE SET NULL,
+  ADD COLUMN IF NOT EXISTS purged boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS posts_deleted_at_idx ON posts(deleted_at) WHERE deleted_at IS NOT NULL AND NOT purged;
+CREATE INDEX IF NOT EXISTS comments_deleted_at_idx ON comments(deleted_at) WHERE deleted_at IS NOT NULL AND NOT purged;
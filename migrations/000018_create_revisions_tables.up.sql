@@ -0,0 +1,31 @@
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS edited_at timestamp(0) with time zone;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS edited_at timestamp(0) with time zone;
+
+-- every version of a post or comment, revision 1 is the original
+CREATE TABLE IF NOT EXISTS post_revisions (
+  id serial PRIMARY KEY,
+  post_id int REFERENCES posts(id) ON DELETE CASCADE NOT NULL,
+  revision int NOT NULL,
+  title varchar(256) NOT NULL,
+  content text NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT now(),
+  UNIQUE(post_id, revision)
+);
+
+CREATE TABLE IF NOT EXISTS comment_revisions (
+  id serial PRIMARY KEY,
+  comment_id int REFERENCES comments(id) ON DELETE CASCADE NOT NULL,
+  revision int NOT NULL,
+  content text NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT now(),
+  UNIQUE(comment_id, revision)
+);
+
+-- the current text of existing posts and comments is the only version we have
+INSERT INTO post_revisions(post_id, revision, title, content, created)
+  SELECT id, 1, title, content, coalesce(last_updated, created, now()) FROM posts
+  ON CONFLICT DO NOTHING;
+
+INSERT INTO comment_revisions(comment_id, revision, content, created)
+  SELECT id, 1, content, coalesce(last_updated, created, now()) FROM comments
+  ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+ALTER TABLE comments DROP COLUMN IF EXISTS revision;
+ALTER TABLE posts DROP COLUMN IF EXISTS revision;
@@ -0,0 +1,11 @@
+-- the revision shown for a post or comment, rendered markdown is cached by it
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS revision int NOT NULL DEFAULT 1;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS revision int NOT NULL DEFAULT 1;
+
+UPDATE posts AS p SET revision = r.revision
+  FROM (SELECT post_id, max(revision) AS revision FROM post_revisions GROUP BY post_id) AS r
+  WHERE r.post_id = p.id;
+
+UPDATE comments AS c SET revision = r.revision
+  FROM (SELECT comment_id, max(revision) AS revision FROM comment_revisions GROUP BY comment_id) AS r
+  WHERE r.comment_id = c.id;
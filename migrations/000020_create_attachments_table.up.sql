@@ -0,0 +1,19 @@
+-- files uploaded with a post, or with one of its comments when comment_id is
+-- set; the files themselves live in the storage backend under storage_key
+CREATE TABLE IF NOT EXISTS attachments (
+  id serial PRIMARY KEY,
+  user_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  post_id int REFERENCES posts(id) ON DELETE CASCADE NOT NULL,
+  comment_id int REFERENCES comments(id) ON DELETE CASCADE,
+  storage_key varchar(256) NOT NULL UNIQUE,
+  thumb_key varchar(256) NOT NULL DEFAULT '',
+  filename varchar(256) NOT NULL,
+  content_type varchar(128) NOT NULL,
+  size bigint NOT NULL,
+  width int NOT NULL DEFAULT 0,
+  height int NOT NULL DEFAULT 0,
+  created timestamp(0) with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS attachments_post_id_idx ON attachments(post_id) WHERE comment_id IS NULL;
+CREATE INDEX IF NOT EXISTS attachments_comment_id_idx ON attachments(comment_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS link_previews;
+DROP INDEX IF EXISTS posts_topic_link_key_idx;
+ALTER TABLE posts DROP COLUMN IF EXISTS link_key;
+ALTER TABLE posts DROP COLUMN IF EXISTS link;
@@ -0,0 +1,18 @@
+-- link posts carry a URL, link_key is the normalized URL used to detect the
+-- same link being submitted to a topic twice
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS link text;
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS link_key text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS posts_topic_link_key_idx ON posts(topic_id, link_key)
+  WHERE link_key IS NOT NULL AND removed_at IS NULL AND deleted_at IS NULL;
+
+-- OpenGraph metadata of the link, filled in by a background fetch; the image
+-- is a thumbnail kept in the attachment storage
+CREATE TABLE IF NOT EXISTS link_previews (
+  post_id int PRIMARY KEY REFERENCES posts(id) ON DELETE CASCADE,
+  title varchar(256) NOT NULL DEFAULT '',
+  description varchar(1024) NOT NULL DEFAULT '',
+  site_name varchar(128) NOT NULL DEFAULT '',
+  image_key varchar(256) NOT NULL DEFAULT '',
+  fetched timestamp(0) with time zone NOT NULL DEFAULT now()
+);
@@ -0,0 +1,42 @@
+-- poll posts have a poll with two or more options; multiple allows voting for
+-- several options, a poll without closes_at stays open
+CREATE TABLE IF NOT EXISTS polls (
+  post_id int PRIMARY KEY REFERENCES posts(id) ON DELETE CASCADE,
+  multiple boolean NOT NULL DEFAULT false,
+  closes_at timestamp(0) with time zone,
+  created timestamp(0) with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS poll_options (
+  id serial PRIMARY KEY,
+  post_id int REFERENCES polls(post_id) ON DELETE CASCADE NOT NULL,
+  position int NOT NULL,
+  label varchar(128) NOT NULL,
+  UNIQUE(post_id, position),
+  UNIQUE(post_id, id)
+);
+
+-- the users who voted in a poll, the row of a user is inserted first by the
+-- transaction of their vote so a second vote waits for the first and fails
+CREATE TABLE IF NOT EXISTS poll_voters (
+  post_id int REFERENCES polls(post_id) ON DELETE CASCADE NOT NULL,
+  user_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  PRIMARY KEY(post_id, user_id)
+);
+
+-- a user votes for an option once, and only once per poll unless it is a
+-- multiple choice poll; multiple is copied from the poll so the constraint
+-- can be enforced by a partial index
+CREATE TABLE IF NOT EXISTS poll_votes (
+  id serial PRIMARY KEY,
+  post_id int NOT NULL,
+  option_id int NOT NULL,
+  user_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  multiple boolean NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT now(),
+  FOREIGN KEY (post_id, option_id) REFERENCES poll_options(post_id, id) ON DELETE CASCADE,
+  UNIQUE(option_id, user_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS poll_votes_single_choice_idx ON poll_votes(post_id, user_id) WHERE NOT multiple;
+CREATE INDEX IF NOT EXISTS poll_votes_user_idx ON poll_votes(post_id, user_id);
@@ -0,0 +1,38 @@
+-- direct messages between two users; every conversation has a row per member
+-- holding the other member and the last message the member has read
+CREATE TABLE IF NOT EXISTS conversations (
+  id serial PRIMARY KEY,
+  started_by int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT now(),
+  last_message_at timestamp(0) with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS conversation_members (
+  id serial PRIMARY KEY,
+  conversation_id int REFERENCES conversations(id) ON DELETE CASCADE NOT NULL,
+  user_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  other_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  last_read_message_id int NOT NULL DEFAULT 0,
+  UNIQUE(conversation_id, user_id),
+  UNIQUE(user_id, other_id)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+  id serial PRIMARY KEY,
+  conversation_id int REFERENCES conversations(id) ON DELETE CASCADE NOT NULL,
+  sender_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  content varchar(2048) NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS messages_conversation_idx ON messages(conversation_id, created);
+CREATE INDEX IF NOT EXISTS messages_sender_idx ON messages(sender_id, created);
+
+-- users who blocked another user cannot message each other
+CREATE TABLE IF NOT EXISTS user_blocks (
+  id serial PRIMARY KEY,
+  user_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  blocked_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT now(),
+  UNIQUE(user_id, blocked_id)
+);
@@ -0,0 +1,15 @@
+-- token buckets of the rate limiter when they are kept in PostgreSQL, the
+-- times keep fractions of seconds since tokens come back continuously
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+  key text PRIMARY KEY,
+  tokens double precision NOT NULL,
+  updated_at timestamp with time zone NOT NULL,
+  full_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_full_at_idx ON rate_limits(full_at);
+
+-- failed logins since the last successful one, past a few of them the
+-- account is locked for longer and longer
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_logins int NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until timestamp(0) with time zone;
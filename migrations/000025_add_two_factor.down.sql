@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS site_settings;
+DROP TABLE IF EXISTS recovery_codes;
+ALTER TABLE users DROP COLUMN IF EXISTS totp_step;
+ALTER TABLE users DROP COLUMN IF EXISTS totp_secret;
@@ -0,0 +1,23 @@
+-- secret of the authenticator app of the user encrypted with the TOTP_KEY of
+-- the application, NULL while two-factor authentication is off; totp_step is
+-- the time step of the last accepted code so a code cannot be used twice
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret bytea;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_step bigint NOT NULL DEFAULT 0;
+
+-- single-use codes to log in without the authenticator, only their hashes
+-- are kept
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  id serial PRIMARY KEY,
+  user_id int REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+  hash bytea NOT NULL,
+  used_at timestamp(0) with time zone,
+  UNIQUE(user_id, hash)
+);
+
+-- settings of the whole site changed by the admins, it has a single row
+CREATE TABLE IF NOT EXISTS site_settings (
+  id int PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+  require_moderator_2fa bool NOT NULL DEFAULT false
+);
+
+INSERT INTO site_settings(id) VALUES (1) ON CONFLICT DO NOTHING;
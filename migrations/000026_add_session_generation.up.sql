@@ -0,0 +1,3 @@
+-- sessions remember the generation of the user they were logged in with,
+-- incrementing it logs the user out of every session at once
+ALTER TABLE users ADD COLUMN IF NOT EXISTS session_generation int NOT NULL DEFAULT 0;
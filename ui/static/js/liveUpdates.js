@@ -0,0 +1,41 @@
+// Pages with a data-events attribute follow the Server-Sent Events of that
+// URL. Every event is a fragment of HTML: elements with a data-append
+// selector add their children to that element, other elements replace the
+// element of the page with the same id.
+function followEvents(root) {
+  const source = new EventSource(root.dataset.events);
+
+  const apply = (event) => {
+    const template = document.createElement("template");
+    template.innerHTML = event.data;
+
+    for (const node of Array.from(template.content.children)) {
+      if (node.dataset.append) {
+        const target = document.querySelector(node.dataset.append);
+        if (!target) {
+          continue;
+        }
+        for (const child of Array.from(node.children)) {
+          // the author of a comment already sees it after the redirect
+          if (child.id && document.getElementById(child.id)) {
+            continue;
+          }
+          target.append(child);
+          htmx.process(child);
+        }
+      } else if (node.id) {
+        const current = document.getElementById(node.id);
+        if (current) {
+          current.replaceWith(node);
+        }
+      }
+    }
+  };
+
+  source.addEventListener("comment", apply);
+  source.addEventListener("likes", apply);
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  document.querySelectorAll("[data-events]").forEach(followEvents);
+});